@@ -13,6 +13,8 @@ func main() {
 		os.Getenv("LOG_LEVEL"),
 		getEnv("SSL_ENABLED", "1"), // Default to HTTPS enabled
 		os.Getenv("STALENESS_CHECK"),
+		os.Getenv("SHUTDOWN_TIMEOUT"),
+		os.Getenv("TASK_RETENTION"), // Such as 720h. 0 keeps the task history forever.
 	)
 
 	port := getEnv("DOKEMON_PORT", "9090")
@@ -15,7 +15,9 @@ fi
 # Extract configuration values
 IMAGE=$(echo "$INSPECT_OUTPUT" | jq -r '.[0].Config.Image')
 RESTART_POLICY=$(echo "$INSPECT_OUTPUT" | jq -r '.[0].HostConfig.RestartPolicy.Name')
-VOLUME_MAP=$(echo "$INSPECT_OUTPUT" | jq -r '.[0].HostConfig.Binds[0]')
+VOLUME_MAPS=$(echo "$INSPECT_OUTPUT" | jq -r '.[0].HostConfig.Binds // [] | .[]')
+# The agent keeps its credential in /data, as the token can be used only once
+DATA_MOUNT=$(echo "$INSPECT_OUTPUT" | jq -r '.[0].Mounts // [] | .[] | select(.Destination == "/data") | if .Type == "volume" then .Name else .Source end')
 ENV_VARS=$(echo "$INSPECT_OUTPUT" | jq -r '.[0].Config.Env[] | select(startswith("SERVER_URL=") or startswith("TOKEN="))')
 
 # Generate the run command
@@ -26,8 +28,14 @@ while read -r env_var; do
   RUN_CMD+=" -e \"$env_var\""
 done <<< "$ENV_VARS"
 
-# Add volume mapping
-RUN_CMD+=" -v $VOLUME_MAP"
+# Add volume mappings
+while read -r volume_map; do
+  [ -n "$volume_map" ] && [[ "$volume_map" != *:/data && "$volume_map" != *:/data:* ]] && RUN_CMD+=" -v $volume_map"
+done <<< "$VOLUME_MAPS"
+if [ -z "$DATA_MOUNT" ]; then
+  echo "Warning: $CONTAINER_NAME keeps no volume on /data. Its token is already used, so generate a new one for the new container."
+fi
+RUN_CMD+=" -v ${DATA_MOUNT:-dokemon-agent-data}:/data"
 
 # Add image
 RUN_CMD+=" -d $IMAGE"
@@ -1,14 +1,16 @@
 package agent
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"net"
+	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dokemon-ng/dokemon/pkg/common"
@@ -21,10 +23,10 @@
 )
 
 var (
-	logLevel       string
-	wsUrl          string
-	token          string
-	stalenessCheck string = "ON"
+	cfg           *Config
+	wsUrl         string
+	serverBaseUrl string
+	serverScheme  string
 )
 
 func getArchitecture() string {
@@ -40,245 +42,50 @@ func getArchitecture() string {
 	}
 }
 
-func logAllNetworkInterfaces() {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get network interfaces")
-		return
-	}
-
-	for _, iface := range interfaces {
-		logData := log.Info().
-			Str("interface", iface.Name).
-			Str("flags", iface.Flags.String()).
-			Str("hardware", iface.HardwareAddr.String())
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			logData.Msg("Interface (failed to get addresses)")
-			continue
-		}
-
-		var ips []string
-		for _, addr := range addrs {
-			ipnet, ok := addr.(*net.IPNet)
-			if ok {
-				ips = append(ips, ipnet.IP.String())
-			}
-		}
-		logData.Strs("ips", ips).Msg("Network interface details")
-	}
-}
-
-func getMainIP() string {
-	// Get all relevant IPs
-	localIP := getLocalNetworkIP()
-
-	// Get all network interfaces
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return ""
-	}
-
-	// Collect all ZeroTier IPs (interfaces starting with "zt")
-	var ztIPs []string
-	// Collect all Tailscale IPs (interfaces starting with "tailscale")
-	var tsIPs []string
-
-	for _, iface := range interfaces {
-		ifaceName := iface.Name
-
-		// Check for ZeroTier interfaces
-		if strings.HasPrefix(ifaceName, "zt") {
-			if ip := getInterfaceIP(ifaceName); ip != "" {
-				ztIPs = append(ztIPs, "zt:"+ip)
-			}
-		}
-
-		// Check for Tailscale interfaces
-		if strings.HasPrefix(ifaceName, "tailscale") {
-			if ip := getInterfaceIP(ifaceName); ip != "" {
-				tsIPs = append(tsIPs, "ts:"+ip)
-			}
-		}
-	}
-
-	// Build the version string components
-	var components []string
-	if localIP != "" {
-		components = append(components, localIP)
-	}
-	// Add all ZeroTier IPs
-	components = append(components, ztIPs...)
-	// Add all Tailscale IPs
-	components = append(components, tsIPs...)
-
-	if len(components) > 0 {
-		return strings.Join(components, "+")
-	}
-	return ""
-}
-
-func getLocalNetworkIP() string {
-	// Try Docker bridge method first
-	if ip := getHostIPViaDockerBridge(); ip != "" {
-		return ip
-	}
-
-	// Try default route method
-	if ip := getIPFromDefaultRoute(); ip != "" {
-		return ip
+func Main() {
+	parseArgs()
+	setLogLevel(cfg.LogLevel)
+	for _, w := range cfg.warnings {
+		log.Warn().Msg(w)
 	}
-
-	// Try Docker bridge IP method
-	if ip := getIPFromDockerBridge(); ip != "" {
-		return ip
+	if cfg.StalenessCheck != "OFF" {
+		go dockerapi.ContainerScheduleRefreshStaleStatusEvery(cfg.stalenessCheckInterval)
 	}
-
-	return ""
+	listen()
 }
 
-func getInterfaceIP(ifaceName string) string {
-	iface, err := net.InterfaceByName(ifaceName)
-	if err != nil {
-		return ""
-	}
-
-	addrs, err := iface.Addrs()
-	if err != nil {
-		return ""
-	}
-
-	for _, addr := range addrs {
-		ipNet, ok := addr.(*net.IPNet)
-		if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() {
-			continue
-		}
-		return ipNet.IP.String()
+func parseArgs() {
+	c, printConfig, err := LoadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-	return ""
-}
-
-func getHostIPViaDockerBridge() string {
-	cmd := exec.Command("sh", "-c", "ip route | awk '/default/ {print $3}'")
-	output, err := cmd.Output()
-	if err == nil {
-		gatewayIP := strings.TrimSpace(string(output))
-		if net.ParseIP(gatewayIP) != nil && !isDockerIP(gatewayIP) {
-			log.Debug().Str("source", "docker bridge gateway").Str("ip", gatewayIP).Msg("Found host IP")
-			return gatewayIP
-		}
+	if printConfig && c != nil {
+		c.Print(os.Stdout)
 	}
-	return ""
-}
-
-func getIPFromDefaultRoute() string {
-	ifaces, err := net.Interfaces()
 	if err != nil {
-		return ""
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
 	}
-
-	for _, iface := range ifaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, addr := range addrs {
-			ipNet, ok := addr.(*net.IPNet)
-			if !ok || ipNet.IP.To4() == nil {
-				continue
-			}
-			ip := ipNet.IP.String()
-			if !isDockerIP(ip) {
-				log.Debug().Str("source", "host interface "+iface.Name).Str("ip", ip).Msg("Found host IP")
-				return ip
-			}
-		}
+	if printConfig {
+		os.Exit(0)
 	}
-	return ""
-}
-
-func getIPFromDockerBridge() string {
-	cmd := exec.Command("sh", "-c", "ip -4 addr show docker0 | grep -oP '(?<=inet\\s)\\d+(\\.\\d+){3}'")
-	output, err := cmd.Output()
-	if err == nil {
-		ip := strings.TrimSpace(string(output))
-		if net.ParseIP(ip) != nil {
-			parts := strings.Split(ip, ".")
-			if len(parts) == 4 {
-				parts[3] = fmt.Sprintf("%d", atoi(parts[3])+1)
-				hostIP := strings.Join(parts, ".")
-				log.Debug().Str("source", "docker0 bridge").Str("ip", hostIP).Msg("Derived host IP")
-				return hostIP
-			}
-		}
-	}
-	return ""
-}
+	cfg = c
 
-func atoi(s string) int {
-	i := 0
-	for _, c := range s {
-		i = i*10 + int(c-'0')
+	// Docker clients and the docker CLI used for compose read the daemon from the environment
+	if cfg.DockerHost != "" {
+		os.Setenv("DOCKER_HOST", cfg.DockerHost)
 	}
-	return i
-}
 
-func isDockerIP(ip string) bool {
-	excludedPrefixes := []string{
-		"172.17.", "172.18.", "172.19.", "172.20.",
-		"192.168.99.", "100.", "169.254.", "127.",
-	}
-	for _, prefix := range excludedPrefixes {
-		if strings.HasPrefix(ip, prefix) {
-			return true
-		}
-	}
-	return false
-}
-
-func getFullVersion() string {
-	ip := getMainIP()
-	if ip != "" {
-		return fmt.Sprintf("%s-%s@%s", common.Version, getArchitecture(), ip)
-	}
-	return fmt.Sprintf("%s-%s", common.Version, getArchitecture())
-}
-
-func Main() {
-	parseArgs()
-	setLogLevel(logLevel)
-	if stalenessCheck != "OFF" {
-		go dockerapi.ContainerScheduleRefreshStaleStatus()
-	}
-	listen()
-}
-
-func parseArgs() {
-	logLevel = os.Getenv("LOG_LEVEL")
-	serverUrl := os.Getenv("SERVER_URL")
-	token = os.Getenv("TOKEN")
-	stalenessCheck = os.Getenv("STALENESS_CHECK")
-
-	serverScheme := "ws"
-	if strings.HasPrefix(serverUrl, "https") {
+	// Validated to be an http or https URL
+	u, _ := url.Parse(strings.TrimSuffix(cfg.ServerUrl, "/"))
+	serverScheme = "ws"
+	if u.Scheme == "https" {
 		serverScheme = "wss"
 	}
+	wsUrl = fmt.Sprintf("%s://%s%s/ws", serverScheme, u.Host, u.Path)
+	serverBaseUrl = u.String()
 
-	urlParts := strings.Split(serverUrl, "//")
-	if len(urlParts) != 2 {
-		panic("Invalid SERVER_URL " + serverUrl)
-	}
-
-	host := urlParts[1]
-	wsUrl = fmt.Sprintf("%s://%s/ws", serverScheme, host)
-
-	log.Info().Str("url", wsUrl).Msgf("Starting Dokemon Agent %s", getFullVersion())
+	log.Info().Str("url", wsUrl).Msgf("Starting Dokemon Agent %s-%s", common.Version, getArchitecture())
 	log.Info().Str("url", wsUrl).Msg("Server set to URL")
 }
 
@@ -304,30 +111,31 @@ func setLogLevel(logLevel string) {
 	}
 }
 
-func open() *websocket.Conn {
+func open(credential string) (*websocket.Conn, error) {
 	log.Debug().Str("url", wsUrl).Msg("Opening connection to server")
 
-	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	config, err := tlsConfig(credential)
 	if err != nil {
-		log.Fatal().Err(err).Str("url", wsUrl).Msg("Error opening connection")
+		log.Error().Err(err).Str("url", wsUrl).Msg("Error preparing TLS configuration")
+		return nil, err
 	}
 
-	return c
-}
-
-func openWithPing() (*websocket.Conn, *sync.Mutex) {
-	c := open()
-	mu := setupPinging(c)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = config
+	dialer.Proxy = proxy
+	c, _, err := dialer.Dial(wsUrl, nil)
+	if err != nil {
+		log.Error().Err(err).Str("url", wsUrl).Msg("Error opening connection")
+		return nil, err
+	}
 
-	return c, mu
+	return c, nil
 }
 
-func setupPinging(ws *websocket.Conn) *sync.Mutex {
+func setupPinging(ws *websocket.Conn, session *messages.Session) {
 	pongWait := 10 * time.Second
 	pingPeriod := (pongWait * 9) / 10
 
-	var mu sync.Mutex
-
 	ws.SetPongHandler(func(string) error {
 		log.Trace().Msg("Pong received")
 		ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -337,11 +145,10 @@ func setupPinging(ws *websocket.Conn) *sync.Mutex {
 	pingTicker := time.NewTicker(pingPeriod)
 
 	go func() {
+		defer pingTicker.Stop()
 		for range pingTicker.C {
 			log.Trace().Msg("Ping sent")
-			mu.Lock()
-			err := ws.WriteMessage(websocket.PingMessage, nil)
-			mu.Unlock()
+			err := session.WriteMessage(websocket.PingMessage, nil)
 			if err != nil {
 				if err.Error() != "websocket: close sent" {
 					log.Debug().Err(err).Msg("Error when sending Ping control message")
@@ -349,9 +156,7 @@ func setupPinging(ws *websocket.Conn) *sync.Mutex {
 				return
 			}
 
-			mu.Lock()
-			err = messages.Send[messages.Ping](ws, messages.Ping{})
-			mu.Unlock()
+			err = messages.Send[messages.Ping](session, messages.Ping{})
 			if err != nil {
 				if err.Error() != "websocket: close sent" {
 					log.Debug().Err(err).Msg("Error when sending Ping application message")
@@ -360,80 +165,161 @@ func setupPinging(ws *websocket.Conn) *sync.Mutex {
 			}
 		}
 	}()
-
-	return &mu
 }
 
+// listen keeps the agent connected to the server. Whenever the connection can't be opened or
+// is lost, it waits with jittered exponential backoff and connects again. It only returns
+// when the agent is interrupted.
 func listen() {
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	common.LogNetworkInfo(common.GetNetworkInfo())
+
+	b := newBackoff(reconnectMinDelay, reconnectMaxDelay)
+	var reconnectCount uint
+	lastError := ""
+
+	for {
+		connected, err := connectAndListen(interrupt, reconnectCount, lastError)
+		if err == nil {
+			return
+		}
+
+		if connected {
+			b.reset()
+		}
+		reconnectCount++
+		lastError = err.Error()
+
+		delay := b.next()
+		log.Warn().Err(err).Uint("reconnectCount", reconnectCount).Dur("delay", delay).Msg("Reconnecting to server")
+
+		select {
+		case <-interrupt:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
 
+// connectAndListen runs one connection to the server until it is lost or the agent is
+// interrupted. It returns a nil error only when interrupted. connected reports whether the
+// server accepted the connection before it was lost.
+func connectAndListen(interrupt <-chan os.Signal, reconnectCount uint, lastError string) (connected bool, _ error) {
 	log.Info().Msg("Connecting to server")
-	c, mu := openWithPing()
+	credential, err := getCredential()
+	if err != nil {
+		return false, err
+	}
+
+	c, err := open(credential)
+	if err != nil {
+		return false, err
+	}
 	defer c.Close()
 
-	// Log all network interfaces for debugging
-	logAllNetworkInterfaces()
+	// All tasks are multiplexed over this connection so every write goes through the session
+	session := messages.NewSession(c, messages.ProtocolVersion)
+	setupPinging(c, session)
 
-	mu.Lock()
+	// Gathered on every connection as addresses may have changed while disconnected
+	network := common.GetNetworkInfo()
 	initialConnectMessage := messages.ConnectMessage{
-		ConnectionToken: token,
-		AgentVersion:    getFullVersion(),
+		ConnectionToken: credential,
+		AgentVersion:    common.Version,
+		Network:         &network,
 		AgentArch:       getArchitecture(),
+		TaskTypes:       supportedTaskTypes(),
+		ReconnectCount:  reconnectCount,
+		ProtocolVersion: messages.ProtocolVersion,
+		LastError:       lastError,
+	}
+	err = messages.Send[messages.ConnectMessage](session, initialConnectMessage)
+	if err != nil {
+		return false, err
 	}
-	messages.Send[messages.ConnectMessage](c, initialConnectMessage)
-	mu.Unlock()
 
 	connectResponse, err := messages.Receive[messages.ConnectResponseMessage](c)
 	if err != nil {
-		log.Fatal().Err(err)
+		return false, err
 	}
 	if connectResponse == nil {
-		log.Fatal().Msg("Connection with server failed")
+		return false, errors.New("connection with server failed")
 	} else if !connectResponse.Success {
-		log.Fatal().Msg(connectResponse.Message)
+		log.Error().Str("serverError", connectResponse.Message).Msg("Server rejected connection")
+		discardClientCertificate()
+		return false, errors.New(connectResponse.Message)
 	}
 
+	go replacedCleanup.Do(removeReplacedContainer)
+
 	log.Info().Msg("Listening for tasks")
-	done := make(chan struct{})
+	pool := newWorkerPool(cfg.RequestWorkers, cfg.StreamWorkers, cfg.TaskQueueSize)
+	pool.start(session)
+	defer pool.close()
+
+	done := make(chan error, 1)
 	go func() {
-		defer close(done)
-		listenForTasks(c)
+		done <- listenForTasks(c, session, pool)
 	}()
 
-	for {
-		select {
-		case <-done:
-			return
-		case <-interrupt:
-			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			return
+	select {
+	case err := <-done:
+		return true, err
+	case <-interrupt:
+		// Tasks keep running over the connection while they are drained
+		log.Info().Dur("timeout", cfg.shutdownTimeout).Msg("Shutting down. Waiting for running tasks to end")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+		err := pool.drain(ctx)
+		cancel()
+		if err != nil {
+			log.Warn().Err(err).Msg("Shutdown timeout reached. Ending running tasks")
 		}
+
+		session.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Agent is shutting down"))
+		return true, nil
 	}
 }
 
-func listenForTasks(c *websocket.Conn) {
-	taskChan := make(chan string, 100)
-	go worker(taskChan)
+func listenForTasks(c *websocket.Conn, session *messages.Session, pool *workerPool) error {
 
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			log.Error().Err(err).Msg("Connection lost to server")
-			return
+			session.Shutdown(err)
+			return err
+		}
+
+		messageString := string(message)
+		messageType := messages.TypeOf(messageString)
+		if session.Dispatch(messageType, messageString) {
+			continue
 		}
-		log.Debug().Str("message", string(message)).Msg("Task received")
-		taskChan <- string(message)
-	}
-}
 
-func worker(taskChan <-chan string) {
-	for task := range taskChan {
-		taskQueuedMessage, err := messages.Parse[messages.TaskQueuedMessage](task)
+		if messageType != "StreamOpenMessage" {
+			log.Debug().Str("messageType", messageType).Msg("Unexpected message received from server")
+			continue
+		}
+
+		m, err := messages.Parse[messages.StreamOpenMessage](messageString)
+		if err != nil || m == nil {
+			log.Error().Err(err).Msg("Invalid task received")
+			continue
+		}
+
+		stream, err := session.Accept(m.StreamId)
 		if err != nil {
+			log.Error().Err(err).Str("taskId", m.StreamId).Msg("Error while accepting task stream")
 			continue
 		}
 
-		go startTaskSession(*taskQueuedMessage)
+		log.Debug().Str("taskId", m.StreamId).Str("message", m.TaskDefinition).Msg("Task received")
+		err = pool.submit(messages.QueuedTask{Stream: stream, TaskDefinition: m.TaskDefinition})
+		if err != nil {
+			log.Warn().Err(err).Str("taskId", m.StreamId).Msg("Task rejected")
+			go rejectTask(stream, err)
+		}
 	}
 }
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	reconnectMinDelay = 1 * time.Second
+	reconnectMaxDelay = 1 * time.Minute
+)
+
+// backoff computes reconnect delays that double on every attempt up to max. Half of each delay
+// is randomized so that agents don't all reconnect at the same moment after a server restart.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newBackoff(minDelay time.Duration, maxDelay time.Duration) *backoff {
+	return &backoff{min: minDelay, max: maxDelay}
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		d = min(b.min<<b.attempt, b.max)
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,321 @@
+package agent
+
+import (
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the agent configuration. Every setting can be given in the YAML config file, as
+// an environment variable or as a command-line flag. Flags override environment variables,
+// which override the config file.
+type Config struct {
+	ServerUrl              string   `yaml:"server_url"`
+	Token                  string   `yaml:"token"`      // Enrollment token, or credential for agents registered before enrollment tokens
+	TokenFile              string   `yaml:"token_file"` // File containing the token, for use with secrets
+	DataPath               string   `yaml:"data_path"`  // Where the credential and client certificate are kept across restarts
+	LogLevel               string   `yaml:"log_level"`
+	CAFingerprint          string   `yaml:"ca_fingerprint"` // Pinned SHA-256 fingerprint of the server CA
+	CAFile                 string   `yaml:"ca_file"`        // PEM file with the CAs trusted for the server certificate
+	Proxy                  string   `yaml:"proxy"`          // Proxy for connections to the server. Defaults to HTTPS_PROXY.
+	StalenessCheck         string   `yaml:"staleness_check"`
+	StalenessCheckInterval string   `yaml:"staleness_check_interval"`
+	AllowedTaskTypes       []string `yaml:"allowed_task_types"` // Task types the agent runs. Empty for all.
+	DockerHost             string   `yaml:"docker_host"`
+	AgentContainer         string   `yaml:"agent_container"`  // Name of the agent container, when it can't be detected
+	RequestWorkers         int      `yaml:"request_workers"`  // Tasks run at once in the request lane
+	StreamWorkers          int      `yaml:"stream_workers"`   // Tasks run at once in the stream lane
+	TaskQueueSize          int      `yaml:"task_queue_size"`  // Tasks waiting per lane before new ones are rejected
+	ShutdownTimeout        string   `yaml:"shutdown_timeout"` // Time allowed for running tasks to end on shutdown
+
+	// Derived from the settings above by validate
+	token                  string
+	rootCAs                *x509.CertPool
+	proxyUrl               *url.URL
+	stalenessCheckInterval time.Duration
+	shutdownTimeout        time.Duration
+	warnings               []string // Settings which were accepted but should be fixed
+}
+
+// configOption binds a setting to its environment variable and flag.
+type configOption struct {
+	name  string // Flag name
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var configOptions = []configOption{
+	{"server-url", "SERVER_URL", "URL of the Dokemon server, such as https://dokemon.example.com:9443", setString(func(c *Config) *string { return &c.ServerUrl })},
+	{"token", "TOKEN", "enrollment token of the node", setString(func(c *Config) *string { return &c.Token })},
+	{"token-file", "TOKEN_FILE", "file containing the enrollment token", setString(func(c *Config) *string { return &c.TokenFile })},
+	{"data-path", "DATA_PATH", "directory where the credential and client certificate are kept", setString(func(c *Config) *string { return &c.DataPath })},
+	{"log-level", "LOG_LEVEL", "TRACE, DEBUG, INFO, WARN, ERROR, FATAL or PANIC", setString(func(c *Config) *string { return &c.LogLevel })},
+	{"ca-fingerprint", "CA_FINGERPRINT", "SHA-256 fingerprint of the server CA to pin", setString(func(c *Config) *string { return &c.CAFingerprint })},
+	{"ca-file", "CA_FILE", "PEM file with the CAs trusted for the server certificate", setString(func(c *Config) *string { return &c.CAFile })},
+	{"proxy", "PROXY_URL", "proxy for connections to the server", setString(func(c *Config) *string { return &c.Proxy })},
+	{"staleness-check", "STALENESS_CHECK", "ON or OFF", setString(func(c *Config) *string { return &c.StalenessCheck })},
+	{"staleness-check-interval", "STALENESS_CHECK_INTERVAL", "interval between container staleness checks, such as 24h", setString(func(c *Config) *string { return &c.StalenessCheckInterval })},
+	{"allowed-task-types", "ALLOWED_TASK_TYPES", "comma separated task types the agent runs, all when empty", func(c *Config, v string) error { c.AllowedTaskTypes = splitList(v); return nil }},
+	{"docker-host", "DOCKER_HOST", "Docker daemon socket", setString(func(c *Config) *string { return &c.DockerHost })},
+	{"agent-container", "AGENT_CONTAINER", "name of the agent container, when it can't be detected", setString(func(c *Config) *string { return &c.AgentContainer })},
+	{"request-workers", "REQUEST_WORKERS", "number of short request/response tasks run at once", setInt(func(c *Config) *int { return &c.RequestWorkers })},
+	{"stream-workers", "STREAM_WORKERS", "number of streaming tasks, such as logs, terminals and compose deployments, run at once", setInt(func(c *Config) *int { return &c.StreamWorkers })},
+	{"task-queue-size", "TASK_QUEUE_SIZE", "number of tasks waiting per lane before new ones are rejected", setInt(func(c *Config) *int { return &c.TaskQueueSize })},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "time allowed for running tasks to end on shutdown, such as 1m", setString(func(c *Config) *string { return &c.ShutdownTimeout })},
+}
+
+var logLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL", "PANIC"}
+
+func defaultConfig() Config {
+	return Config{
+		DataPath:               "/data",
+		LogLevel:               "INFO",
+		StalenessCheck:         "ON",
+		StalenessCheckInterval: "24h",
+		RequestWorkers:         max(4, 2*runtime.NumCPU()),
+		StreamWorkers:          16,
+		TaskQueueSize:          100,
+		ShutdownTimeout:        "1m",
+	}
+}
+
+func setString(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// LoadConfig builds the configuration from the config file, the environment and the given
+// command-line arguments. printConfig is set when --print-config is given.
+func LoadConfig(args []string, getenv func(string) string, output io.Writer) (c *Config, printConfig bool, err error) {
+	fs := flag.NewFlagSet("dokemon-agent", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configFile := fs.String("config", getenv("AGENT_CONFIG"), "YAML config file (env AGENT_CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	flagValues := make(map[string]*string, len(configOptions))
+	for _, o := range configOptions {
+		flagValues[o.name] = fs.String(o.name, "", fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	config := defaultConfig()
+	if *configFile != "" {
+		err := readConfigFile(*configFile, &config)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var errs []error
+	for _, o := range configOptions {
+		if v := getenv(o.env); v != "" {
+			if err := o.set(&config, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", o.env, err))
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range configOptions {
+			if o.name == f.Name {
+				if err := o.set(&config, *flagValues[o.name]); err != nil {
+					errs = append(errs, fmt.Errorf("--%s: %w", o.name, err))
+				}
+			}
+		}
+	})
+
+	return &config, printConfig, errors.Join(append(errs, config.validate())...)
+}
+
+func readConfigFile(path string, c *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	err = d.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// validate checks every setting and reports all problems at once.
+func (c *Config) validate() error {
+	var errs []error
+	invalid := func(setting string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
+	}
+
+	if c.ServerUrl == "" {
+		invalid("server_url", "is required")
+	} else if u, err := url.Parse(c.ServerUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("server_url", "must be an http or https URL such as https://dokemon.example.com:9443, got %q", redactUrl(c.ServerUrl))
+	}
+
+	c.token = c.Token
+	switch {
+	case c.Token != "" && c.TokenFile != "":
+		invalid("token_file", "can't be used together with token")
+	case c.TokenFile != "":
+		b, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			invalid("token_file", "%v", err)
+		}
+		c.token = strings.TrimSpace(string(b))
+	case c.Token == "":
+		invalid("token", "is required. Set token or token_file")
+	}
+
+	if c.DataPath == "" {
+		invalid("data_path", "is required")
+	}
+
+	c.LogLevel = strings.ToUpper(c.LogLevel)
+	if !slices.Contains(logLevels, c.LogLevel) {
+		invalid("log_level", "must be one of %s, got %q", strings.Join(logLevels, ", "), c.LogLevel)
+	}
+
+	if c.CAFingerprint != "" && c.CAFile != "" {
+		invalid("ca_file", "can't be used together with ca_fingerprint")
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			invalid("ca_file", "%v", err)
+		} else {
+			c.rootCAs = x509.NewCertPool()
+			if !c.rootCAs.AppendCertsFromPEM(pem) {
+				invalid("ca_file", "no PEM encoded certificate found in %s", c.CAFile)
+			}
+		}
+	}
+	if (c.CAFingerprint != "" || c.CAFile != "") && strings.HasPrefix(c.ServerUrl, "http:") {
+		invalid("server_url", "must use https when ca_fingerprint or ca_file is set")
+	}
+
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("proxy", "must be a URL such as http://proxy:3128, got %q", redactUrl(c.Proxy))
+		}
+		c.proxyUrl = u
+	}
+
+	// Agents have always taken anything but OFF as on, so other values are only warned about
+	c.StalenessCheck = strings.ToUpper(c.StalenessCheck)
+	if c.StalenessCheck != "ON" && c.StalenessCheck != "OFF" {
+		c.warnings = append(c.warnings, fmt.Sprintf("staleness_check: should be ON or OFF, got %q. Taken as ON", c.StalenessCheck))
+		c.StalenessCheck = "ON"
+	}
+	interval, err := time.ParseDuration(c.StalenessCheckInterval)
+	if err != nil || interval < time.Minute {
+		invalid("staleness_check_interval", "must be a duration of at least 1m such as 24h, got %q", c.StalenessCheckInterval)
+	}
+	c.stalenessCheckInterval = interval
+
+	if c.RequestWorkers < 1 {
+		invalid("request_workers", "must be at least 1, got %d", c.RequestWorkers)
+	}
+	if c.StreamWorkers < 1 {
+		invalid("stream_workers", "must be at least 1, got %d", c.StreamWorkers)
+	}
+	if c.TaskQueueSize < 1 {
+		invalid("task_queue_size", "must be at least 1, got %d", c.TaskQueueSize)
+	}
+
+	shutdownTimeout, err := time.ParseDuration(c.ShutdownTimeout)
+	if err != nil || shutdownTimeout < 0 {
+		invalid("shutdown_timeout", "must be a duration such as 1m, got %q", c.ShutdownTimeout)
+	}
+	c.shutdownTimeout = shutdownTimeout
+
+	var unknown []string
+	for _, t := range c.AllowedTaskTypes {
+		if _, ok := taskHandlers[t]; !ok {
+			unknown = append(unknown, t)
+		}
+	}
+	if len(unknown) > 0 {
+		invalid("allowed_task_types", "unknown task types %s", strings.Join(unknown, ", "))
+	}
+
+	return errors.Join(errs...)
+}
+
+// isTaskTypeAllowed reports whether the agent runs tasks of the type.
+func (c *Config) isTaskTypeAllowed(taskType string) bool {
+	return len(c.AllowedTaskTypes) == 0 || slices.Contains(c.AllowedTaskTypes, taskType)
+}
+
+// Print writes the configuration as YAML with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	if redacted.Token != "" {
+		redacted.Token = "<redacted>"
+	}
+	redacted.ServerUrl = redactUrl(redacted.ServerUrl)
+	redacted.Proxy = redactUrl(redacted.Proxy)
+
+	e := yaml.NewEncoder(w)
+	defer e.Close()
+
+	return e.Encode(redacted)
+}
+
+// redactUrl hides the user and password of a URL, which may be given for the server or the
+// proxy.
+func redactUrl(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	u.User = url.User("redacted")
+
+	return u.String()
+}
+
+func splitList(v string) []string {
+	var l []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			l = append(l, item)
+		}
+	}
+
+	return l
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/rs/zerolog/log"
+)
+
+const requestTimeout = 30 * time.Second
+
+var (
+	credentialMu sync.Mutex
+	credential   string
+)
+
+// storedCredential is kept in the data path so that the agent can reconnect after a restart.
+// The enrollment token can only be used once.
+type storedCredential struct {
+	TokenHash  string `json:"tokenHash"` // Hash of the TOKEN the credential was obtained with
+	Credential string `json:"credential"`
+}
+
+// httpStatusError is returned by post when the server responds with an error.
+type httpStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.StatusCode)
+}
+
+// getCredential returns the credential used to connect to the server. On first start it
+// exchanges the enrollment token for one. When the token is changed, for example to register the
+// node again, the stored credential is replaced.
+func getCredential() (string, error) {
+	credentialMu.Lock()
+	defer credentialMu.Unlock()
+
+	if credential != "" {
+		return credential, nil
+	}
+
+	tokenHash := crypto.HashString(cfg.token)
+	stored, err := loadCredential()
+	if err == nil && stored.TokenHash == tokenHash {
+		credential = stored.Credential
+		return credential, nil
+	}
+
+	log.Info().Msg("Exchanging enrollment token for credential")
+	var r messages.EnrollResponse
+	err = post(serverTLSConfig(), "/agent/enroll", messages.EnrollRequest{Token: cfg.token}, &r)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without enrollment tokens take the token as it is
+		credential = cfg.token
+		return credential, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("enrollment failed: %w", err)
+	}
+
+	// The server invalidates the client certificate of the node when it enrolls again
+	if r.Credential != cfg.token {
+		discardClientCertificate()
+	}
+
+	err = saveCredential(storedCredential{TokenHash: tokenHash, Credential: r.Credential})
+	if err != nil {
+		log.Warn().Err(err).Str("path", cfg.DataPath).Msg("Error while saving credential. The agent will need a new token when restarted")
+	}
+	credential = r.Credential
+
+	return credential, nil
+}
+
+// setCredential stores a rotated credential. The in-memory credential is only replaced once
+// it has been saved so that a restart never loses it.
+func setCredential(newCredential string) error {
+	credentialMu.Lock()
+	defer credentialMu.Unlock()
+
+	err := saveCredential(storedCredential{TokenHash: crypto.HashString(cfg.token), Credential: newCredential})
+	if err != nil {
+		return err
+	}
+	credential = newCredential
+
+	return nil
+}
+
+func credentialPath() string {
+	return path.Join(cfg.DataPath, "credential.json")
+}
+
+func loadCredential() (*storedCredential, error) {
+	b, err := os.ReadFile(credentialPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storedCredential
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+func saveCredential(stored storedCredential) error {
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(cfg.DataPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a partial credential
+	tmpPath := credentialPath() + ".tmp"
+	err = os.WriteFile(tmpPath, b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, credentialPath())
+}
+
+// post sends a JSON request to an agent endpoint of the server.
+func post(config *tls.Config, endpoint string, req any, res any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{TLSClientConfig: config, Proxy: proxy},
+		Timeout:   requestTimeout,
+	}
+	r, err := client.Post(serverBaseUrl+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		var e struct {
+			Errors struct {
+				Body string `json:"body"`
+			} `json:"errors"`
+		}
+		json.NewDecoder(r.Body).Decode(&e)
+		return &httpStatusError{StatusCode: r.StatusCode, Message: e.Errors.Body}
+	}
+
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+func handleAgentCredentialRotate(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[messages.AgentCredentialRotate](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = setCredential(m.Credential)
+	if err != nil {
+		err := completedWithFailure(c, "Error while saving credential: "+err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	log.Info().Msg("Credential rotated")
+	err = completedWithSuccess(c, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
@@ -2,16 +2,14 @@
 
 import (
 	"github.com/dokemon-ng/dokemon/pkg/messages"
-
-	"github.com/gorilla/websocket"
 )
 
-func completedWithFailure(ws *websocket.Conn, errorMessage string) error {
+func completedWithFailure(ws *messages.Stream, errorMessage string) error {
 	err := messages.Send[messages.TaskStatusMessage](ws, messages.TaskStatusMessage{Status: "CompletedWithFailure", Result: &errorMessage})
 	return err
 }
 
-func completedWithSuccess(ws *websocket.Conn, result *string) error {
+func completedWithSuccess(ws *messages.Stream, result *string) error {
 	err := messages.Send[messages.TaskStatusMessage](ws, messages.TaskStatusMessage{Status: "CompletedWithSuccess", Result: result})
 	return err
 }
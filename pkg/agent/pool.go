@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Tasks run in one of two lanes, each with its own workers, so that long streaming tasks such
+// as terminals and compose deployments can't hold up the short request/response tasks the UI
+// waits on.
+const (
+	requestLane = "request"
+	streamLane  = "stream"
+)
+
+const (
+	statusReportPeriod = time.Second // Load changes are reported to the server at most this often
+	drainCheckPeriod   = 100 * time.Millisecond
+)
+
+var errShuttingDown = errors.New("Agent is shutting down")
+
+var steamMessageTypes = []string{
+	"DockerContainerLogs", "DockerContainerLogsDownload", "DockerContainerTerminal", "DockerContainerStats", "DockerContainerCreate",
+	"DockerContainerFilesDownload", "DockerContainerFilesUpload",
+	"DockerComposeDeploy", "DockerComposePull", "DockerComposeUp", "DockerComposeDown", "DockerComposeLogs", "DockerComposeStats",
+}
+
+func isStreamTask(messageType string) bool {
+	return slices.Contains(steamMessageTypes, messageType)
+}
+
+type taskLane struct {
+	name    string
+	workers int
+	queue   chan messages.QueuedTask
+	running atomic.Int32
+}
+
+func (l *taskLane) status() messages.TaskLaneStatus {
+	return messages.TaskLaneStatus{
+		Name:      l.name,
+		Workers:   l.workers,
+		Running:   int(l.running.Load()),
+		Queued:    len(l.queue),
+		QueueSize: cap(l.queue),
+	}
+}
+
+// workerPool runs the tasks of one connection with a bounded number of workers per lane.
+// Tasks wait in the queue of their lane while all its workers are busy.
+type workerPool struct {
+	request  *taskLane
+	stream   *taskLane
+	changed  chan struct{} // Signalled whenever the load of a lane changes
+	done     chan struct{}
+	draining atomic.Bool
+}
+
+func newWorkerPool(requestWorkers int, streamWorkers int, queueSize int) *workerPool {
+	return &workerPool{
+		request: &taskLane{name: requestLane, workers: requestWorkers, queue: make(chan messages.QueuedTask, queueSize)},
+		stream:  &taskLane{name: streamLane, workers: streamWorkers, queue: make(chan messages.QueuedTask, queueSize)},
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *workerPool) lanes() []*taskLane {
+	return []*taskLane{p.request, p.stream}
+}
+
+// start starts the workers and reports the load of the lanes on the session until the pool is
+// closed.
+func (p *workerPool) start(session *messages.Session) {
+	for _, l := range p.lanes() {
+		for range l.workers {
+			go p.work(l)
+		}
+	}
+	go p.report(session)
+	p.notify()
+}
+
+// close stops the workers once their running task ends. Queued tasks belong to the lost
+// connection and end with it.
+func (p *workerPool) close() {
+	close(p.done)
+}
+
+// submit queues a task in its lane. It never blocks so that the connection keeps being read
+// while the agent is busy. Tasks are rejected when the queue of their lane is full.
+func (p *workerPool) submit(task messages.QueuedTask) error {
+	if p.draining.Load() || p.isClosed() {
+		return errShuttingDown
+	}
+
+	l := p.request
+	if isStreamTask(messages.TypeOf(task.TaskDefinition)) {
+		l = p.stream
+	}
+
+	select {
+	case l.queue <- task:
+	default:
+		return fmt.Errorf("Agent is busy. %d tasks are already queued in the %s lane", cap(l.queue), l.name)
+	}
+
+	if len(l.queue) > 0 && int(l.running.Load()) >= l.workers {
+		log.Debug().Str("taskId", task.Stream.Id).Str("lane", l.name).Int("queued", len(l.queue)).Msg("All workers busy. Task queued")
+	}
+	p.notify()
+	return nil
+}
+
+func (p *workerPool) work(l *taskLane) {
+	for {
+		var task messages.QueuedTask
+		select {
+		case <-p.done:
+			return
+		case task = <-l.queue:
+		}
+
+		// The task was cancelled or its connection lost while it was waiting
+		if task.Stream.Context().Err() != nil {
+			task.Stream.Close()
+			p.notify()
+			continue
+		}
+		if p.draining.Load() {
+			rejectTask(task.Stream, errShuttingDown)
+			p.notify()
+			continue
+		}
+
+		l.running.Add(1)
+		p.notify()
+		startTaskSession(task)
+		l.running.Add(-1)
+		p.notify()
+	}
+}
+
+// drain stops starting tasks and waits until the running tasks end or the context is done.
+// Queued tasks are failed so that the server can retry them once the agent is back.
+func (p *workerPool) drain(ctx context.Context) error {
+	p.draining.Store(true)
+
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		n := 0
+		for _, l := range p.lanes() {
+			n += int(l.running.Load()) + len(l.queue)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d tasks still running: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// rejectTask ends a task that won't run with the reason.
+func rejectTask(c *messages.Stream, reason error) {
+	defer c.Close()
+
+	err := completedWithFailure(c, reason.Error())
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func (p *workerPool) isClosed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *workerPool) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (p *workerPool) status() messages.AgentStatusMessage {
+	m := messages.AgentStatusMessage{}
+	for _, l := range p.lanes() {
+		m.Lanes = append(m.Lanes, l.status())
+	}
+	return m
+}
+
+// report sends the load of the lanes to the server whenever it changes. Changes in quick
+// succession are coalesced into one message.
+func (p *workerPool) report(session *messages.Session) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.changed:
+		}
+
+		err := messages.Send[messages.AgentStatusMessage](session, p.status())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error while sending agent status")
+			return
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(statusReportPeriod):
+		}
+	}
+}
@@ -1,108 +1,101 @@
 package agent
 
 import (
+	"context"
 	"slices"
-	"strings"
-	"time"
 
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
 	"github.com/rs/zerolog/log"
 )
 
-func startTaskSession(tqm messages.TaskQueuedMessage) {
-	messageType := strings.Split(tqm.TaskDefinition, " ")[0]
-	taskDefinition := tqm.TaskDefinition
+var taskHandlers = map[string]func(c *messages.Stream, messageString string){
+	"AgentCredentialRotate":        handleAgentCredentialRotate,
+	"AgentUpdate":                  handleAgentUpdate,
+	"DockerContainerList":          handleDockerContainerList,
+	"DockerContainerCreate":        handleDockerContainerCreate,
+	"DockerContainerInspect":       handleDockerContainerInspect,
+	"DockerContainerLogs":          handleDockerContainerLogs,
+	"DockerContainerLogsDownload":  handleDockerContainerLogsDownload,
+	"DockerContainerTerminal":      handleDockerContainerTerminal,
+	"DockerContainerStats":         handleDockerContainerStats,
+	"DockerContainerFilesList":     handleDockerContainerFilesList,
+	"DockerContainerFilesDownload": handleDockerContainerFilesDownload,
+	"DockerContainerFilesUpload":   handleDockerContainerFilesUpload,
+	"DockerContainerStart":         handleDockerContainerStart,
+	"DockerContainerStop":          handleDockerContainerStop,
+	"DockerContainerRestart":       handleDockerContainerRestart,
+	"DockerContainerRemove":        handleDockerContainerRemove,
+	"DockerContainerPause":         handleDockerContainerPause,
+	"DockerContainerUnpause":       handleDockerContainerUnpause,
+	"DockerContainerKill":          handleDockerContainerKill,
+	"DockerContainerRename":        handleDockerContainerRename,
+	"DockerContainerRecreate":      handleDockerContainerRecreate,
+	"DockerContainerRecreateStale": handleDockerContainerRecreateStale,
+	"DockerImageList":              handleDockerImageList,
+	"DockerImageRemove":            handleDockerImageRemove,
+	"DockerImagesPrune":            handleDockerImagesPrune,
+	"DockerVolumeCreate":           handleDockerVolumeCreate,
+	"DockerVolumeList":             handleDockerVolumeList,
+	"DockerVolumeRemove":           handleDockerVolumeRemove,
+	"DockerVolumesPrune":           handleDockerVolumesPrune,
+	"DockerNetworkCreate":          handleDockerNetworkCreate,
+	"DockerNetworkList":            handleDockerNetworkList,
+	"DockerNetworkRemove":          handleDockerNetworkRemove,
+	"DockerNetworksPrune":          handleDockerNetworksPrune,
+	"DockerComposeList":            handleDockerComposeList,
+	"DockerComposeGet":             handleDockerComposeGet,
+	"DockerComposeContainerList":   handleDockerComposeContainerList,
+	"DockerComposeLogs":            handleDockerComposeLogs,
+	"DockerComposeStats":           handleDockerComposeStats,
+	"DockerComposeDeploy":          handleDockerComposeDeploy,
+	"DockerComposePull":            handleDockerComposePull,
+	"DockerComposeUp":              handleDockerComposeUp,
+	"DockerComposeDown":            handleDockerComposeDown,
+	"DockerComposeDownNoStreaming": handleDockerComposeDownNoStreaming,
+	"ClusterSwarmNodeList":         handleClusterSwarmNodesList,
+	"SwarmNodeInfoId":              handleGetSwarmNodeById,
+}
 
-	log.Info().Str("messageType", messageType).Msg("Task received")
-	log.Debug().Str("taskId", tqm.TaskId).Msg("Starting task session")
-	c := open()
+// supportedTaskTypes returns the task types advertised to the server in the ConnectMessage.
+// Task types not allowed by the configuration are left out.
+func supportedTaskTypes() []string {
+	taskTypes := make([]string, 0, len(taskHandlers))
+	for taskType := range taskHandlers {
+		if cfg.isTaskTypeAllowed(taskType) {
+			taskTypes = append(taskTypes, taskType)
+		}
+	}
+	slices.Sort(taskTypes)
+	return taskTypes
+}
+
+func startTaskSession(task messages.QueuedTask) {
+	messageType := messages.TypeOf(task.TaskDefinition)
+	taskDefinition := task.TaskDefinition
+	c := task.Stream
 	defer c.Close()
 
-	stream := false
-	steamMessageTypes := []string{
-		"DockerContainerLogs", "DockerContainerTerminal",
-		"DockerComposeDeploy", "DockerComposePull", "DockerComposePull", "DockerComposeUp", "DockerComposeDown", "DockerComposeLogs",
-	}
-	if slices.Contains(steamMessageTypes, messageType) {
-		stream = true
-	}
+	stream := isStreamTask(messageType)
 
-	messages.Send(c, messages.TaskSessionMessage{ConnectionToken: token, TaskId: tqm.TaskId, Stream: stream})
-	taskSessionResponseMessage, err := messages.Receive[messages.TaskSessionResponseMessage](c)
-	if err != nil {
-		log.Error().Str("taskId", tqm.TaskId).Msg("Error while receiving task session response")
-		return
-	}
+	log.Info().Str("messageType", messageType).Msg("Task received")
+	log.Debug().Str("taskId", c.Id).Bool("stream", stream).Msg("Starting task session")
 
-	if !taskSessionResponseMessage.Success {
-		log.Error().Str("taskId", tqm.TaskId).Str("serverError", taskSessionResponseMessage.Message).Msg("Task session establishments failed")
+	handler, ok := taskHandlers[messageType]
+	if !ok || !cfg.isTaskTypeAllowed(messageType) {
+		// The server only sends task types advertised in the ConnectMessage, so this means a
+		// server bug or a tampered message. Fail the task rather than the whole agent.
+		log.Error().Str("messageType", messageType).Msg("Unsupported task type received")
+		err := completedWithFailure(c, "Unsupported task type "+messageType)
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
 		return
 	}
+	handler(c, taskDefinition)
 
-	// We have successfully established the session. Process the task now.
-	switch messageType {
-	case "DockerContainerList":
-		handleDockerContainerList(c, taskDefinition)
-	case "DockerContainerLogs":
-		handleDockerContainerLogs(c, taskDefinition)
-	case "DockerContainerTerminal":
-		handleDockerContainerTerminal(c, taskDefinition)
-	case "DockerContainerStart":
-		handleDockerContainerStart(c, taskDefinition)
-	case "DockerContainerStop":
-		handleDockerContainerStop(c, taskDefinition)
-	case "DockerContainerRestart":
-		handleDockerContainerRestart(c, taskDefinition)
-	case "DockerContainerRemove":
-		handleDockerContainerRemove(c, taskDefinition)
-	case "DockerImageList":
-		handleDockerImageList(c, taskDefinition)
-	case "DockerImageRemove":
-		handleDockerImageRemove(c, taskDefinition)
-	case "DockerImagesPrune":
-		handleDockerImagesPrune(c, taskDefinition)
-	case "DockerVolumeList":
-		handleDockerVolumeList(c, taskDefinition)
-	case "DockerVolumeRemove":
-		handleDockerVolumeRemove(c, taskDefinition)
-	case "DockerVolumesPrune":
-		handleDockerVolumesPrune(c, taskDefinition)
-	case "DockerNetworkList":
-		handleDockerNetworkList(c, taskDefinition)
-	case "DockerNetworkRemove":
-		handleDockerNetworkRemove(c, taskDefinition)
-	case "DockerNetworksPrune":
-		handleDockerNetworksPrune(c, taskDefinition)
-	case "DockerComposeList":
-		handleDockerComposeList(c, taskDefinition)
-	case "DockerComposeGet":
-		handleDockerComposeGet(c, taskDefinition)
-	case "DockerComposeContainerList":
-		handleDockerComposeContainerList(c, taskDefinition)
-	case "DockerComposeLogs":
-		handleDockerComposeLogs(c, taskDefinition)
-	case "DockerComposeDeploy":
-		handleDockerComposeDeploy(c, taskDefinition)
-	case "DockerComposePull":
-		handleDockerComposePull(c, taskDefinition)
-	case "DockerComposeUp":
-		handleDockerComposeUp(c, taskDefinition)
-	case "DockerComposeDown":
-		handleDockerComposeDown(c, taskDefinition)
-	case "DockerComposeDownNoStreaming":
-		handleDockerComposeDownNoStreaming(c, taskDefinition)
-	case "ClusterSwarmNodeList":
-		handleClusterSwarmNodesList(c, taskDefinition)
-	case "SwarmNodeInfoId":
-		handleGetSwarmNodeById(c, taskDefinition)
-	default:
-		panic("Invalid message received")
+	if context.Cause(c.Context()) == messages.ErrTaskCancelled {
+		log.Info().Str("taskId", c.Id).Str("messageType", messageType).Msg("Task cancelled")
 	}
-
-	// Wait until all messages are sent. If we don't sleep here then routine ends and `defer c.Close()` executes closing the
-	// socket before message are sent.
-	time.Sleep(1 * time.Second)
-
-	log.Debug().Str("taskId", tqm.TaskId).Msg("Task session ended")
+	log.Debug().Str("taskId", c.Id).Msg("Task session ended")
 }
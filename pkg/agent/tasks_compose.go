@@ -4,11 +4,10 @@
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func handleDockerComposeList(c *websocket.Conn, messageString string) {
+func handleDockerComposeList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -34,7 +33,7 @@ func handleDockerComposeList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeGet(c *websocket.Conn, messageString string) {
+func handleDockerComposeGet(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeGet](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -64,7 +63,7 @@ func handleDockerComposeGet(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeContainerList(c *websocket.Conn, messageString string) {
+func handleDockerComposeContainerList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeContainerList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -90,7 +89,7 @@ func handleDockerComposeContainerList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeLogs(c *websocket.Conn, messageString string) {
+func handleDockerComposeLogs(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeLogs](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -106,7 +105,23 @@ func handleDockerComposeLogs(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeDeploy(c *websocket.Conn, messageString string) {
+func handleDockerComposeStats(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerComposeStats](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ComposeStats(m, c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerComposeDeploy(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeDeploy](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -122,7 +137,7 @@ func handleDockerComposeDeploy(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposePull(c *websocket.Conn, messageString string) {
+func handleDockerComposePull(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposePull](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -138,7 +153,7 @@ func handleDockerComposePull(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeUp(c *websocket.Conn, messageString string) {
+func handleDockerComposeUp(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeUp](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -154,7 +169,7 @@ func handleDockerComposeUp(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeDown(c *websocket.Conn, messageString string) {
+func handleDockerComposeDown(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeDown](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -170,7 +185,7 @@ func handleDockerComposeDown(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerComposeDownNoStreaming(c *websocket.Conn, messageString string) {
+func handleDockerComposeDownNoStreaming(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerComposeDownNoStreaming](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
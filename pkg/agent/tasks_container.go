@@ -4,11 +4,10 @@
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func handleDockerContainerList(c *websocket.Conn, messageString string) {
+func handleDockerContainerList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -34,7 +33,107 @@ func handleDockerContainerList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerContainerLogs(c *websocket.Conn, messageString string) {
+func handleDockerContainerCreate(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerCreate](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerCreate(m, c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error while creating container")
+	}
+}
+
+func handleDockerContainerInspect(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerInspect](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	res, err := dockerapi.ContainerInspect(m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	resString := string(messages.Serialize[dockerapi.DockerContainerInspectResponse](*res))
+	err = completedWithSuccess(c, &resString)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerFilesList(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerFilesList](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	res, err := dockerapi.ContainerFilesList(m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	resString := string(messages.Serialize[dockerapi.DockerContainerFilesListResponse](*res))
+	err = completedWithSuccess(c, &resString)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerFilesDownload(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerFilesDownload](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerFilesDownload(m, c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error while copying files from container")
+	}
+}
+
+func handleDockerContainerFilesUpload(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerFilesUpload](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerFilesUpload(m, c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error while copying files to container")
+	}
+}
+
+func handleDockerContainerLogs(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerLogs](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -50,7 +149,23 @@ func handleDockerContainerLogs(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerContainerTerminal(c *websocket.Conn, messageString string) {
+func handleDockerContainerLogsDownload(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerLogsDownload](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerLogsDownload(m, c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error while downloading container logs")
+	}
+}
+
+func handleDockerContainerTerminal(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerTerminal](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -66,7 +181,23 @@ func handleDockerContainerTerminal(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerContainerStart(c *websocket.Conn, messageString string) {
+func handleDockerContainerStats(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerStats](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerStats(m, c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerStart(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerStart](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -91,7 +222,7 @@ func handleDockerContainerStart(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerContainerStop(c *websocket.Conn, messageString string) {
+func handleDockerContainerStop(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerStop](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -116,7 +247,7 @@ func handleDockerContainerStop(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerContainerRestart(c *websocket.Conn, messageString string) {
+func handleDockerContainerRestart(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerRestart](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -141,7 +272,7 @@ func handleDockerContainerRestart(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerContainerRemove(c *websocket.Conn, messageString string) {
+func handleDockerContainerRemove(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerContainerRemove](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -165,3 +296,155 @@ func handleDockerContainerRemove(c *websocket.Conn, messageString string) {
 		log.Debug().Err(err).Msg("Error sending message to client")
 	}
 }
+
+func handleDockerContainerPause(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerPause](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerPause(c.Context(), m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = completedWithSuccess(c, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerUnpause(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerUnpause](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerUnpause(c.Context(), m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = completedWithSuccess(c, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerKill(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerKill](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerKill(c.Context(), m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = completedWithSuccess(c, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerRename(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerRename](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = dockerapi.ContainerRename(c.Context(), m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = completedWithSuccess(c, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerRecreate(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerRecreate](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	res, err := dockerapi.ContainerRecreate(c.Context(), m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	resString := string(messages.Serialize[dockerapi.DockerContainerRecreateResponse](*res))
+	err = completedWithSuccess(c, &resString)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerContainerRecreateStale(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerContainerRecreateStale](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	res, err := dockerapi.ContainerRecreateStale(c.Context(), m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	resString := string(messages.Serialize[dockerapi.DockerContainerRecreateStaleResponse](*res))
+	err = completedWithSuccess(c, &resString)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
@@ -4,11 +4,10 @@
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func handleDockerImageList(c *websocket.Conn, messageString string) {
+func handleDockerImageList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerImageList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -34,7 +33,7 @@ func handleDockerImageList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerImageRemove(c *websocket.Conn, messageString string) {
+func handleDockerImageRemove(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerImageRemove](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -59,7 +58,7 @@ func handleDockerImageRemove(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerImagesPrune(c *websocket.Conn, messageString string) {
+func handleDockerImagesPrune(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerImagesPrune](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -4,11 +4,36 @@
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func handleDockerNetworkList(c *websocket.Conn, messageString string) {
+func handleDockerNetworkCreate(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerNetworkCreate](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	res, err := dockerapi.NetworkCreate(m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	resString := string(messages.Serialize[dockerapi.DockerNetworkCreateResponse](*res))
+	err = completedWithSuccess(c, &resString)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerNetworkList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerNetworkList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -34,7 +59,7 @@ func handleDockerNetworkList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerNetworkRemove(c *websocket.Conn, messageString string) {
+func handleDockerNetworkRemove(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerNetworkRemove](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -59,7 +84,7 @@ func handleDockerNetworkRemove(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerNetworksPrune(c *websocket.Conn, messageString string) {
+func handleDockerNetworksPrune(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerNetworksPrune](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -4,11 +4,10 @@
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func handleClusterSwarmNodesList(c *websocket.Conn, messageString string) {
+func handleClusterSwarmNodesList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.ClusterSwarmNodeList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -33,7 +32,7 @@ func handleClusterSwarmNodesList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleGetSwarmNodeById(c *websocket.Conn, messageString string) {
+func handleGetSwarmNodeById(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.SwarmNodeInfoId](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -4,11 +4,36 @@
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
 
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func handleDockerVolumeList(c *websocket.Conn, messageString string) {
+func handleDockerVolumeCreate(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[dockerapi.DockerVolumeCreate](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	res, err := dockerapi.VolumeCreate(m)
+	if err != nil {
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	resString := string(messages.Serialize[dockerapi.DockerVolumeCreateResponse](*res))
+	err = completedWithSuccess(c, &resString)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+func handleDockerVolumeList(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerVolumeList](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -34,7 +59,7 @@ func handleDockerVolumeList(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerVolumeRemove(c *websocket.Conn, messageString string) {
+func handleDockerVolumeRemove(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerVolumeRemove](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -59,7 +84,7 @@ func handleDockerVolumeRemove(c *websocket.Conn, messageString string) {
 	}
 }
 
-func handleDockerVolumesPrune(c *websocket.Conn, messageString string) {
+func handleDockerVolumesPrune(c *messages.Stream, messageString string) {
 	m, err := messages.Parse[dockerapi.DockerVolumesPrune](messageString)
 	if err != nil {
 		err := completedWithFailure(c, "Error parsing request message")
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ssl"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/rs/zerolog/log"
+)
+
+var clientCertificate *tls.Certificate
+
+// Set once the server rejected the client certificate, which is then only presented to enroll
+// for a new one
+var renewClientCertificate bool
+
+// serverTLSConfig returns the TLS configuration trusting only the pinned CA or the configured
+// CA file. It returns nil to verify the server certificate against the system roots.
+func serverTLSConfig() *tls.Config {
+	if serverScheme != "wss" {
+		return nil
+	}
+
+	switch {
+	case cfg.CAFingerprint != "":
+		return ssl.PinnedClientConfig(cfg.CAFingerprint)
+	case cfg.rootCAs != nil:
+		return &tls.Config{RootCAs: cfg.rootCAs}
+	default:
+		return nil
+	}
+}
+
+// proxy is the proxy used for connections to the server.
+func proxy(req *http.Request) (*url.URL, error) {
+	if cfg.proxyUrl != nil {
+		return cfg.proxyUrl, nil
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// tlsConfig returns the TLS configuration for agent connections. When the server CA is
+// configured the agent also authenticates with its client certificate, enrolling for one
+// first if needed.
+func tlsConfig(credential string) (*tls.Config, error) {
+	config := serverTLSConfig()
+	if config == nil {
+		return nil, nil
+	}
+
+	if clientCertificate == nil {
+		cert, err := loadClientCertificate()
+		if err != nil || renewClientCertificate {
+			cert, err = enrollCertificate(config, credential, cert)
+			if err != nil {
+				return nil, err
+			}
+			renewClientCertificate = false
+		}
+		clientCertificate = cert
+	}
+	config.Certificates = []tls.Certificate{*clientCertificate}
+
+	return config, nil
+}
+
+// discardClientCertificate makes the agent enroll again on the next connection. Used when the
+// server rejects the connection, as the certificate is invalidated whenever the agent enrolls
+// again or its token is revoked. The certificate is kept on disk until it is replaced, as the
+// server only issues a new one to the holder of the current one.
+func discardClientCertificate() {
+	clientCertificate = nil
+	renewClientCertificate = true
+}
+
+func certsPath() string {
+	return path.Join(cfg.DataPath, "certs")
+}
+
+func loadClientCertificate() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(path.Join(certsPath(), "agent.crt"), path.Join(certsPath(), "agent.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// enrollCertificate gets a client certificate for a new key, presenting the current
+// certificate if there is one.
+func enrollCertificate(config *tls.Config, credential string, current *tls.Certificate) (*tls.Certificate, error) {
+	log.Info().Msg("Enrolling for client certificate")
+
+	if current != nil {
+		config.Certificates = []tls.Certificate{*current}
+	}
+
+	key, csr, err := ssl.GenerateClientKey("dokemon-agent")
+	if err != nil {
+		return nil, err
+	}
+
+	var r messages.CertificateResponse
+	err = post(config, "/agent/certificate", messages.CertificateRequest{ConnectionToken: credential, CSR: csr}, &r)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate enrollment failed: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(r.Certificate), []byte(key))
+	if err != nil {
+		return nil, errors.Join(errors.New("invalid client certificate received"), err)
+	}
+
+	err = saveClientCertificate(r.Certificate, key)
+	if err != nil {
+		log.Warn().Err(err).Str("path", certsPath()).Msg("Error while saving client certificate. The agent will enroll again when restarted")
+	}
+
+	return &cert, nil
+}
+
+func saveClientCertificate(cert string, key string) error {
+	err := os.MkdirAll(certsPath(), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path.Join(certsPath(), "agent.key"), []byte(key), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(certsPath(), "agent.crt"), []byte(cert), 0644)
+}
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog/log"
+)
+
+// Label set on the container created by an update. It holds the id of the container it
+// replaces, which the new agent removes once it is connected.
+const replacesLabel = "dokemon.agent.replaces"
+
+var replacedCleanup sync.Once
+
+func handleAgentUpdate(c *messages.Stream, messageString string) {
+	m, err := messages.Parse[messages.AgentUpdate](messageString)
+	if err != nil {
+		err := completedWithFailure(c, "Error parsing request message")
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = updateAgent(c.Context(), m)
+	if err != nil {
+		log.Error().Err(err).Msg("Agent update failed")
+		err := completedWithFailure(c, err.Error())
+		if err != nil {
+			log.Debug().Err(err).Msg("Error sending message to client")
+		}
+		return
+	}
+
+	err = completedWithSuccess(c, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error sending message to client")
+	}
+}
+
+// updateAgent pulls the new image and starts a copy of the agent container running it. The
+// current container is renamed and kept until the new agent removes it, so that any failure
+// before the new container starts leaves the current agent in place.
+func updateAgent(ctx context.Context, m *messages.AgentUpdate) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	self, err := selfContainer(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	// The enrollment token is already used, so the new agent only connects with the credential
+	// and client certificate of this one
+	if !dockerapi.ContainerKeepsPath(self, cfg.DataPath) {
+		return fmt.Errorf("%s is not on a volume, so the updated agent would lose its credential. Run the agent with a volume on %s, such as -v dokemon-agent-data:%s, and a new token", cfg.DataPath, cfg.DataPath, cfg.DataPath)
+	}
+
+	ref := m.Image
+	if ref == "" {
+		if m.Tag == "" {
+			return errors.New("Image or tag is required")
+		}
+		ref = withTag(self.Config.Image, m.Tag)
+	}
+
+	log.Info().Str("image", ref).Msg("Updating agent")
+	r, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(self.Name, "/")
+	oldName := name + "-old"
+	err = cli.ContainerRename(ctx, self.ID, oldName)
+	if err != nil {
+		return err
+	}
+
+	rollback := func(newId string) {
+		if newId != "" {
+			cli.ContainerRemove(context.Background(), newId, container.RemoveOptions{Force: true})
+		}
+		cli.ContainerUpdate(context.Background(), self.ID, container.UpdateConfig{RestartPolicy: self.HostConfig.RestartPolicy})
+		cli.ContainerRename(context.Background(), self.ID, name)
+	}
+
+	config := *self.Config
+	config.Image = ref
+	if strings.HasPrefix(self.ID, config.Hostname) {
+		config.Hostname = "" // Generated from the id of the old container
+	}
+	config.Labels = make(map[string]string, len(self.Config.Labels)+1)
+	for k, v := range self.Config.Labels {
+		config.Labels[k] = v
+	}
+	config.Labels[replacesLabel] = self.ID
+
+	// Only one network can be given on create, others are connected afterwards
+	primary, others := dockerapi.ContainerNetworks(self)
+	created, err := cli.ContainerCreate(ctx, &config, self.HostConfig, primary, nil, name)
+	if err != nil {
+		rollback("")
+		return err
+	}
+
+	for networkName, endpoint := range others {
+		err := cli.NetworkConnect(ctx, networkName, created.ID, endpoint)
+		if err != nil {
+			rollback(created.ID)
+			return err
+		}
+	}
+
+	// The old container must not come back if the host restarts before it is removed
+	_, err = cli.ContainerUpdate(ctx, self.ID, container.UpdateConfig{RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyDisabled}})
+	if err != nil {
+		rollback(created.ID)
+		return err
+	}
+
+	err = cli.ContainerStart(ctx, created.ID, container.StartOptions{})
+	if err != nil {
+		rollback(created.ID)
+		return err
+	}
+
+	log.Info().Str("containerId", created.ID).Msg("Updated agent started")
+	return nil
+}
+
+// removeReplacedContainer removes the container of the previous agent after an update. It is
+// called once connected, after the previous agent had time to report the update.
+func removeReplacedContainer() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+
+	self, err := selfContainer(ctx, cli)
+	if err != nil {
+		log.Debug().Err(err).Msg("Agent container not found")
+		return
+	}
+
+	oldId := self.Config.Labels[replacesLabel]
+	if oldId == "" {
+		return
+	}
+
+	err = cli.ContainerRemove(ctx, oldId, container.RemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		log.Error().Err(err).Str("containerId", oldId).Msg("Error while removing previous agent container")
+		return
+	}
+	if err == nil {
+		log.Info().Str("containerId", oldId).Msg("Previous agent container removed")
+	}
+}
+
+// selfContainer finds the container the agent runs in. Agents usually run with host
+// networking where the hostname is not the container id, so it is read from the mounts of the
+// container unless agent_container gives its name.
+func selfContainer(ctx context.Context, cli *client.Client) (*container.InspectResponse, error) {
+	candidates := []string{}
+	if cfg.AgentContainer != "" {
+		candidates = append(candidates, cfg.AgentContainer)
+	}
+	if id := dockerapi.SelfContainerId(); id != "" {
+		candidates = append(candidates, id)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		candidates = append(candidates, hostname)
+	}
+
+	for _, candidate := range candidates {
+		c, err := cli.ContainerInspect(ctx, candidate)
+		if err == nil {
+			return &c, nil
+		}
+	}
+
+	return nil, errors.New("Agent is not running in a container. Set agent_container to the name of its container")
+}
+
+// withTag replaces the tag of an image reference, which may contain a registry port.
+func withTag(ref string, tag string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+
+	return ref + ":" + tag
+}
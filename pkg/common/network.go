@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NetworkInfo describes the network of a host. Agents usually run with host networking so
+// this is the network of the Docker host.
+type NetworkInfo struct {
+	Hostname         string             `json:"hostname"`
+	Interfaces       []NetworkInterface `json:"interfaces"`
+	DefaultGateway   string             `json:"defaultGateway"`
+	DefaultInterface string             `json:"defaultInterface"`
+	PrimaryIp        string             `json:"primaryIp"` // First IPv4 address of the default interface
+	ZeroTierIps      []string           `json:"zeroTierIps"`
+	TailscaleIps     []string           `json:"tailscaleIps"`
+}
+
+type NetworkInterface struct {
+	Name string   `json:"name"`
+	Kind string   `json:"kind"` // zerotier, tailscale, docker, loopback or empty for others
+	Mac  string   `json:"mac"`
+	Up   bool     `json:"up"`
+	IPv4 []string `json:"ipv4"`
+	IPv6 []string `json:"ipv6"`
+}
+
+const (
+	InterfaceKindZeroTier  = "zerotier"
+	InterfaceKindTailscale = "tailscale"
+	InterfaceKindDocker    = "docker"
+	InterfaceKindLoopback  = "loopback"
+)
+
+// GetNetworkInfo gathers the network information of the host. Interfaces without addresses,
+// such as the veth pairs of containers, are left out.
+func GetNetworkInfo() NetworkInfo {
+	info := NetworkInfo{
+		Interfaces:   []NetworkInterface{},
+		ZeroTierIps:  []string{},
+		TailscaleIps: []string{},
+	}
+	info.Hostname, _ = os.Hostname()
+	info.DefaultInterface, info.DefaultGateway = defaultRoute()
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return info
+	}
+
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+
+		ni := NetworkInterface{
+			Name: iface.Name,
+			Kind: interfaceKind(iface),
+			Mac:  iface.HardwareAddr.String(),
+			Up:   iface.Flags&net.FlagUp != 0,
+			IPv4: []string{},
+			IPv6: []string{},
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				ni.IPv4 = append(ni.IPv4, ipNet.IP.String())
+			} else {
+				ni.IPv6 = append(ni.IPv6, ipNet.IP.String())
+			}
+		}
+
+		switch ni.Kind {
+		case InterfaceKindZeroTier:
+			info.ZeroTierIps = append(info.ZeroTierIps, ni.IPv4...)
+		case InterfaceKindTailscale:
+			info.TailscaleIps = append(info.TailscaleIps, ni.IPv4...)
+		}
+		if ni.Name == info.DefaultInterface && len(ni.IPv4) > 0 {
+			info.PrimaryIp = ni.IPv4[0]
+		}
+
+		info.Interfaces = append(info.Interfaces, ni)
+	}
+
+	// Without a default route, e.g. on hosts other than Linux, the first address of a
+	// physical interface is the best guess
+	if info.PrimaryIp == "" {
+		for _, ni := range info.Interfaces {
+			if ni.Up && ni.Kind == "" && len(ni.IPv4) > 0 {
+				info.PrimaryIp = ni.IPv4[0]
+				break
+			}
+		}
+	}
+
+	return info
+}
+
+// LogNetworkInfo logs the network of the host for troubleshooting connectivity.
+func LogNetworkInfo(info NetworkInfo) {
+	log.Info().
+		Str("hostname", info.Hostname).
+		Str("primaryIp", info.PrimaryIp).
+		Str("defaultGateway", info.DefaultGateway).
+		Str("defaultInterface", info.DefaultInterface).
+		Strs("zeroTierIps", info.ZeroTierIps).
+		Strs("tailscaleIps", info.TailscaleIps).
+		Msg("Host network")
+
+	for _, ni := range info.Interfaces {
+		log.Debug().
+			Str("interface", ni.Name).
+			Str("kind", ni.Kind).
+			Str("mac", ni.Mac).
+			Bool("up", ni.Up).
+			Strs("ipv4", ni.IPv4).
+			Strs("ipv6", ni.IPv6).
+			Msg("Network interface")
+	}
+}
+
+func interfaceKind(iface net.Interface) string {
+	switch {
+	case iface.Flags&net.FlagLoopback != 0:
+		return InterfaceKindLoopback
+	case strings.HasPrefix(iface.Name, "zt"):
+		return InterfaceKindZeroTier
+	case strings.HasPrefix(iface.Name, "tailscale"):
+		return InterfaceKindTailscale
+	case iface.Name == "docker0" || strings.HasPrefix(iface.Name, "br-") || strings.HasPrefix(iface.Name, "veth") || iface.Name == "docker_gwbridge":
+		return InterfaceKindDocker
+	default:
+		return ""
+	}
+}
+
+// defaultRoute reads the IPv4 default route from the routing table of the kernel. It returns
+// empty strings where the table isn't available.
+func defaultRoute() (iface string, gateway string) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	return ParseDefaultRoute(bufio.NewScanner(f))
+}
+
+// ParseDefaultRoute parses the routing table in the format of /proc/net/route, where
+// addresses are hex encoded in host byte order.
+func ParseDefaultRoute(s *bufio.Scanner) (iface string, gateway string) {
+	s.Scan() // Header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// Little endian on the architectures agents are built for
+		return fields[0], net.IPv4(b[3], b[2], b[1], b[0]).String()
+	}
+
+	return "", ""
+}
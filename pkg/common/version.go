@@ -0,0 +1,49 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AgentVersionNumber returns the version part of the version reported by an agent. Older
+// agents also report their architecture and addresses, such as 1.7.0b-amd64@192.168.1.2.
+func AgentVersionNumber(agentVersion string) string {
+	version, _, _ := strings.Cut(agentVersion, "-")
+	return version
+}
+
+// CompareVersions compares versions such as 1.7.0b. Dot separated parts are compared as
+// numbers. Letters following a number, such as the b of 1.7.0b, mark a revision of that
+// version and sort after it. It returns -1, 0 or 1 like strings.Compare.
+func CompareVersions(a string, b string) int {
+	aParts := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bParts := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < max(len(aParts), len(bParts)); i++ {
+		aNumber, aSuffix := versionPart(aParts, i)
+		bNumber, bSuffix := versionPart(bParts, i)
+		if aNumber != bNumber {
+			if aNumber < bNumber {
+				return -1
+			}
+			return 1
+		}
+		if c := strings.Compare(aSuffix, bSuffix); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+func versionPart(parts []string, i int) (int, string) {
+	if i >= len(parts) {
+		return 0, ""
+	}
+
+	part := parts[i]
+	digits := len(part) - len(strings.TrimLeft(part, "0123456789"))
+	number, _ := strconv.Atoi(part[:digits])
+
+	return number, part[digits:]
+}
@@ -0,0 +1,336 @@
+package ssl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	caValidity     = 20 * 365 * 24 * time.Hour
+	serverValidity = 10 * 365 * 24 * time.Hour
+	clientValidity = 5 * 365 * 24 * time.Hour
+)
+
+var (
+	ErrFingerprintMismatch = errors.New("server certificate does not match the pinned CA fingerprint")
+	ErrInvalidCSR          = errors.New("invalid certificate signing request")
+)
+
+// CertificateAuthority is the private CA of a Dokemon server. It issues the server certificate
+// and the client certificates agents authenticate with. Agents pin its fingerprint instead of
+// relying on public CAs, so self-signed installations can still use wss.
+type CertificateAuthority struct {
+	Certificate    *x509.Certificate
+	CertificatePEM string
+	key            crypto.Signer
+}
+
+// LoadOrCreateCertificateAuthority loads the CA from the given files, creating it on first use.
+func LoadOrCreateCertificateAuthority(certPath string, keyPath string) (*CertificateAuthority, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		cert, key, err := generateCertificateAuthority()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, []byte(key), 0600); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(certPath, []byte(cert), 0644); err != nil {
+			return nil, err
+		}
+		return ParseCertificateAuthority(cert, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCertificateAuthority(string(certPEM), string(keyPEM))
+}
+
+func ParseCertificateAuthority(certPEM string, keyPEM string) (*CertificateAuthority, error) {
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{Certificate: cert, CertificatePEM: certPEM, key: key}, nil
+}
+
+func generateCertificateAuthority() (cert string, key string, err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return "", "", err
+	}
+
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "Dokemon CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(caValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err = encodePrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return encodeCertificate(derBytes), key, nil
+}
+
+// Fingerprint is the SHA-256 fingerprint of the CA certificate. Agents pin it.
+func (ca *CertificateAuthority) Fingerprint() string {
+	return Fingerprint(ca.Certificate)
+}
+
+// Pool returns a pool containing only the CA, for verifying client certificates.
+func (ca *CertificateAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// IssueServerCertificate issues a certificate for the HTTPS server. The returned certificate
+// PEM contains the whole chain so that agents receive the CA they have pinned.
+func (ca *CertificateAuthority) IssueServerCertificate() (cert string, key string, err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return "", "", err
+	}
+
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "Dokemon Server"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca.Certificate, &privateKey.PublicKey, ca.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err = encodePrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return encodeCertificate(derBytes) + ca.CertificatePEM, key, nil
+}
+
+// SignClientCertificate issues a client certificate for the key in the certificate signing
+// request. The subject of the request is ignored and replaced with commonName.
+func (ca *CertificateAuthority) SignClientCertificate(csrPEM string, commonName string) (string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", ErrInvalidCSR
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", ErrInvalidCSR
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", ErrInvalidCSR
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return "", err
+	}
+
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(clientValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca.Certificate, csr.PublicKey, ca.key)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeCertificate(derBytes), nil
+}
+
+// IsIssuedBy reports whether the leaf of the PEM encoded chain was issued by the CA.
+func (ca *CertificateAuthority) IsIssuedBy(certPEM string) bool {
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return false
+	}
+
+	return cert.CheckSignatureFrom(ca.Certificate) == nil
+}
+
+// GenerateClientKey generates the private key of an agent along with a certificate signing
+// request for it.
+func GenerateClientKey(commonName string) (key string, csr string, err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	derBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err = encodePrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	csr = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: derBytes}))
+
+	return key, csr, nil
+}
+
+// PinnedClientConfig returns a TLS configuration that trusts only servers whose certificate
+// chain includes the certificate with the given fingerprint. Host names are not checked as
+// servers are commonly reached by IP address.
+func PinnedClientConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true, // Replaced by VerifyConnection
+		VerifyConnection:   VerifyPinnedCertificate(fingerprint),
+	}
+}
+
+// VerifyPinnedCertificate verifies that the peer presented the pinned certificate and that its
+// leaf certificate chains up to it.
+func VerifyPinnedCertificate(fingerprint string) func(tls.ConnectionState) error {
+	pin := NormalizeFingerprint(fingerprint)
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrFingerprintMismatch
+		}
+
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		pinned := false
+		for _, cert := range cs.PeerCertificates {
+			if Fingerprint(cert) == pin {
+				roots.AddCert(cert)
+				pinned = true
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if !pinned {
+			return ErrFingerprintMismatch
+		}
+
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		return err
+	}
+}
+
+// Fingerprint is the lowercase hex encoded SHA-256 hash of the certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint accepts fingerprints with or without colons and in any case.
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
+
+// ParseCertificate parses the first certificate of a PEM encoded chain.
+func ParseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+
+	return signer, nil
+}
+
+func encodePrivateKey(privateKey *ecdsa.PrivateKey) (string, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})), nil
+}
+
+func encodeCertificate(derBytes []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}))
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -1,9 +1,11 @@
 package dockerapi
 
 import (
+	"context"
 	"sync"
 	"time"
 
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
@@ -16,7 +18,16 @@
 	pingPeriod = (pongWait * 9) / 10
 )
 
-func discardIncomingMessages(ws *websocket.Conn) {
+// taskContext returns the context of the task running over ws. It is cancelled when the task
+// is cancelled by the server. A plain browser websocket has no such context.
+func taskContext(ws messages.Conn) context.Context {
+	if c, ok := ws.(interface{ Context() context.Context }); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+func discardIncomingMessages(ws messages.Conn) {
 	for {
 		if _, _, err := ws.NextReader(); err != nil {
 			ws.Close()
@@ -25,7 +36,7 @@ func discardIncomingMessages(ws *websocket.Conn) {
 	}
 }
 
-func setupPinging(ws *websocket.Conn, connectionClosed *chan bool) *sync.Mutex {
+func setupPinging(ws messages.Conn, connectionClosed *chan bool) *sync.Mutex {
 	var mu sync.Mutex
 
 	ws.SetReadDeadline(time.Now().Add(pongWait))
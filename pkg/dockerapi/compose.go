@@ -3,6 +3,7 @@
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@
 
 	"github.com/dokemon-ng/dokemon/pkg/server/store"
 
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/dokemon-ng/dokemon/pkg/util"
 	"github.com/gabemarshall/pty"
 	"github.com/gorilla/websocket"
@@ -119,10 +121,7 @@ func ComposeContainerList(req *DockerComposeContainerList) (*DockerComposeContai
 		if err != nil {
 			return nil, err
 		}
-		stale, ok := containerStaleStatus[item.Id]
-		if !ok {
-			stale = StaleStatusProcessing
-		}
+		stale := getContainerStaleStatus(item.Id)
 		items = append(items, ComposeContainer{
 			Id:      item.Id,
 			Name:    item.Name,
@@ -144,7 +143,7 @@ func ComposeContainerList(req *DockerComposeContainerList) (*DockerComposeContai
 
 var composeLogsSessionId uint = 0
 
-func ComposeLogs(req *DockerComposeLogs, ws *websocket.Conn) error {
+func ComposeLogs(req *DockerComposeLogs, ws messages.Conn) error {
 	composeLogsSessionId += 1
 	sessionId := composeLogsSessionId
 	log.Debug().Int("sessionId", int(sessionId)).Msg("Starting compose logs session")
@@ -154,7 +153,7 @@ func ComposeLogs(req *DockerComposeLogs, ws *websocket.Conn) error {
 	connectionClosed := make(chan bool)
 	mu := setupPinging(ws, &connectionClosed)
 
-	cmd := exec.Command("docker-compose", "-p", req.ProjectName, "logs", "-f")
+	cmd := exec.CommandContext(taskContext(ws), "docker-compose", "-p", req.ProjectName, "logs", "-f")
 	// We use pty so that we get colors in the output. Note that it has bugs on windows and some
 	// parts of the lines are not aligned correctly. We only support Linux so this is fine.
 	f, err := pty.Start(cmd)
@@ -196,7 +195,7 @@ func ComposeLogs(req *DockerComposeLogs, ws *websocket.Conn) error {
 	return nil
 }
 
-func performComposeAction(action string, projectName string, definition string, variables map[string]store.VariableValue, ws *websocket.Conn, printVars bool) error {
+func performComposeAction(action string, projectName string, definition string, variables map[string]store.VariableValue, ws messages.Conn, printVars bool) error {
 	dir, composefile, envfile, err := util.CreateTempComposeFile(projectName, definition, variables)
 	log.Debug().Str("composeFileName", composefile).Str("envFileName", envfile).Msg("Created temporary compose file and .env file")
 	if err != nil {
@@ -207,14 +206,16 @@ func performComposeAction(action string, projectName string, definition string,
 		os.RemoveAll(dir)
 	}()
 
+	// The docker-compose process is killed if the task is cancelled
+	ctx := taskContext(ws)
 	var cmd *exec.Cmd
 	switch action {
 	case "up":
-		cmd = exec.Command("docker-compose", "-p", projectName, "--env-file", envfile, "-f", composefile, action, "-d")
+		cmd = exec.CommandContext(ctx, "docker-compose", "-p", projectName, "--env-file", envfile, "-f", composefile, action, "-d")
 	case "down":
-		cmd = exec.Command("docker-compose", "-p", projectName, "--env-file", envfile, action)
+		cmd = exec.CommandContext(ctx, "docker-compose", "-p", projectName, "--env-file", envfile, action)
 	case "pull":
-		cmd = exec.Command("docker-compose", "-p", projectName, "--env-file", envfile, "-f", composefile, action)
+		cmd = exec.CommandContext(ctx, "docker-compose", "-p", projectName, "--env-file", envfile, "-f", composefile, action)
 	default:
 		panic(fmt.Errorf("unknown compose action %s", action))
 	}
@@ -246,6 +247,10 @@ func performComposeAction(action string, projectName string, definition string,
 	}
 
 	err = cmd.Wait()
+	if ctx.Err() != nil {
+		log.Info().Str("action", action).Str("projectName", projectName).Msg("Compose action cancelled")
+		return context.Cause(ctx)
+	}
 	ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("\n*** COMPLETED ACTION: %s ***\n\n", action)))
 
 	if err != nil {
@@ -259,7 +264,7 @@ func performComposeAction(action string, projectName string, definition string,
 	return nil
 }
 
-func ComposeDeploy(req *DockerComposeDeploy, ws *websocket.Conn) error {
+func ComposeDeploy(req *DockerComposeDeploy, ws messages.Conn) error {
 	go discardIncomingMessages(ws)
 
 	err := performComposeAction("pull", req.ProjectName, req.Definition, req.Variables, ws, true)
@@ -271,19 +276,19 @@ func ComposeDeploy(req *DockerComposeDeploy, ws *websocket.Conn) error {
 	return err
 }
 
-func ComposePull(req *DockerComposePull, ws *websocket.Conn) error {
+func ComposePull(req *DockerComposePull, ws messages.Conn) error {
 	go discardIncomingMessages(ws)
 	err := performComposeAction("pull", req.ProjectName, req.Definition, req.Variables, ws, true)
 	return err
 }
 
-func ComposeUp(req *DockerComposeUp, ws *websocket.Conn) error {
+func ComposeUp(req *DockerComposeUp, ws messages.Conn) error {
 	go discardIncomingMessages(ws)
 	err := performComposeAction("up", req.ProjectName, req.Definition, req.Variables, ws, true)
 	return err
 }
 
-func ComposeDown(req *DockerComposeDown, ws *websocket.Conn) error {
+func ComposeDown(req *DockerComposeDown, ws messages.Conn) error {
 	go discardIncomingMessages(ws)
 	err := performComposeAction("down", req.ProjectName, "", nil, ws, true)
 	return err
@@ -1,14 +1,19 @@
 package dockerapi
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"sort"
 	"strings"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
@@ -38,10 +43,7 @@ func ContainerList(req *DockerContainerList) (*DockerContainerListResponse, erro
 		}
 
 		image := strings.Split(c.Image, "@")[0]
-		stale, ok := containerStaleStatus[c.ID]
-		if !ok {
-			stale = StaleStatusProcessing
-		}
+		stale := getContainerStaleStatus(c.ID)
 
 		containers[i] = Container{
 			Id:     c.ID,
@@ -51,6 +53,7 @@ func ContainerList(req *DockerContainerList) (*DockerContainerListResponse, erro
 			State:  c.State,
 			Ports:  ports,
 			Stale:  stale,
+			Labels: c.Labels,
 		}
 	}
 
@@ -81,7 +84,7 @@ func ContainerStop(req *DockerContainerStop) error {
 		return err
 	}
 
-	err = cli.ContainerStop(context.Background(), req.Id, container.StopOptions{})
+	err = cli.ContainerStop(context.Background(), req.Id, container.StopOptions{Timeout: req.Timeout})
 	if err != nil {
 		return err
 	}
@@ -116,138 +119,260 @@ func ContainerRemove(req *DockerContainerRemove) error {
 	return nil
 }
 
-func ContainerLogs(req *DockerContainerLogs, ws *websocket.Conn) error {
+func ContainerPause(ctx context.Context, req *DockerContainerPause) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
+	defer cli.Close()
 
-	o := container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
-		Tail:       "40",
+	err = cli.ContainerPause(ctx, req.Id)
+	if err != nil {
+		return err
 	}
 
-	r, err := cli.ContainerLogs(context.Background(), req.Id, o)
+	return nil
+}
+
+func ContainerUnpause(ctx context.Context, req *DockerContainerUnpause) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	defer cli.Close()
 
-	hdr := make([]byte, 8)
-	for {
-		_, err := r.Read(hdr)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			} else {
-				panic(err)
-			}
-		}
+	err = cli.ContainerUnpause(ctx, req.Id)
+	if err != nil {
+		return err
+	}
 
-		count := binary.BigEndian.Uint32(hdr[4:])
-		dat := make([]byte, count)
-		_, err = r.Read(dat)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			} else {
-				panic(err)
-			}
-		}
+	return nil
+}
+
+func ContainerKill(ctx context.Context, req *DockerContainerKill) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
 
-		err = ws.WriteMessage(websocket.BinaryMessage, dat)
+	err = cli.ContainerKill(ctx, req.Id, req.Signal)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ContainerRename(ctx context.Context, req *DockerContainerRename) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	err = cli.ContainerRename(ctx, req.Id, req.Name)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ContainerLogs(req *DockerContainerLogs, ws messages.Conn) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	// Cancelling the task cancels the request, which ends the read with an error
+	return readContainerLogs(taskContext(ws), cli, req.Id, req.ContainerLogsOptions, !req.NoFollow, func(dat []byte) error {
+		err := ws.WriteMessage(websocket.BinaryMessage, dat)
 		if err != nil {
 			if err.Error() != "websocket: close sent" {
 				log.Debug().Err(err).Msg("Error sending message to client")
 			}
 			log.Debug().Msg("Container logs session ended as client closed connection")
-			return err
 		}
-	}
+		return err
+	})
 }
 
-var terminalSessionId uint = 0
+// ContainerLogsDownload sends the logs of a container on ws without following them. Only the
+// most recent maxLogsDownloadSize bytes are sent, starting at a line boundary, so the logs are
+// read to the end before the start event tells whether older lines were left out.
+func ContainerLogsDownload(req *DockerContainerLogsDownload, ws messages.Conn) error {
+	go discardIncomingMessages(ws)
 
-func ContainerTerminal(req *DockerContainerTerminal, wsBrowser *websocket.Conn) error {
-	terminalSessionId += 1
-	sessionId := terminalSessionId
-	log.Debug().Uint("sessionId", terminalSessionId).Msg("Starting terminal session")
+	err := downloadContainerLogs(taskContext(ws), req, ws)
+	if err != nil {
+		sendContainerLogsDownloadEvent(ws, ContainerLogsDownloadEvent{Type: ContainerLogsDownloadEventError, Error: err.Error()})
+		return err
+	}
+
+	return sendContainerLogsDownloadEvent(ws, ContainerLogsDownloadEvent{Type: ContainerLogsDownloadEventDone})
+}
 
+func downloadContainerLogs(ctx context.Context, req *DockerContainerLogsDownload, ws messages.Conn) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
+	defer cli.Close()
+
+	var buf []byte
+	truncated := false
+	err = readContainerLogs(ctx, cli, req.Id, req.ContainerLogsOptions, false, func(dat []byte) error {
+		buf = append(buf, dat...)
+		// Trimmed in batches rather than on every frame
+		if len(buf) > 2*maxLogsDownloadSize {
+			buf = TrimLogsHead(buf, maxLogsDownloadSize)
+			truncated = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	execConfig := container.ExecOptions{
-		Tty:          true,
-		Detach:       false,
-		AttachStdin:  true,
-		AttachStderr: true,
-		AttachStdout: true,
-		Cmd:          []string{"sh"},
+	if len(buf) > maxLogsDownloadSize {
+		buf = TrimLogsHead(buf, maxLogsDownloadSize)
+		truncated = true
 	}
 
-	idResponse, err := cli.ContainerExecCreate(context.Background(), req.Id, execConfig)
+	err = sendContainerLogsDownloadEvent(ws, ContainerLogsDownloadEvent{Type: ContainerLogsDownloadEventStart, Truncated: truncated})
 	if err != nil {
-		log.Error().Uint("sessionId", sessionId).Msg("Error while calling ContainerExecCreate")
 		return err
 	}
-	hijackedResponse, err := cli.ContainerExecAttach(
-		context.Background(),
-		idResponse.ID,
-		container.ExecStartOptions{Tty: true},
-	)
+
+	for len(buf) > 0 {
+		n := min(len(buf), logsDownloadChunkSize)
+		if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+
+	return nil
+}
+
+func sendContainerLogsDownloadEvent(ws messages.Conn, e ContainerLogsDownloadEvent) error {
+	dat, err := json.Marshal(e)
 	if err != nil {
-		log.Error().Uint("sessionId", sessionId).Msg("Error while calling ContainerExecAttach")
 		return err
 	}
+	return ws.WriteMessage(websocket.TextMessage, dat)
+}
 
-	browserClosedConnection := false
-	connectionClosed := make(chan bool)
-	mu := setupPinging(wsBrowser, &connectionClosed)
+const (
+	defaultLogsTail       = "40"
+	maxLogsDownloadSize   = 32 << 20
+	logsDownloadChunkSize = 32 << 10
+)
 
-	go func() {
-		for range connectionClosed {
-			log.Debug().Uint("sessionId", sessionId).Msg("Closing terminal session as client closed connection")
-			hijackedResponse.Conn.Close()
-			wsBrowser.Close()
-			browserClosedConnection = true
-			return
-		}
-	}()
+// Streams of the frames of multiplexed container logs
+const (
+	logsFrameStdin     = 0
+	logsFrameStdout    = 1
+	logsFrameStderr    = 2
+	logsFrameSystemErr = 3 // Error of the Docker engine while reading the logs
+)
+
+// TrimLogsHead drops the oldest lines so that at most max bytes remain. When not even the
+// last line fits, its end is kept.
+func TrimLogsHead(buf []byte, max int) []byte {
+	if len(buf) <= max {
+		return buf
+	}
+	cut := len(buf) - max
+	if i := bytes.IndexByte(buf[cut:], '\n'); i >= 0 && cut+i+1 < len(buf) {
+		cut += i + 1
+	}
+	return append([]byte(nil), buf[cut:]...)
+}
+
+// DockerOptions maps the options to those of the Docker API.
+func (o ContainerLogsOptions) DockerOptions(follow bool) container.LogsOptions {
+	lo := container.LogsOptions{
+		ShowStdout: o.Stream != LogsStreamStderr,
+		ShowStderr: o.Stream != LogsStreamStdout,
+		Follow:     follow,
+		Tail:       o.Tail,
+		Since:      o.Since,
+		Until:      o.Until,
+		Timestamps: o.Timestamps,
+	}
+	if lo.Tail == "" {
+		lo.Tail = defaultLogsTail
+	}
+	return lo
+}
 
-	go func() {
+// readContainerLogs passes the log output of a container to write as it is read. Unless the
+// container has a TTY, Docker multiplexes stdout and stderr into frames with an 8 byte header
+// holding the stream and the size of the frame.
+func readContainerLogs(ctx context.Context, cli *client.Client, id string, o ContainerLogsOptions, follow bool, write func([]byte) error) error {
+	c, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	r, err := cli.ContainerLogs(ctx, id, o.DockerOptions(follow))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if c.Config != nil && c.Config.Tty {
+		b := make([]byte, 32*1024)
 		for {
-			_, inputBytes, err := wsBrowser.ReadMessage()
-			if err != nil {
-				if !browserClosedConnection {
-					log.Debug().Uint("sessionId", sessionId).Err(err).Msg("Error while reading from client socket")
+			n, err := r.Read(b)
+			if n > 0 {
+				if err := write(b[:n]); err != nil {
+					return err
 				}
-				return
 			}
-			hijackedResponse.Conn.Write(inputBytes)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 		}
-	}()
+	}
+
+	return ReadLogFrames(r, write)
+}
 
+// ReadLogFrames passes the payload of the frames of multiplexed container logs to write until
+// the end of r. An error reported by Docker in a frame of its own ends the read.
+func ReadLogFrames(r io.Reader, write func([]byte) error) error {
+	hdr := make([]byte, 8)
 	for {
-		outputBytesBuffer := make([]byte, 1024)
-		n, err := hijackedResponse.Conn.Read(outputBytesBuffer)
+		_, err := io.ReadFull(r, hdr)
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			if !browserClosedConnection {
-				log.Debug().Uint("sessionId", sessionId).Msg("Error while reading from terminal. Closing session.")
-			}
 			return err
 		}
-		mu.Lock()
-		if err := wsBrowser.WriteMessage(websocket.BinaryMessage, outputBytesBuffer[0:n]); err != nil {
-			if !browserClosedConnection {
-				log.Debug().Uint("sessionId", sessionId).Msg("Error while writing to client socket. Closing session.")
+
+		dat := make([]byte, binary.BigEndian.Uint32(hdr[4:]))
+		_, err = io.ReadFull(r, dat)
+		if err != nil {
+			return err
+		}
+
+		switch hdr[0] {
+		case logsFrameStdin, logsFrameStdout, logsFrameStderr:
+			if err := write(dat); err != nil {
 				return err
 			}
-			return nil
+		case logsFrameSystemErr:
+			return errors.New(strings.TrimSpace(string(dat)))
+		default:
+			return fmt.Errorf("Unexpected stream %d in container logs", hdr[0])
 		}
-		mu.Unlock()
 	}
 }
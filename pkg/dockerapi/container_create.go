@@ -0,0 +1,242 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-connections/nat"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Progress of a layer is sent at most this often. Status changes are always sent.
+const pullProgressPeriod = 250 * time.Millisecond
+
+// ContainerCreate pulls the image if needed, creates the container and starts it unless told
+// not to. The progress and the outcome are sent on ws as ContainerCreateEvent messages.
+func ContainerCreate(req *DockerContainerCreate, ws messages.Conn) error {
+	go discardIncomingMessages(ws)
+
+	send := func(e ContainerCreateEvent) error {
+		dat, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(websocket.TextMessage, dat)
+	}
+
+	res, err := createContainer(taskContext(ws), req, send)
+	if err != nil {
+		log.Debug().Err(err).Str("image", req.Image).Msg("Error while creating container")
+		send(ContainerCreateEvent{Type: ContainerCreateEventError, Error: err.Error()})
+		return err
+	}
+
+	return send(ContainerCreateEvent{Type: ContainerCreateEventResult, Id: res.ID, Warnings: res.Warnings})
+}
+
+func createContainer(ctx context.Context, req *DockerContainerCreate, send func(ContainerCreateEvent) error) (*container.CreateResponse, error) {
+	config, hostConfig, err := ContainerCreateConfig(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	present := true
+	if req.Pull == "" || req.Pull == PullMissing {
+		_, err := cli.ImageInspect(ctx, req.Image)
+		if err != nil && !client.IsErrNotFound(err) {
+			return nil, err
+		}
+		present = err == nil
+	}
+	if PullImageNeeded(req.Pull, present) {
+		err := pullImage(ctx, cli, req.Image, send)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only one network can be given on create, others are connected before the start
+	var networkingConfig *network.NetworkingConfig
+	if len(req.Networks) > 0 {
+		networkingConfig = &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{
+			req.Networks[0]: {},
+		}}
+	}
+
+	created, err := cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A half set up container is removed rather than left behind
+	cleanup := func() {
+		err := cli.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true})
+		if err != nil {
+			log.Error().Err(err).Str("containerId", created.ID).Msg("Error while removing container after failed create")
+		}
+	}
+
+	for _, n := range req.Networks[min(1, len(req.Networks)):] {
+		err := cli.NetworkConnect(ctx, n, created.ID, nil)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("Error while connecting to network %s: %w", n, err)
+		}
+	}
+
+	if !req.NoStart {
+		err := cli.ContainerStart(ctx, created.ID, container.StartOptions{})
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	return &created, nil
+}
+
+// PullImageNeeded reports whether the image must be pulled before the container is created,
+// given the pull policy and whether the image is already present.
+func PullImageNeeded(policy string, present bool) bool {
+	switch policy {
+	case PullAlways:
+		return true
+	case "", PullMissing:
+		return !present
+	}
+	return false
+}
+
+// ContainerCreateConfig maps a create request to the configs of the Docker API. Absolute
+// volume sources are bind mounted, others are volume names.
+func ContainerCreateConfig(req *DockerContainerCreate) (*container.Config, *container.HostConfig, error) {
+	if req.Image == "" {
+		return nil, nil, errors.New("Image is required")
+	}
+
+	config := &container.Config{
+		Image:        req.Image,
+		Cmd:          req.Cmd,
+		Env:          req.Env,
+		Labels:       req.Labels,
+		ExposedPorts: nat.PortSet{},
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{},
+		RestartPolicy: container.RestartPolicy{
+			Name:              container.RestartPolicyMode(req.RestartPolicy),
+			MaximumRetryCount: req.MaxRetries,
+		},
+		Resources: container.Resources{
+			Memory:   req.Memory,
+			NanoCPUs: int64(req.Cpus * 1e9),
+		},
+	}
+	if req.RestartPolicy == "" {
+		hostConfig.RestartPolicy.Name = container.RestartPolicyDisabled
+	}
+	if err := container.ValidateRestartPolicy(hostConfig.RestartPolicy); err != nil {
+		return nil, nil, err
+	}
+	if len(req.Networks) > 0 {
+		hostConfig.NetworkMode = container.NetworkMode(req.Networks[0])
+	}
+
+	for _, p := range req.Ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		port, err := nat.NewPort(protocol, strconv.Itoa(int(p.ContainerPort)))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		binding := nat.PortBinding{HostIP: p.HostIp}
+		if p.HostPort != 0 {
+			binding.HostPort = strconv.Itoa(int(p.HostPort))
+		}
+		config.ExposedPorts[port] = struct{}{}
+		hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], binding)
+	}
+
+	for _, v := range req.Volumes {
+		m := mount.Mount{Type: mount.TypeVolume, Source: v.Source, Target: v.Target, ReadOnly: v.ReadOnly}
+		if filepath.IsAbs(v.Source) {
+			m.Type = mount.TypeBind
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, m)
+	}
+
+	return config, hostConfig, nil
+}
+
+// pullImage pulls the image from its registry. Registries requiring credentials are only
+// supported when the Docker host itself is logged in to them.
+func pullImage(ctx context.Context, cli *client.Client, ref string, send func(ContainerCreateEvent) error) error {
+	r, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	type layer struct {
+		status string
+		sentAt time.Time
+	}
+	layers := map[string]*layer{}
+
+	dec := json.NewDecoder(r)
+	for {
+		var m jsonmessage.JSONMessage
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+
+		l, ok := layers[m.ID]
+		if !ok {
+			l = &layer{}
+			layers[m.ID] = l
+		}
+		if m.Status == l.status && time.Since(l.sentAt) < pullProgressPeriod {
+			continue
+		}
+		l.status = m.Status
+		l.sentAt = time.Now()
+
+		e := ContainerCreateEvent{Type: ContainerCreateEventProgress, Status: m.Status, LayerId: m.ID}
+		if m.Progress != nil {
+			e.Current = m.Progress.Current
+			e.Total = m.Progress.Total
+		}
+		// Progress is best effort, a client that is gone is noticed when the outcome is sent
+		send(e)
+	}
+}
@@ -0,0 +1,289 @@
+package dockerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/gorilla/websocket"
+)
+
+// Entries of a directory listed at most, as each one may cost a stat process
+const maxListedFiles = 1000
+
+// Limit of a file copy when the request doesn't give one
+const defaultMaxCopySize = 100 << 20
+
+const copyChunkSize = 32 << 10
+
+// listFilesScript prints the type, the size and modification time if stat is available, and
+// the name of each entry of the directory given as argument. Apart from stat it only uses sh
+// builtins, as many images have little else.
+var listFilesScript = `cd -- "$1" || exit 1
+n=0
+for f in * .[!.]* ..?*; do
+	if [ -L "$f" ]; then t=link; elif [ -d "$f" ]; then t=dir; elif [ -f "$f" ]; then t=file; elif [ -e "$f" ]; then t=other; else continue; fi
+	n=$((n+1))
+	if [ "$n" -gt ` + strconv.Itoa(maxListedFiles) + ` ]; then echo more; exit 0; fi
+	s=$(stat -c '%s %Y' -- "$f" 2>/dev/null)
+	printf '%s\t%s\t%s\n' "$t" "$s" "$f"
+done`
+
+func ContainerFilesList(req *DockerContainerFilesList) (*DockerContainerFilesListResponse, error) {
+	if !path.IsAbs(req.Path) {
+		return nil, errors.New("Path should be absolute")
+	}
+	dir := path.Clean(req.Path)
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	ctx := context.Background()
+	exec, err := cli.ContainerExecCreate(ctx, req.Id, container.ExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"sh", "-c", listFilesScript, "sh", dir},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attach, err := cli.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer attach.Close()
+
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, attach.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.ExitCode != 0 {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = fmt.Sprintf("Listing files exited with code %d", inspect.ExitCode)
+		}
+		return nil, errors.New(msg)
+	}
+
+	res := parseFilesList(stdout.String())
+	res.Path = dir
+	return res, nil
+}
+
+func parseFilesList(out string) *DockerContainerFilesListResponse {
+	res := &DockerContainerFilesListResponse{Items: []ContainerFile{}}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "more" {
+			res.Truncated = true
+			continue
+		}
+
+		// Names with a line break end up split over lines that don't parse and are left out
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		f := ContainerFile{Type: fields[0], Name: fields[2]}
+		if size, modTime, ok := strings.Cut(fields[1], " "); ok {
+			f.Size, _ = strconv.ParseInt(size, 10, 64)
+			if seconds, err := strconv.ParseInt(modTime, 10, 64); err == nil {
+				t := time.Unix(seconds, 0).UTC()
+				f.ModTime = &t
+			}
+		}
+		res.Items = append(res.Items, f)
+	}
+
+	// Directories first, as file managers do
+	slices.SortFunc(res.Items, func(a, b ContainerFile) int {
+		if aDir, bDir := a.Type == ContainerFileTypeDir, b.Type == ContainerFileTypeDir; aDir != bDir {
+			if aDir {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return res
+}
+
+// ContainerFilesDownload sends a tar archive of a file or directory of a container on ws.
+func ContainerFilesDownload(req *DockerContainerFilesDownload, ws messages.Conn) error {
+	go discardIncomingMessages(ws)
+
+	send := func(e ContainerFilesEvent) error {
+		return sendContainerFilesEvent(ws, e)
+	}
+
+	err := copyFromContainer(taskContext(ws), req, ws, send)
+	if err != nil {
+		send(ContainerFilesEvent{Type: ContainerFilesEventError, Error: err.Error()})
+		return err
+	}
+
+	return send(ContainerFilesEvent{Type: ContainerFilesEventDone})
+}
+
+func copyFromContainer(ctx context.Context, req *DockerContainerFilesDownload, ws messages.Conn, send func(ContainerFilesEvent) error) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	r, stat, err := cli.CopyFromContainer(ctx, req.Id, req.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	maxSize := copySizeLimit(req.MaxSize)
+	if stat.Mode.IsRegular() && stat.Size > maxSize {
+		return copySizeError(maxSize)
+	}
+
+	err = send(ContainerFilesEvent{Type: ContainerFilesEventStat, Stat: &ContainerFileStat{
+		Name:       stat.Name,
+		Size:       stat.Size,
+		Mode:       uint32(stat.Mode),
+		ModTime:    stat.Mtime,
+		LinkTarget: stat.LinkTarget,
+	}})
+	if err != nil {
+		return err
+	}
+
+	// The size of a directory is only known once it has been archived
+	var total int64
+	buf := make([]byte, copyChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			if total > maxSize {
+				return copySizeError(maxSize)
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ContainerFilesUpload extracts the tar archive received on ws into a directory of a container.
+func ContainerFilesUpload(req *DockerContainerFilesUpload, ws messages.Conn) error {
+	err := copyToContainer(taskContext(ws), req, ws)
+	if err != nil {
+		sendContainerFilesEvent(ws, ContainerFilesEvent{Type: ContainerFilesEventError, Error: err.Error()})
+		return err
+	}
+
+	return sendContainerFilesEvent(ws, ContainerFilesEvent{Type: ContainerFilesEventDone})
+}
+
+func copyToContainer(ctx context.Context, req *DockerContainerFilesUpload, ws messages.Conn) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	pr, pw := io.Pipe()
+	// Stops receiving if Docker gives up before the end of the archive
+	defer pr.Close()
+	go receiveArchive(ws, pw, copySizeLimit(req.MaxSize))
+
+	return cli.CopyToContainer(ctx, req.Id, req.Path, pr, container.CopyToContainerOptions{})
+}
+
+// receiveArchive writes the archive sent in binary messages to pw until the done event.
+func receiveArchive(ws messages.Conn, pw *io.PipeWriter, maxSize int64) {
+	var total int64
+	for {
+		messageType, dat, err := ws.ReadMessage()
+		if err != nil {
+			pw.CloseWithError(errors.New("Upload ended before the whole archive was received"))
+			return
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			total += int64(len(dat))
+			if total > maxSize {
+				pw.CloseWithError(copySizeError(maxSize))
+				return
+			}
+			if _, err := pw.Write(dat); err != nil {
+				return
+			}
+		case websocket.TextMessage:
+			var e ContainerFilesEvent
+			if err := json.Unmarshal(dat, &e); err != nil {
+				continue
+			}
+			switch e.Type {
+			case ContainerFilesEventDone:
+				pw.Close()
+				return
+			case ContainerFilesEventError:
+				pw.CloseWithError(errors.New(e.Error))
+				return
+			}
+		}
+	}
+}
+
+func sendContainerFilesEvent(ws messages.Conn, e ContainerFilesEvent) error {
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(websocket.TextMessage, dat)
+}
+
+func copySizeLimit(maxSize int64) int64 {
+	if maxSize <= 0 {
+		return defaultMaxCopySize
+	}
+	return maxSize
+}
+
+func copySizeError(maxSize int64) error {
+	return fmt.Errorf("Copy is larger than the limit of %d MiB", maxSize>>20)
+}
+
+// IsRegularFile reports whether the mode of a ContainerFileStat is the one of a regular file.
+func (s *ContainerFileStat) IsRegularFile() bool {
+	return fs.FileMode(s.Mode).IsRegular()
+}
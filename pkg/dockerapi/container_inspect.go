@@ -0,0 +1,196 @@
+package dockerapi
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+const maskedValue = "********"
+
+// Parts of environment variable names that usually hold secrets
+var secretEnvNameParts = []string{
+	"PASS", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "PRIVATE", "AUTH", "SALT",
+}
+
+func ContainerInspect(req *DockerContainerInspect) (*DockerContainerInspectResponse, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	c, err := cli.ContainerInspect(context.Background(), req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &DockerContainerInspectResponse{
+		Id:       c.ID,
+		Name:     strings.TrimPrefix(c.Name, "/"),
+		ImageId:  c.Image,
+		Created:  c.Created,
+		Command:  append([]string{c.Path}, c.Args...),
+		Env:      []ContainerEnvVar{},
+		Labels:   map[string]string{},
+		Mounts:   []ContainerMount{},
+		Networks: []ContainerNetwork{},
+		Ports:    []Port{},
+	}
+
+	if c.Config != nil {
+		res.Image = c.Config.Image
+		res.Entrypoint = c.Config.Entrypoint
+		res.Cmd = c.Config.Cmd
+		res.WorkingDir = c.Config.WorkingDir
+		res.User = c.Config.User
+		res.Env = MaskEnv(c.Config.Env)
+		if c.Config.Labels != nil {
+			res.Labels = c.Config.Labels
+		}
+	}
+
+	if c.HostConfig != nil {
+		res.RestartPolicy = ContainerRestartPolicy{
+			Name:              string(c.HostConfig.RestartPolicy.Name),
+			MaximumRetryCount: c.HostConfig.RestartPolicy.MaximumRetryCount,
+		}
+		res.NetworkMode = string(c.HostConfig.NetworkMode)
+	}
+
+	if c.State != nil {
+		res.State = containerState(c.State)
+	}
+
+	for _, m := range c.Mounts {
+		res.Mounts = append(res.Mounts, ContainerMount{
+			Type:        string(m.Type),
+			Name:        m.Name,
+			Source:      m.Source,
+			Destination: m.Destination,
+			Mode:        m.Mode,
+			RW:          m.RW,
+		})
+	}
+
+	if c.NetworkSettings != nil {
+		for name, endpoint := range c.NetworkSettings.Networks {
+			if endpoint == nil {
+				continue
+			}
+			res.Networks = append(res.Networks, ContainerNetwork{
+				Name:       name,
+				IPAddress:  endpoint.IPAddress,
+				Gateway:    endpoint.Gateway,
+				MacAddress: endpoint.MacAddress,
+				Aliases:    endpoint.Aliases,
+			})
+		}
+		sort.Slice(res.Networks, func(i, j int) bool {
+			return res.Networks[i].Name < res.Networks[j].Name
+		})
+
+		for port, bindings := range c.NetworkSettings.Ports {
+			private, _ := strconv.ParseUint(port.Port(), 10, 16)
+			if len(bindings) == 0 {
+				res.Ports = append(res.Ports, Port{Type: port.Proto(), PrivatePort: uint16(private)})
+				continue
+			}
+			for _, b := range bindings {
+				public, _ := strconv.ParseUint(b.HostPort, 10, 16)
+				res.Ports = append(res.Ports, Port{IP: b.HostIP, Type: port.Proto(), PrivatePort: uint16(private), PublicPort: uint16(public)})
+			}
+		}
+		sort.Slice(res.Ports, func(i, j int) bool {
+			if res.Ports[i].PrivatePort != res.Ports[j].PrivatePort {
+				return res.Ports[i].PrivatePort < res.Ports[j].PrivatePort
+			}
+			return res.Ports[i].IP < res.Ports[j].IP
+		})
+	}
+
+	return res, nil
+}
+
+func containerState(s *container.State) ContainerState {
+	state := ContainerState{
+		Status:     string(s.Status),
+		Running:    s.Running,
+		Paused:     s.Paused,
+		Restarting: s.Restarting,
+		OOMKilled:  s.OOMKilled,
+		ExitCode:   s.ExitCode,
+		Error:      s.Error,
+		StartedAt:  s.StartedAt,
+		FinishedAt: s.FinishedAt,
+	}
+
+	if s.Health != nil {
+		state.Health = &ContainerHealth{
+			Status:        string(s.Health.Status),
+			FailingStreak: s.Health.FailingStreak,
+		}
+		if n := len(s.Health.Log); n > 0 {
+			last := s.Health.Log[n-1]
+			state.Health.LastOutput = last.Output
+			state.Health.LastCheckedAt = last.End.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return state
+}
+
+// MaskEnv splits environment variables in the NAME=value form. Values of variables whose name
+// looks like it holds a secret are masked, as are passwords in URLs such as connection strings.
+func MaskEnv(env []string) []ContainerEnvVar {
+	vars := make([]ContainerEnvVar, 0, len(env))
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		v := ContainerEnvVar{Name: name, Value: value}
+
+		if value != "" && isSecretEnvName(name) {
+			v.Value = maskedValue
+			v.Masked = true
+		} else if masked, ok := maskUrlPassword(value); ok {
+			v.Value = masked
+			v.Masked = true
+		}
+
+		vars = append(vars, v)
+	}
+
+	return vars
+}
+
+func isSecretEnvName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, part := range secretEnvNameParts {
+		if strings.Contains(upper, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func maskUrlPassword(value string) (string, bool) {
+	if !strings.Contains(value, "://") {
+		return value, false
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value, false
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value, false
+	}
+
+	// Redacted puts a placeholder in place of the password, which the url package would escape
+	return strings.Replace(u.Redacted(), ":xxxxx@", ":"+maskedValue+"@", 1), true
+}
@@ -0,0 +1,317 @@
+package dockerapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog/log"
+)
+
+const composeProjectLabel = "com.docker.compose.project"
+
+var selfContainerIdPattern = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+// ContainerRecreate replaces a standalone container with a copy running the latest version of
+// its image. The old container is kept under another name until the new one has started, and
+// is put back if anything fails. Cancelling ctx stops the recreate and restores the old
+// container.
+func ContainerRecreate(ctx context.Context, req *DockerContainerRecreate) (*DockerContainerRecreateResponse, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	return recreateContainer(ctx, cli, req.Id)
+}
+
+// ContainerRecreateStale recreates the standalone containers whose image is stale. Containers
+// are recreated one after the other and a failure doesn't stop the others, but cancelling ctx
+// does.
+func ContainerRecreateStale(ctx context.Context, req *DockerContainerRecreateStale) (*DockerContainerRecreateStaleResponse, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	dcontainers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	self := SelfContainerId()
+	items := []ContainerRecreateResult{}
+	for _, c := range dcontainers {
+		if getContainerStaleStatus(c.ID) != StaleStatusYes || c.Labels[composeProjectLabel] != "" || c.ID == self {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		item := ContainerRecreateResult{Id: c.ID, Name: strings.TrimPrefix(c.Names[0], "/")}
+		res, err := recreateContainer(ctx, cli, c.ID)
+		if err != nil {
+			item.Error = err.Error()
+		} else {
+			item.NewId = res.Id
+		}
+		items = append(items, item)
+	}
+
+	return &DockerContainerRecreateStaleResponse{Items: items}, nil
+}
+
+func recreateContainer(ctx context.Context, cli *client.Client, id string) (*DockerContainerRecreateResponse, error) {
+	old, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ContainerRecreatable(&old)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := old.Config.Image
+	name := strings.TrimPrefix(old.Name, "/")
+	log.Info().Str("containerId", old.ID).Str("name", name).Str("image", ref).Msg("Recreating container")
+
+	r, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(io.Discard, r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	wasRunning := old.State != nil && (old.State.Running || old.State.Restarting)
+	if wasRunning {
+		err = cli.ContainerStop(ctx, old.ID, container.StopOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	oldName := name + "-old-" + old.ID[:12]
+	err = cli.ContainerRename(ctx, old.ID, oldName)
+	if err != nil {
+		restartOld(cli, old.ID, wasRunning)
+		return nil, err
+	}
+
+	rollback := func(newId string) {
+		if newId != "" {
+			err := cli.ContainerRemove(context.Background(), newId, container.RemoveOptions{Force: true})
+			if err != nil {
+				log.Error().Err(err).Str("containerId", newId).Msg("Error while removing container after failed recreate")
+			}
+		}
+		err := cli.ContainerRename(context.Background(), old.ID, name)
+		if err != nil {
+			log.Error().Err(err).Str("containerId", old.ID).Msg("Error while restoring name of container after failed recreate")
+		}
+		restartOld(cli, old.ID, wasRunning)
+	}
+
+	config := *old.Config
+	if strings.HasPrefix(old.ID, config.Hostname) {
+		config.Hostname = "" // Generated from the id of the old container
+	}
+
+	hostConfig := *old.HostConfig
+	hostConfig.Binds = namedBinds(old.HostConfig.Binds)
+	hostConfig.Mounts = append(slices.Clone(hostConfig.Mounts), anonymousVolumeMounts(&old)...)
+
+	// Only one network can be given on create, others are connected afterwards
+	primary, others := ContainerNetworks(&old)
+	created, err := cli.ContainerCreate(ctx, &config, &hostConfig, primary, nil, name)
+	if err != nil {
+		rollback("")
+		return nil, err
+	}
+
+	for networkName, endpoint := range others {
+		err := cli.NetworkConnect(ctx, networkName, created.ID, endpoint)
+		if err != nil {
+			rollback(created.ID)
+			return nil, err
+		}
+	}
+
+	if wasRunning {
+		err = cli.ContainerStart(ctx, created.ID, container.StartOptions{})
+		if err != nil {
+			rollback(created.ID)
+			return nil, fmt.Errorf("New container failed to start, the old one was restored: %w", err)
+		}
+	}
+
+	// Named and anonymous volumes are now used by the new container and must be kept
+	err = cli.ContainerRemove(ctx, old.ID, container.RemoveOptions{})
+	if err != nil {
+		log.Error().Err(err).Str("containerId", old.ID).Str("name", oldName).Msg("Error while removing recreated container")
+	}
+
+	setContainerStaleStatus(created.ID, StaleStatusNo)
+	log.Info().Str("containerId", created.ID).Str("name", name).Msg("Container recreated")
+
+	return &DockerContainerRecreateResponse{Id: created.ID, Name: name, Image: ref}, nil
+}
+
+// ContainerRecreatable returns why a container can't be recreated, if it can't.
+func ContainerRecreatable(c *container.InspectResponse) error {
+	if project := c.Config.Labels[composeProjectLabel]; project != "" {
+		return fmt.Errorf("Container is part of compose project %s. Pull and deploy the project instead", project)
+	}
+	if c.ID == SelfContainerId() {
+		return errors.New("Container runs Dokemon itself. Use the agent update instead")
+	}
+	// Stopping the container would make Docker remove it, leaving nothing to roll back to
+	if c.HostConfig != nil && c.HostConfig.AutoRemove {
+		return errors.New("Container was started with --rm and is removed when stopped. Run it again with the new image instead")
+	}
+	if ref := c.Config.Image; strings.Contains(ref, "@") || strings.HasPrefix(ref, "sha256:") {
+		return fmt.Errorf("Image %s is pinned to a digest", ref)
+	}
+	return nil
+}
+
+func restartOld(cli *client.Client, id string, wasRunning bool) {
+	if !wasRunning {
+		return
+	}
+	err := cli.ContainerStart(context.Background(), id, container.StartOptions{})
+	if err != nil {
+		log.Error().Err(err).Str("containerId", id).Msg("Error while restarting container after failed recreate")
+	}
+}
+
+// namedBinds leaves out the binds that only give a container path, which are anonymous volumes.
+func namedBinds(binds []string) []string {
+	named := []string{}
+	for _, b := range binds {
+		if strings.Contains(b, ":") {
+			named = append(named, b)
+		}
+	}
+	return named
+}
+
+// anonymousVolumeMounts returns mounts for the anonymous volumes of a container, which would
+// otherwise be replaced by empty ones in a container created from its config.
+func anonymousVolumeMounts(c *container.InspectResponse) []mount.Mount {
+	configured := map[string]bool{}
+	for _, b := range namedBinds(c.HostConfig.Binds) {
+		configured[strings.Split(b, ":")[1]] = true
+	}
+	for _, m := range c.HostConfig.Mounts {
+		configured[m.Target] = true
+	}
+
+	mounts := []mount.Mount{}
+	for _, m := range c.Mounts {
+		if m.Type != mount.TypeVolume || configured[m.Destination] {
+			continue
+		}
+		mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: m.Name, Target: m.Destination, ReadOnly: !m.RW})
+	}
+	return mounts
+}
+
+// ContainerNetworks splits the networks of a container into the one it can be created with
+// and the others, which must be connected after it is created.
+func ContainerNetworks(c *container.InspectResponse) (*network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	primary := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	others := map[string]*network.EndpointSettings{}
+	if c.NetworkSettings == nil {
+		return primary, others
+	}
+
+	primaryName := string(c.HostConfig.NetworkMode)
+	if c.HostConfig.NetworkMode.IsDefault() {
+		primaryName = network.NetworkBridge
+	}
+
+	for name, endpoint := range c.NetworkSettings.Networks {
+		// Docker adds the short id of a container to its aliases, which must not follow it
+		aliases := []string{}
+		for _, a := range endpoint.Aliases {
+			if !strings.HasPrefix(c.ID, a) {
+				aliases = append(aliases, a)
+			}
+		}
+
+		settings := &network.EndpointSettings{
+			IPAMConfig: endpoint.IPAMConfig,
+			Links:      endpoint.Links,
+			Aliases:    aliases,
+		}
+		if name == primaryName {
+			primary.EndpointsConfig[name] = settings
+		} else {
+			others[name] = settings
+		}
+	}
+
+	return primary, others
+}
+
+// ContainerKeepsPath reports whether a path of a container is on a bind mount or a named
+// volume, which a copy of the container created from its host config gets too. Anonymous
+// volumes are left out as the copy gets new ones.
+func ContainerKeepsPath(c *container.InspectResponse, p string) bool {
+	if c.HostConfig == nil {
+		return false
+	}
+
+	p = path.Clean(p)
+	within := func(target string) bool {
+		target = path.Clean(target)
+		return p == target || strings.HasPrefix(p, strings.TrimSuffix(target, "/")+"/")
+	}
+
+	// Binds are source:target with options after another colon
+	for _, b := range c.HostConfig.Binds {
+		parts := strings.Split(b, ":")
+		if len(parts) >= 2 && within(parts[1]) {
+			return true
+		}
+	}
+	for _, m := range c.HostConfig.Mounts {
+		if (m.Type == mount.TypeBind || m.Type == mount.TypeVolume) && m.Source != "" && within(m.Target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SelfContainerId returns the id of the container this process runs in, read from its mounts.
+// It is empty when not running in a container.
+func SelfContainerId() string {
+	mountInfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	m := selfContainerIdPattern.FindSubmatch(mountInfo)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
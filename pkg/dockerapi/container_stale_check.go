@@ -4,6 +4,7 @@
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
@@ -12,7 +13,10 @@
 	"github.com/rs/zerolog/log"
 )
 
-var containerStaleStatus map[string]string
+var (
+	containerStaleStatusMu sync.Mutex
+	containerStaleStatus   = make(map[string]string)
+)
 
 const (
 	StaleStatusProcessing = "processing"
@@ -49,17 +53,38 @@ func isContainerImageStale(imageAndTag string, imageId string, cli *client.Clien
 }
 
 func ContainerScheduleRefreshStaleStatus() {
+	ContainerScheduleRefreshStaleStatusEvery(24 * time.Hour)
+}
+
+func ContainerScheduleRefreshStaleStatusEvery(interval time.Duration) {
 	for {
 		log.Info().Msg("Refreshing container stale status")
 		ContainerRefreshStaleStatus()
-		time.Sleep(24 * time.Hour)
+		time.Sleep(interval)
 	}
 }
 
-func ContainerRefreshStaleStatus() error {
-	if containerStaleStatus == nil {
-		containerStaleStatus = make(map[string]string)
+// getContainerStaleStatus returns the stale status of a container by its full or short id.
+func getContainerStaleStatus(id string) string {
+	containerStaleStatusMu.Lock()
+	defer containerStaleStatusMu.Unlock()
+
+	stale, ok := containerStaleStatus[id]
+	if !ok {
+		return StaleStatusProcessing
 	}
+	return stale
+}
+
+func setContainerStaleStatus(id string, stale string) {
+	containerStaleStatusMu.Lock()
+	defer containerStaleStatusMu.Unlock()
+
+	containerStaleStatus[id] = stale
+	containerStaleStatus[id[:12]] = stale // Safe since Docker IDs are always >=12 chars
+}
+
+func ContainerRefreshStaleStatus() error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
@@ -70,13 +95,6 @@ func ContainerRefreshStaleStatus() error {
 		return err
 	}
 
-	for _, c := range dcontainers {
-		_, ok := containerStaleStatus[c.ID]
-		if !ok {
-			containerStaleStatus[c.ID] = StaleStatusProcessing
-		}
-	}
-
 	for _, c := range dcontainers {
 		image := c.Image
 		if image == "" {
@@ -96,8 +114,7 @@ func ContainerRefreshStaleStatus() error {
 				stale = StaleStatusNo
 			}
 		}
-		containerStaleStatus[c.ID] = stale
-		containerStaleStatus[c.ID[:12]] = stale // Safe since Docker IDs are always >=12 chars
+		setContainerStaleStatus(c.ID, stale)
 	}
 
 	return nil
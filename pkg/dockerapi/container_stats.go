@@ -0,0 +1,180 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// ContainerStats streams the resource usage of a container as JSON encoded ContainerUsage
+// messages, one about every second as produced by Docker.
+func ContainerStats(req *DockerContainerStats, ws messages.Conn) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	go discardIncomingMessages(ws)
+
+	var mu sync.Mutex
+	return streamContainerStats(taskContext(ws), cli, req.Id, ws, &mu)
+}
+
+// ComposeStats streams the resource usage of the running containers of a compose project.
+// Messages of the containers are interleaved and told apart by their id. Containers started
+// after the stream are not included.
+func ComposeStats(req *DockerComposeStats, ws messages.Conn) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithCancel(taskContext(ws))
+	defer cancel()
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", "com.docker.compose.project="+req.ProjectName)),
+	})
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return errors.New("No running containers in project " + req.ProjectName)
+	}
+
+	go discardIncomingMessages(ws)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, len(containers))
+	for _, c := range containers {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			err := streamContainerStats(ctx, cli, id, ws, &mu)
+			// The stream of a container ends without error when it stops, the others go on
+			if err != nil {
+				errs <- err
+			}
+		}(c.ID)
+	}
+
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	// A failed write means the client is gone, so all the streams are stopped
+	var firstErr error
+	for err := range errs {
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	return firstErr
+}
+
+func streamContainerStats(ctx context.Context, cli *client.Client, id string, ws messages.Conn, mu *sync.Mutex) error {
+	r, err := cli.ContainerStats(ctx, id, true)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	dec := json.NewDecoder(r.Body)
+	for {
+		var s container.StatsResponse
+		err := dec.Decode(&s)
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		// Docker sends a zero reading once a container stops
+		if s.Read.IsZero() {
+			return nil
+		}
+
+		dat, err := json.Marshal(CalculateContainerUsage(&s))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		err = ws.WriteMessage(websocket.TextMessage, dat)
+		mu.Unlock()
+		if err != nil {
+			log.Debug().Err(err).Str("containerId", id).Msg("Container stats session ended as client closed connection")
+			return err
+		}
+	}
+}
+
+// CalculateContainerUsage computes the usage shown by docker stats from the raw statistics
+// of a container.
+func CalculateContainerUsage(s *container.StatsResponse) ContainerUsage {
+	stats := ContainerUsage{
+		Id:          s.ID,
+		Name:        strings.TrimPrefix(s.Name, "/"),
+		Read:        s.Read,
+		MemoryLimit: s.MemoryStats.Limit,
+		Pids:        s.PidsStats.Current,
+	}
+
+	onlineCpus := s.CPUStats.OnlineCPUs
+	if onlineCpus == 0 {
+		onlineCpus = uint32(len(s.CPUStats.CPUUsage.PercpuUsage))
+	}
+	stats.OnlineCpus = onlineCpus
+
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CpuPercent = cpuDelta / systemDelta * float64(onlineCpus) * 100
+	}
+
+	// The page cache is left out like docker stats does. Its key depends on the cgroup version.
+	stats.MemoryUsage = s.MemoryStats.Usage
+	cache, ok := s.MemoryStats.Stats["total_inactive_file"]
+	if !ok {
+		cache = s.MemoryStats.Stats["inactive_file"]
+	}
+	if cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	}
+	if stats.MemoryLimit > 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+
+	for _, n := range s.Networks {
+		stats.NetworkRx += n.RxBytes
+		stats.NetworkTx += n.TxBytes
+	}
+
+	for _, e := range s.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			stats.BlockRead += e.Value
+		case "write":
+			stats.BlockWrite += e.Value
+		}
+	}
+
+	return stats
+}
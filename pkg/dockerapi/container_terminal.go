@@ -0,0 +1,207 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Text messages from the client starting with this byte are control messages, not keystrokes
+const terminalControlPrefix = 0
+
+// Shell started when the request doesn't name a command, as before commands could be chosen
+const defaultTerminalShell = "sh"
+
+// Starts the shell given as argument if the container has it, sh otherwise
+const terminalShellFallback = `command -v "$1" >/dev/null 2>&1 && exec "$1"; exec sh`
+
+var lastTerminalSessionId atomic.Uint64
+
+// terminalSession is the state of one terminal, so that concurrent terminals don't interfere.
+type terminalSession struct {
+	id     uint64
+	cli    *client.Client
+	execId string
+	exec   net.Conn
+	ws     messages.Conn
+	closed atomic.Bool
+}
+
+// ContainerTerminal runs a command with a TTY in a container and relays its input and output
+// over ws. Text messages starting with a NUL byte are TerminalControl messages, everything
+// else is input.
+func ContainerTerminal(req *DockerContainerTerminal, wsBrowser messages.Conn) error {
+	s := &terminalSession{id: lastTerminalSessionId.Add(1), ws: wsBrowser}
+	log.Debug().Uint64("sessionId", s.id).Str("containerId", req.Id).Msg("Starting terminal session")
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	s.cli = cli
+
+	execConfig := container.ExecOptions{
+		Tty:          true,
+		Detach:       false,
+		AttachStdin:  true,
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          TerminalCmd(req.Cmd),
+		User:         req.User,
+		WorkingDir:   req.WorkingDir,
+	}
+	if req.Cols > 0 && req.Rows > 0 {
+		execConfig.ConsoleSize = &[2]uint{req.Rows, req.Cols}
+	}
+
+	ctx := taskContext(wsBrowser)
+	idResponse, err := cli.ContainerExecCreate(ctx, req.Id, execConfig)
+	if err != nil {
+		log.Error().Uint64("sessionId", s.id).Msg("Error while calling ContainerExecCreate")
+		return err
+	}
+	s.execId = idResponse.ID
+
+	hijackedResponse, err := cli.ContainerExecAttach(
+		ctx,
+		s.execId,
+		container.ExecStartOptions{Tty: true, ConsoleSize: execConfig.ConsoleSize},
+	)
+	if err != nil {
+		log.Error().Uint64("sessionId", s.id).Msg("Error while calling ContainerExecAttach")
+		return err
+	}
+	s.exec = hijackedResponse.Conn
+	defer s.close()
+
+	connectionClosed := make(chan bool)
+	mu := setupPinging(wsBrowser, &connectionClosed)
+
+	go func() {
+		for range connectionClosed {
+			log.Debug().Uint64("sessionId", s.id).Msg("Closing terminal session as client closed connection")
+			s.close()
+			return
+		}
+	}()
+
+	go s.readInput(ctx)
+
+	return s.writeOutput(mu)
+}
+
+// TerminalCmd returns the command to run. A single command name, such as a shell, is started
+// with sh as fallback for containers that don't have it.
+func TerminalCmd(cmd []string) []string {
+	if len(cmd) == 0 {
+		cmd = []string{defaultTerminalShell}
+	}
+	if len(cmd) > 1 || cmd[0] == "sh" || strings.Contains(cmd[0], "/") {
+		return cmd
+	}
+	return []string{"sh", "-c", terminalShellFallback, "sh", cmd[0]}
+}
+
+func (s *terminalSession) readInput(ctx context.Context) {
+	for {
+		messageType, inputBytes, err := s.ws.ReadMessage()
+		if err != nil {
+			if !s.closed.Load() {
+				log.Debug().Uint64("sessionId", s.id).Err(err).Msg("Error while reading from client socket")
+			}
+			s.close()
+			return
+		}
+
+		// Invalid control messages are ignored as the terminal still works
+		m, err := TerminalControlMessage(messageType, inputBytes)
+		if err != nil {
+			log.Debug().Uint64("sessionId", s.id).Err(err).Msg("Invalid terminal control message")
+			continue
+		}
+		if m != nil {
+			s.control(ctx, m)
+			continue
+		}
+
+		if _, err := s.exec.Write(inputBytes); err != nil {
+			s.close()
+			return
+		}
+	}
+}
+
+// TerminalControlMessage returns the control message carried by a message from the client, or
+// nil when the message is input.
+func TerminalControlMessage(messageType int, dat []byte) (*TerminalControl, error) {
+	if messageType != websocket.TextMessage || len(dat) == 0 || dat[0] != terminalControlPrefix {
+		return nil, nil
+	}
+
+	var m TerminalControl
+	if err := json.Unmarshal(dat[1:], &m); err != nil {
+		return nil, err
+	}
+	if m.Type == TerminalControlResize && (m.Cols == 0 || m.Rows == 0) {
+		return nil, errors.New("Resize needs cols and rows")
+	}
+	return &m, nil
+}
+
+func (s *terminalSession) control(ctx context.Context, m *TerminalControl) {
+	switch m.Type {
+	case TerminalControlResize:
+		err := s.cli.ContainerExecResize(ctx, s.execId, container.ResizeOptions{Height: m.Rows, Width: m.Cols})
+		if err != nil {
+			log.Debug().Uint64("sessionId", s.id).Err(err).Msg("Error while resizing terminal")
+		}
+	default:
+		log.Debug().Uint64("sessionId", s.id).Str("type", m.Type).Msg("Unknown terminal control message")
+	}
+}
+
+func (s *terminalSession) writeOutput(mu *sync.Mutex) error {
+	outputBytesBuffer := make([]byte, 32*1024)
+	for {
+		n, err := s.exec.Read(outputBytesBuffer)
+		if err != nil {
+			// The command exited or the client is gone
+			if err == io.EOF || s.closed.Load() {
+				return nil
+			}
+			log.Debug().Uint64("sessionId", s.id).Err(err).Msg("Error while reading from terminal. Closing session.")
+			return err
+		}
+
+		mu.Lock()
+		err = s.ws.WriteMessage(websocket.BinaryMessage, outputBytesBuffer[:n])
+		mu.Unlock()
+		if err != nil {
+			if s.closed.Load() {
+				return nil
+			}
+			log.Debug().Uint64("sessionId", s.id).Err(err).Msg("Error while writing to client socket. Closing session.")
+			return err
+		}
+	}
+}
+
+func (s *terminalSession) close() {
+	if s.closed.Swap(true) {
+		return
+	}
+	s.exec.Close()
+	s.ws.Close()
+}
@@ -0,0 +1,78 @@
+package dockerapi
+
+import "github.com/dokemon-ng/dokemon/pkg/messages"
+
+// Task definitions and results exchanged with agents. The names are part of the wire protocol
+// and the task types advertised by agents, so they must never change. See the compatibility
+// rules in the messages package before changing any of these types.
+func init() {
+	messages.Register[DockerContainerList]("DockerContainerList", 1)
+	messages.Register[DockerContainerListResponse]("DockerContainerListResponse", 1)
+	messages.Register[DockerContainerCreate]("DockerContainerCreate", 1)
+	messages.Register[DockerContainerStart]("DockerContainerStart", 1)
+	messages.Register[DockerContainerStop]("DockerContainerStop", 1)
+	messages.Register[DockerContainerRestart]("DockerContainerRestart", 1)
+	messages.Register[DockerContainerRemove]("DockerContainerRemove", 1)
+	messages.Register[DockerContainerPause]("DockerContainerPause", 1)
+	messages.Register[DockerContainerUnpause]("DockerContainerUnpause", 1)
+	messages.Register[DockerContainerKill]("DockerContainerKill", 1)
+	messages.Register[DockerContainerRename]("DockerContainerRename", 1)
+	messages.Register[DockerContainerRecreate]("DockerContainerRecreate", 1)
+	messages.Register[DockerContainerRecreateResponse]("DockerContainerRecreateResponse", 1)
+	messages.Register[DockerContainerRecreateStale]("DockerContainerRecreateStale", 1)
+	messages.Register[DockerContainerRecreateStaleResponse]("DockerContainerRecreateStaleResponse", 1)
+	messages.Register[DockerContainerLogs]("DockerContainerLogs", 1)
+	messages.Register[DockerContainerLogsDownload]("DockerContainerLogsDownload", 1)
+	messages.Register[DockerContainerTerminal]("DockerContainerTerminal", 1)
+	messages.Register[DockerContainerInspect]("DockerContainerInspect", 1)
+	messages.Register[DockerContainerInspectResponse]("DockerContainerInspectResponse", 1)
+	messages.Register[DockerContainerStats]("DockerContainerStats", 1)
+	messages.Register[DockerContainerFilesList]("DockerContainerFilesList", 1)
+	messages.Register[DockerContainerFilesListResponse]("DockerContainerFilesListResponse", 1)
+	messages.Register[DockerContainerFilesDownload]("DockerContainerFilesDownload", 1)
+	messages.Register[DockerContainerFilesUpload]("DockerContainerFilesUpload", 1)
+
+	messages.Register[DockerImageList]("DockerImageList", 1)
+	messages.Register[DockerImageListResponse]("DockerImageListResponse", 1)
+	messages.Register[DockerImageRemove]("DockerImageRemove", 1)
+	messages.Register[DockerImagesPrune]("DockerImagesPrune", 1)
+	messages.Register[DockerImagesPruneResponse]("DockerImagesPruneResponse", 1)
+
+	messages.Register[DockerVolumeCreate]("DockerVolumeCreate", 1)
+	messages.Register[DockerVolumeCreateResponse]("DockerVolumeCreateResponse", 1)
+	messages.Register[DockerVolumeList]("DockerVolumeList", 1)
+	messages.Register[DockerVolumeListResponse]("DockerVolumeListResponse", 1)
+	messages.Register[DockerVolumeRemove]("DockerVolumeRemove", 1)
+	messages.Register[DockerVolumesPrune]("DockerVolumesPrune", 1)
+	messages.Register[DockerVolumesPruneResponse]("DockerVolumesPruneResponse", 1)
+
+	messages.Register[DockerNetworkCreate]("DockerNetworkCreate", 1)
+	messages.Register[DockerNetworkCreateResponse]("DockerNetworkCreateResponse", 1)
+	messages.Register[DockerNetworkList]("DockerNetworkList", 1)
+	messages.Register[DockerNetworkListResponse]("DockerNetworkListResponse", 1)
+	messages.Register[DockerNetworkRemove]("DockerNetworkRemove", 1)
+	messages.Register[DockerNetworksPrune]("DockerNetworksPrune", 1)
+	messages.Register[DockerNetworksPruneResponse]("DockerNetworksPruneResponse", 1)
+
+	messages.Register[DockerComposeList]("DockerComposeList", 1)
+	messages.Register[DockerComposeListResponse]("DockerComposeListResponse", 1)
+	messages.Register[DockerComposeGet]("DockerComposeGet", 1)
+	messages.Register[ComposeItem]("ComposeItem", 1)
+	messages.Register[DockerComposeContainerList]("DockerComposeContainerList", 1)
+	messages.Register[DockerComposeContainerListResponse]("DockerComposeContainerListResponse", 1)
+	messages.Register[DockerComposeLogs]("DockerComposeLogs", 1)
+	messages.Register[DockerComposeStats]("DockerComposeStats", 1)
+	messages.Register[DockerComposeDeploy]("DockerComposeDeploy", 1)
+	messages.Register[DockerComposePull]("DockerComposePull", 1)
+	messages.Register[DockerComposeUp]("DockerComposeUp", 1)
+	messages.Register[DockerComposeDown]("DockerComposeDown", 1)
+	messages.Register[DockerComposeDownNoStreaming]("DockerComposeDownNoStreaming", 1)
+
+	messages.Register[ClusterSwarmNodeList]("ClusterSwarmNodeList", 1)
+	messages.Register[ClusterSwarmNodeListResponse]("ClusterSwarmNodeListResponse", 1)
+	messages.Register[SwarmNodeInfoId]("SwarmNodeInfoId", 1)
+	messages.Register[SwarmNodeInfoDetailsResponse]("SwarmNodeInfoDetailsResponse", 1)
+	messages.Register[ClusterSwarmNodeRemoveRequest]("ClusterSwarmNodeRemoveRequest", 1)
+	messages.Register[SwarmNodeUpdateRequest]("SwarmNodeUpdateRequest", 1)
+	messages.Register[SwarmNodePromoteOrDemoteRequest]("SwarmNodePromoteOrDemoteRequest", 1)
+}
@@ -1,6 +1,8 @@
 package dockerapi
 
 import (
+	"time"
+
 	"github.com/docker/docker/api/types/filters"
 	"github.com/dokemon-ng/dokemon/pkg/server/store"
 )
@@ -15,13 +17,14 @@ type Port struct {
 }
 
 type Container struct {
-	Id     string `json:"id"`
-	Name   string `json:"name"`
-	Image  string `json:"image"`
-	Status string `json:"status"`
-	State  string `json:"state"`
-	Stale  string `json:"stale"`
-	Ports  []Port `json:"ports"`
+	Id     string            `json:"id"`
+	Name   string            `json:"name"`
+	Image  string            `json:"image"`
+	Status string            `json:"status"`
+	State  string            `json:"state"`
+	Stale  string            `json:"stale"`
+	Ports  []Port            `json:"ports"`
+	Labels map[string]string `json:"labels"`
 }
 
 type DockerContainerList struct {
@@ -37,7 +40,8 @@ type DockerContainerStart struct {
 }
 
 type DockerContainerStop struct {
-	Id string `json:"id"`
+	Id      string `json:"id"`
+	Timeout *int   `json:"timeout,omitempty"` // Seconds before the container is killed, Docker's default if nil
 }
 
 type DockerContainerRestart struct {
@@ -49,14 +53,329 @@ type DockerContainerRemove struct {
 	Force bool   `json:"force"`
 }
 
+type DockerContainerPause struct {
+	Id string `json:"id"`
+}
+
+type DockerContainerUnpause struct {
+	Id string `json:"id"`
+}
+
+type DockerContainerKill struct {
+	Id     string `json:"id"`
+	Signal string `json:"signal,omitempty"` // Name or number, SIGKILL if empty
+}
+
+type DockerContainerRename struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ContainerLogsOptions selects the container logs to read. The zero value follows the last 40
+// lines of both streams, which is what agents that predate the options do.
+type ContainerLogsOptions struct {
+	Tail       string `json:"tail,omitempty"`  // Number of lines or "all"
+	Since      string `json:"since,omitempty"` // RFC 3339 or Unix timestamp, or a duration such as 10m
+	Until      string `json:"until,omitempty"`
+	Timestamps bool   `json:"timestamps,omitempty"`
+	Stream     string `json:"stream,omitempty"` // stdout, stderr or empty for both
+	NoFollow   bool   `json:"noFollow,omitempty"`
+}
+
+const (
+	LogsStreamStdout = "stdout"
+	LogsStreamStderr = "stderr"
+)
+
 type DockerContainerLogs struct {
 	Id string `json:"id"`
+	ContainerLogsOptions
+}
+
+// DockerContainerLogsDownload reads the logs without following them. NoFollow is ignored. It
+// runs as a stream task. A start event is sent first, then the logs in binary messages and a
+// done or an error event at the end.
+type DockerContainerLogsDownload struct {
+	Id string `json:"id"`
+	ContainerLogsOptions
+}
+
+// ContainerLogsDownloadEvent is sent in a text message of the logs download task.
+type ContainerLogsDownloadEvent struct {
+	Type      string `json:"type"`
+	Truncated bool   `json:"truncated,omitempty"` // Older lines were left out to limit the size
+	Error     string `json:"error,omitempty"`
 }
 
+const (
+	ContainerLogsDownloadEventStart = "start"
+	ContainerLogsDownloadEventDone  = "done"
+	ContainerLogsDownloadEventError = "error"
+)
+
 type DockerContainerTerminal struct {
+	Id         string   `json:"id"`
+	Cmd        []string `json:"cmd,omitempty"` // sh when empty
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Cols       uint     `json:"cols,omitempty"` // Initial size of the TTY, Docker's default if zero
+	Rows       uint     `json:"rows,omitempty"`
+}
+
+const TerminalControlResize = "resize"
+
+// TerminalControl is sent by the client to a terminal, as JSON in a text message prefixed
+// with a NUL byte.
+type TerminalControl struct {
+	Type string `json:"type"`
+	Cols uint   `json:"cols"`
+	Rows uint   `json:"rows"`
+}
+
+type DockerContainerStats struct {
 	Id string `json:"id"`
 }
 
+// ContainerUsage is one reading of the resource usage of a container. Network and block IO
+// are totals since the container started.
+type ContainerUsage struct {
+	Id            string    `json:"id"`
+	Name          string    `json:"name"`
+	Read          time.Time `json:"read"`
+	CpuPercent    float64   `json:"cpuPercent"` // 100% is one fully used CPU
+	OnlineCpus    uint32    `json:"onlineCpus"`
+	MemoryUsage   uint64    `json:"memoryUsage"`
+	MemoryLimit   uint64    `json:"memoryLimit"`
+	MemoryPercent float64   `json:"memoryPercent"`
+	NetworkRx     uint64    `json:"networkRx"`
+	NetworkTx     uint64    `json:"networkTx"`
+	BlockRead     uint64    `json:"blockRead"`
+	BlockWrite    uint64    `json:"blockWrite"`
+	Pids          uint64    `json:"pids"`
+}
+
+type DockerContainerInspect struct {
+	Id string `json:"id"`
+}
+
+// DockerContainerInspectResponse is the part of the container inspect output shown in the UI.
+// Values of environment variables which look like secrets are masked.
+type DockerContainerInspectResponse struct {
+	Id            string                 `json:"id"`
+	Name          string                 `json:"name"`
+	Image         string                 `json:"image"`
+	ImageId       string                 `json:"imageId"`
+	Created       string                 `json:"created"`
+	Command       []string               `json:"command"` // Entrypoint followed by the arguments
+	Entrypoint    []string               `json:"entrypoint"`
+	Cmd           []string               `json:"cmd"`
+	WorkingDir    string                 `json:"workingDir"`
+	User          string                 `json:"user"`
+	Env           []ContainerEnvVar      `json:"env"`
+	Labels        map[string]string      `json:"labels"`
+	Mounts        []ContainerMount       `json:"mounts"`
+	RestartPolicy ContainerRestartPolicy `json:"restartPolicy"`
+	State         ContainerState         `json:"state"`
+	NetworkMode   string                 `json:"networkMode"`
+	Networks      []ContainerNetwork     `json:"networks"`
+	Ports         []Port                 `json:"ports"`
+}
+
+type ContainerEnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Masked bool   `json:"masked"`
+}
+
+type ContainerMount struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Mode        string `json:"mode"`
+	RW          bool   `json:"rw"`
+}
+
+type ContainerRestartPolicy struct {
+	Name              string `json:"name"`
+	MaximumRetryCount int    `json:"maximumRetryCount"`
+}
+
+type ContainerState struct {
+	Status     string           `json:"status"`
+	Running    bool             `json:"running"`
+	Paused     bool             `json:"paused"`
+	Restarting bool             `json:"restarting"`
+	OOMKilled  bool             `json:"oomKilled"`
+	ExitCode   int              `json:"exitCode"`
+	Error      string           `json:"error"`
+	StartedAt  string           `json:"startedAt"`
+	FinishedAt string           `json:"finishedAt"`
+	Health     *ContainerHealth `json:"health"` // Nil without a health check
+}
+
+type ContainerHealth struct {
+	Status        string `json:"status"`
+	FailingStreak int    `json:"failingStreak"`
+	LastOutput    string `json:"lastOutput"`
+	LastCheckedAt string `json:"lastCheckedAt"`
+}
+
+type ContainerNetwork struct {
+	Name       string   `json:"name"`
+	IPAddress  string   `json:"ipAddress"`
+	Gateway    string   `json:"gateway"`
+	MacAddress string   `json:"macAddress"`
+	Aliases    []string `json:"aliases"`
+}
+
+// DockerContainerCreate creates a container and by default starts it. It runs as a stream
+// task so that the progress of pulling the image can be followed. ContainerCreateEvent
+// messages are sent on the stream, ending with a result or an error event.
+type DockerContainerCreate struct {
+	Image         string            `json:"image"`
+	Name          string            `json:"name"`
+	Cmd           []string          `json:"cmd"`
+	Env           []string          `json:"env"` // NAME=value
+	Ports         []PortMapping     `json:"ports"`
+	Volumes       []VolumeMapping   `json:"volumes"`
+	Networks      []string          `json:"networks"` // The first one is the network mode
+	RestartPolicy string            `json:"restartPolicy"`
+	MaxRetries    int               `json:"maxRetries"` // Only for the on-failure restart policy
+	Labels        map[string]string `json:"labels"`
+	Memory        int64             `json:"memory"` // Limit in bytes
+	Cpus          float64           `json:"cpus"`
+	Pull          string            `json:"pull"` // always, never or missing if empty
+	NoStart       bool              `json:"noStart"`
+}
+
+const (
+	PullAlways  = "always"
+	PullMissing = "missing"
+	PullNever   = "never"
+)
+
+type PortMapping struct {
+	HostIp        string `json:"hostIp"`
+	HostPort      uint16 `json:"hostPort"` // Zero publishes on a random port
+	ContainerPort uint16 `json:"containerPort"`
+	Protocol      string `json:"protocol"` // tcp if empty
+}
+
+type VolumeMapping struct {
+	Source   string `json:"source"` // Absolute host path for a bind mount, otherwise a volume name
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+type ContainerCreateEvent struct {
+	Type     string   `json:"type"`
+	Status   string   `json:"status,omitempty"`  // Progress of the pull, as reported by Docker
+	LayerId  string   `json:"layerId,omitempty"` // Layer the progress is about, if any
+	Current  int64    `json:"current,omitempty"`
+	Total    int64    `json:"total,omitempty"`
+	Id       string   `json:"id,omitempty"` // Id of the created container
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+const (
+	ContainerCreateEventProgress = "progress"
+	ContainerCreateEventResult   = "result"
+	ContainerCreateEventError    = "error"
+)
+
+type DockerContainerRecreate struct {
+	Id string `json:"id"`
+}
+
+type DockerContainerRecreateResponse struct {
+	Id    string `json:"id"` // Id of the new container
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// DockerContainerRecreateStale recreates all the standalone containers with a stale image.
+type DockerContainerRecreateStale struct {
+}
+
+type DockerContainerRecreateStaleResponse struct {
+	Items []ContainerRecreateResult `json:"items"`
+}
+
+type ContainerRecreateResult struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	NewId string `json:"newId,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// DockerContainerFilesList lists a directory of a running container. It needs sh in the
+// container.
+type DockerContainerFilesList struct {
+	Id   string `json:"id"`
+	Path string `json:"path"`
+}
+
+type DockerContainerFilesListResponse struct {
+	Path      string          `json:"path"`
+	Items     []ContainerFile `json:"items"`
+	Truncated bool            `json:"truncated"` // The directory has more entries than listed
+}
+
+type ContainerFile struct {
+	Name    string     `json:"name"`
+	Type    string     `json:"type"`
+	Size    int64      `json:"size"`              // Only known if the container has stat
+	ModTime *time.Time `json:"modTime,omitempty"` // Only known if the container has stat
+}
+
+const (
+	ContainerFileTypeFile  = "file"
+	ContainerFileTypeDir   = "dir"
+	ContainerFileTypeLink  = "link"
+	ContainerFileTypeOther = "other"
+)
+
+// DockerContainerFilesDownload copies a file or directory out of a container. It runs as a
+// stream task. A stat event is sent first, then the tar archive in binary messages and a done
+// or an error event at the end.
+type DockerContainerFilesDownload struct {
+	Id      string `json:"id"`
+	Path    string `json:"path"`
+	MaxSize int64  `json:"maxSize"` // Of the archive in bytes
+}
+
+// DockerContainerFilesUpload extracts a tar archive into a directory of a container. It runs
+// as a stream task. The archive is sent to the task in binary messages followed by a done
+// event, and the task replies with a done or an error event.
+type DockerContainerFilesUpload struct {
+	Id      string `json:"id"`
+	Path    string `json:"path"` // Existing directory
+	MaxSize int64  `json:"maxSize"`
+}
+
+// ContainerFilesEvent is sent in a text message of the file copy tasks.
+type ContainerFilesEvent struct {
+	Type  string             `json:"type"`
+	Stat  *ContainerFileStat `json:"stat,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+
+const (
+	ContainerFilesEventStat  = "stat"
+	ContainerFilesEventDone  = "done"
+	ContainerFilesEventError = "error"
+)
+
+type ContainerFileStat struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Mode       uint32    `json:"mode"` // Go fs.FileMode bits
+	ModTime    time.Time `json:"modTime"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+}
+
 // Images
 
 type Image struct {
@@ -249,6 +568,10 @@ type DockerComposeLogs struct {
 	ProjectName string `json:"projectName"`
 }
 
+type DockerComposeStats struct {
+	ProjectName string `json:"projectName"`
+}
+
 type DockerComposeDeploy struct {
 	Variables   map[string]store.VariableValue `json:"variables"`
 	ProjectName string                         `json:"projectName"`
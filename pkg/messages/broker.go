@@ -0,0 +1,904 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// QueuedTask is a task handed to the agent as a stream on its connection.
+type QueuedTask struct {
+	Stream         *Stream
+	TaskDefinition string
+}
+
+const (
+	TaskStatusQueued               = "Queued"
+	TaskStatusDispatched           = "Dispatched"
+	TaskStatusCompletedWithSuccess = "CompletedWithSuccess"
+	TaskStatusCompletedWithFailure = "CompletedWithFailure"
+	TaskStatusExpired              = "Expired"
+	TaskStatusCancelled            = "Cancelled"
+)
+
+// Task is what the broker keeps about a task in its TaskStore.
+type Task struct {
+	ExpiresAt    *time.Time
+	DispatchedAt *time.Time
+	Id           string
+	Type         string
+	Status       string
+	Payload      string // Encrypted task definition of queued tasks
+	UserName     string
+	NodeId       uint
+	Attempts     uint
+	MaxAttempts  uint
+	Timeout      time.Duration // Time allowed for one attempt of a queued task
+	Interactive  bool
+}
+
+// TaskStore persists the tasks of the broker. It is implemented by the server, as this package
+// is shared with the agent which has no database.
+type TaskStore interface {
+	Create(t *Task) error
+	Exists(id string) (bool, error)
+	GetQueuedByNodeId(nodeId uint) ([]Task, error)
+	Claim(id string, t time.Time) (bool, error)
+	Complete(id string, status string, result *string, t time.Time) error
+	CancelQueued(id string, t time.Time) (bool, error)
+	Requeue(id string) error
+	ExpireQueued(t time.Time) (int64, error)
+	RecoverDispatched(t time.Time) error
+	DeleteFinished(before time.Time) (int64, error)
+}
+
+// TaskPolicy controls how a queued task is retried. A task is retried when the agent
+// disconnects or doesn't answer in time, not when the task itself fails on the agent.
+type TaskPolicy struct {
+	MaxAttempts uint
+	Expiry      time.Duration // Queued tasks not dispatched within this duration are expired
+	Timeout     time.Duration // Time allowed for one attempt once dispatched
+}
+
+var DefaultTaskPolicy = TaskPolicy{
+	MaxAttempts: 3,
+	Expiry:      24 * time.Hour,
+	Timeout:     10 * time.Minute,
+}
+
+var (
+	ErrNodeOffline    = errors.New("Node is offline")
+	ErrTaskTimeout    = errors.New("timeout")
+	ErrBrokerClosed   = errors.New("task broker closed")
+	ErrShuttingDown   = errors.New("Server is shutting down")
+	ErrTaskNotFound   = errors.New("Task not found")
+	ErrTaskCompleted  = errors.New("Task has already completed")
+	ErrNotCancellable = errors.New("Task runs on the server and can't be cancelled")
+	errNoTaskStatus   = errors.New("agent ended task without status")
+	errUnexpectedMsg  = errors.New("unexpected message received from agent")
+)
+
+// ErrTaskNotSupported is returned for tasks the agent of the node doesn't advertise. Usually
+// the agent needs to be updated.
+var ErrTaskNotSupported = errors.New("Task is not supported by the agent of this node. Please update the agent")
+
+const (
+	expiryCheckPeriod    = time.Minute
+	retentionCheckPeriod = time.Hour
+	retryDelay           = 30 * time.Second
+	drainCheckPeriod     = 100 * time.Millisecond
+)
+
+// DefaultTaskRetention is how long finished tasks are kept in the history by default.
+const DefaultTaskRetention = 30 * 24 * time.Hour
+
+// TaskBroker hands tasks to connected agents and keeps track of them until they complete.
+// Interactive tasks fail fast when the node is offline. Queued tasks are persisted and
+// dispatched whenever the agent of their node is connected.
+type TaskBroker struct {
+	store     TaskStore
+	retention time.Duration // Finished tasks older than this are deleted. Zero keeps them.
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu         sync.Mutex
+	sessions   map[uint]*agentSession             // NodeId is the map key
+	streams    map[string]*Stream                 // Task id is the map key
+	localTasks map[string]context.CancelCauseFunc // Tasks run by the server itself that haven't ended. Nil for those that can't be cancelled.
+	waiters    map[string]chan error              // Queued tasks someone waits for. Receives the outcome once.
+	draining   bool
+}
+
+// agentSession is the connection of an agent along with what it told about itself in its
+// ConnectMessage.
+type agentSession struct {
+	*Session
+	taskTypes map[string]bool
+
+	// Load last reported by the agent, guarded by the mutex of the broker
+	status           *AgentStatusMessage
+	statusReportedAt time.Time
+}
+
+func (s *agentSession) supports(taskType string) bool {
+	return s.taskTypes[taskType]
+}
+
+// open hands a task to the agent. Task definitions may have been serialized before the agent
+// was known, e.g. for queued tasks, so they are re-encoded for the protocol version of the agent.
+func (s *agentSession) open(stream *Stream, taskDefinition string) error {
+	taskDefinition, err := Transcode(taskDefinition, s.PeerProtocolVersion())
+	if err != nil {
+		return err
+	}
+
+	return s.Open(stream, taskDefinition)
+}
+
+func (s *agentSession) checkSupported(taskDefinition string) error {
+	t := taskType(taskDefinition)
+	if !s.supports(t) {
+		return fmt.Errorf("%w: %s", ErrTaskNotSupported, t)
+	}
+	return nil
+}
+
+func NewTaskBroker(taskStore TaskStore, retention time.Duration) *TaskBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &TaskBroker{
+		store:      taskStore,
+		retention:  retention,
+		ctx:        ctx,
+		cancel:     cancel,
+		sessions:   make(map[uint]*agentSession),
+		streams:    make(map[string]*Stream),
+		localTasks: make(map[string]context.CancelCauseFunc),
+		waiters:    make(map[string]chan error),
+	}
+}
+
+// Start recovers tasks that were running when the server stopped and starts expiring stale
+// queued tasks and deleting finished tasks past the retention.
+func (b *TaskBroker) Start() error {
+	err := b.store.RecoverDispatched(time.Now())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(expiryCheckPeriod)
+		defer ticker.Stop()
+
+		for {
+			b.expireQueued()
+
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	if b.retention > 0 {
+		go func() {
+			ticker := time.NewTicker(retentionCheckPeriod)
+			defer ticker.Stop()
+
+			for {
+				b.deleteFinished()
+
+				select {
+				case <-b.ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Close stops background work and ends all tasks that are still running. Agents are
+// disconnected so that they reconnect once the server is back.
+func (b *TaskBroker) Close() {
+	b.cancel()
+
+	b.mu.Lock()
+	streams := b.streams
+	b.streams = make(map[string]*Stream)
+	// Copied as agents unregister while their sessions are closed
+	sessions := make([]*agentSession, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.CloseWithError(ErrBrokerClosed)
+	}
+	for _, s := range sessions {
+		s.Close(websocket.CloseGoingAway, ErrShuttingDown.Error())
+	}
+}
+
+// Drain stops handing tasks to agents and waits until the running tasks end or the context
+// is done. New interactive tasks fail with ErrShuttingDown. Queued tasks stay queued and are
+// dispatched after the restart.
+func (b *TaskBroker) Drain(ctx context.Context) error {
+	b.mu.Lock()
+	b.draining = true
+	b.mu.Unlock()
+
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		n := b.runningTasks()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d tasks still running: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *TaskBroker) isDraining() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.draining
+}
+
+func (b *TaskBroker) runningTasks() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.streams) + len(b.localTasks)
+}
+
+func (b *TaskBroker) expireQueued() {
+	n, err := b.store.ExpireQueued(time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Error while expiring queued tasks")
+	} else if n > 0 {
+		log.Info().Int64("count", n).Msg("Expired queued tasks")
+	}
+}
+
+func (b *TaskBroker) deleteFinished() {
+	n, err := b.store.DeleteFinished(time.Now().Add(-b.retention))
+	if err != nil {
+		log.Error().Err(err).Msg("Error while deleting finished tasks")
+	} else if n > 0 {
+		log.Info().Int64("count", n).Msg("Deleted finished tasks past retention")
+	}
+}
+
+// RegisterSession makes the connection of an agent available for tasks and dispatches the
+// tasks that were queued while the agent was offline. Only the task types advertised by the
+// agent are sent to it.
+func (b *TaskBroker) RegisterSession(nodeId uint, session *Session, taskTypes []string) {
+	s := &agentSession{Session: session, taskTypes: make(map[string]bool, len(taskTypes))}
+	for _, t := range taskTypes {
+		s.taskTypes[t] = true
+	}
+
+	b.mu.Lock()
+	b.sessions[nodeId] = s
+	b.mu.Unlock()
+
+	go b.dispatchQueuedTasks(nodeId, s)
+}
+
+// UnregisterSession is called when the connection of an agent is lost. A newer connection of
+// the same node is left alone.
+func (b *TaskBroker) UnregisterSession(nodeId uint, session *Session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.sessions[nodeId]; ok && s.Session == session {
+		delete(b.sessions, nodeId)
+	}
+}
+
+// UpdateAgentStatus records the load of the task lanes reported by the agent of the node.
+func (b *TaskBroker) UpdateAgentStatus(nodeId uint, session *Session, m *AgentStatusMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.sessions[nodeId]; ok && s.Session == session {
+		s.status = m
+		s.statusReportedAt = time.Now()
+	}
+}
+
+// AgentStatus returns the load of the task lanes last reported by the agent of the node. It
+// returns nil if the node is offline or its agent doesn't report its load.
+func (b *TaskBroker) AgentStatus(nodeId uint) (*AgentStatusMessage, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.sessions[nodeId]
+	if s == nil || s.status == nil {
+		return nil, time.Time{}
+	}
+	return s.status, s.statusReportedAt
+}
+
+func (b *TaskBroker) session(nodeId uint) *agentSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.sessions[nodeId]
+}
+
+func (b *TaskBroker) IsNodeConnected(nodeId uint) bool {
+	return b.session(nodeId) != nil
+}
+
+// Disconnect closes the connection of the agent of the node, for example when its credential
+// is revoked. Running tasks fail as the connection is lost. It returns false if the node is
+// not connected.
+func (b *TaskBroker) Disconnect(nodeId uint, reason string) bool {
+	s := b.session(nodeId)
+	if s == nil {
+		return false
+	}
+
+	s.Close(websocket.ClosePolicyViolation, reason)
+	return true
+}
+
+// ServeLegacyTask carries a task of an agent that predates protocol version 1 over the
+// websocket the agent opened for it. It returns false if the agent of the node has no such task.
+func (b *TaskBroker) ServeLegacyTask(nodeId uint, taskId string, ws *websocket.Conn) bool {
+	s := b.session(nodeId)
+	if s == nil {
+		return false
+	}
+
+	return s.ServeLegacyTask(taskId, ws)
+}
+
+func (b *TaskBroker) track(stream *Stream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.streams[stream.Id] = stream
+}
+
+func (b *TaskBroker) untrack(stream *Stream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.streams, stream.Id)
+}
+
+func taskType(taskDefinition string) string {
+	return TypeOf(taskDefinition)
+}
+
+// open sends an interactive task to the agent. Interactive tasks have a caller waiting for
+// them so they fail immediately when the node is offline instead of being queued.
+func (b *TaskBroker) open(ctx context.Context, nodeId uint, taskDefinition string) (*Stream, error) {
+	if b.ctx.Err() != nil {
+		return nil, ErrBrokerClosed
+	}
+	if b.isDraining() {
+		return nil, ErrShuttingDown
+	}
+
+	session := b.session(nodeId)
+	if session == nil {
+		return nil, ErrNodeOffline
+	}
+	if err := session.checkSupported(taskDefinition); err != nil {
+		return nil, err
+	}
+
+	stream := NewStream(uuid.NewString())
+
+	now := time.Now()
+	task := Task{
+		Id:           stream.Id,
+		NodeId:       nodeId,
+		Type:         taskType(taskDefinition),
+		Status:       TaskStatusDispatched,
+		UserName:     UserName(ctx),
+		Interactive:  true,
+		Attempts:     1,
+		MaxAttempts:  1,
+		DispatchedAt: &now,
+	}
+	if err := b.store.Create(&task); err != nil {
+		return nil, err
+	}
+
+	if err := session.open(stream, taskDefinition); err != nil {
+		b.fail(task.Id, err)
+		return nil, err
+	}
+	b.track(stream)
+	log.Debug().Str("taskId", stream.Id).Msg("Task queued")
+
+	return stream, nil
+}
+
+// closeOnDone ends the stream when the context is done. The returned function must be called
+// once the stream is no longer used.
+func (b *TaskBroker) closeOnDone(ctx context.Context, stream *Stream) func() {
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			stream.CloseWithError(ErrTaskTimeout)
+		} else {
+			stream.CloseWithError(ctx.Err())
+		}
+	})
+
+	return func() {
+		stop()
+		stream.Close()
+		b.untrack(stream)
+	}
+}
+
+// Process runs an interactive task and waits for its final status.
+func (b *TaskBroker) Process(ctx context.Context, nodeId uint, taskDefinition string, timeout time.Duration) (*TaskStatusMessage, error) {
+	stream, err := b.open(ctx, nodeId, taskDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer b.closeOnDone(ctx, stream)()
+
+	taskStatusMessage, err := waitForTaskStatus(stream)
+	b.recordTaskStatus(stream.Id, taskStatusMessage, err)
+
+	return taskStatusMessage, err
+}
+
+// ProcessStream relays messages between the browser websocket and the task stream until
+// either side closes or the context is done.
+func (b *TaskBroker) ProcessStream(ctx context.Context, nodeId uint, taskDefinition string, ws Conn) (err error) {
+	stream, err := b.open(ctx, nodeId, taskDefinition)
+	if err != nil {
+		// The browser has no other way to learn why nothing happens
+		ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("\n*** %s ***\n\n", err)))
+		return err
+	}
+	defer b.closeOnDone(ctx, stream)()
+	defer func() {
+		if err != nil {
+			b.fail(stream.Id, err)
+		} else {
+			b.complete(stream.Id, TaskStatusCompletedWithSuccess, nil)
+		}
+	}()
+
+	go func() {
+		// Read from browser and send to agent
+		for {
+			mt, dat, err := ws.ReadMessage()
+			if err != nil {
+				log.Debug().Err(err).Str("taskId", stream.Id).Msg("Browser closed connection")
+				stream.Close()
+				return
+			}
+
+			err = stream.WriteMessage(mt, dat)
+			if err != nil {
+				log.Debug().Err(err).Str("taskId", stream.Id).Msg("Error while sending streaming message to agent")
+				return
+			}
+		}
+	}()
+
+	// Read from agent and send to browser
+	for {
+		mt, dat, err := stream.ReadMessage()
+		if err != nil {
+			if err == io.EOF || err == ErrStreamClosed {
+				log.Debug().Str("taskId", stream.Id).Uint("nodeId", nodeId).Msg("Stream task session ended")
+				return nil
+			}
+			if err == ErrTaskCancelled {
+				ws.WriteMessage(websocket.TextMessage, []byte("\n*** TASK CANCELLED ***\n\n"))
+			}
+			return err
+		}
+
+		err = ws.WriteMessage(mt, dat)
+		if err != nil {
+			log.Debug().Err(err).Msg("Error while sending streaming message to browser")
+			stream.Close()
+			return err
+		}
+	}
+}
+
+// RecordLocal records a task that the server runs itself against its local Docker engine so
+// that it shows up in the task history like the tasks run by agents. The returned function
+// must be called with the outcome of the task. Such tasks can't be cancelled.
+func (b *TaskBroker) RecordLocal(ctx context.Context, nodeId uint, taskDefinition string) func(error) {
+	return b.recordLocal(ctx, nodeId, taskDefinition, nil)
+}
+
+// RecordLocalCancellable is RecordLocal for long running tasks that can be cancelled. The task
+// must be run with the returned context, which is cancelled when the task is cancelled.
+func (b *TaskBroker) RecordLocalCancellable(ctx context.Context, nodeId uint, taskDefinition string) (context.Context, func(error)) {
+	taskCtx, cancel := context.WithCancelCause(ctx)
+	done := b.recordLocal(ctx, nodeId, taskDefinition, cancel)
+
+	return taskCtx, func(err error) {
+		if context.Cause(taskCtx) == ErrTaskCancelled {
+			err = ErrTaskCancelled
+		}
+		cancel(nil)
+		done(err)
+	}
+}
+
+// RecordLocalStream is RecordLocal for streaming tasks. The task must be run over the returned
+// connection, which wraps ws with the context of the task like the streams of agents do. The
+// context is cancelled when the task is cancelled.
+func (b *TaskBroker) RecordLocalStream(ctx context.Context, nodeId uint, taskDefinition string, ws Conn) (Conn, func(error)) {
+	taskCtx, done := b.RecordLocalCancellable(ctx, nodeId, taskDefinition)
+	return &localConn{Conn: ws, ctx: taskCtx}, done
+}
+
+// localConn is the connection of a streaming task run by the server itself.
+type localConn struct {
+	Conn
+	ctx context.Context
+}
+
+func (c *localConn) Context() context.Context {
+	return c.ctx
+}
+
+func (b *TaskBroker) recordLocal(ctx context.Context, nodeId uint, taskDefinition string, cancel context.CancelCauseFunc) func(error) {
+	now := time.Now()
+	task := Task{
+		Id:           uuid.NewString(),
+		NodeId:       nodeId,
+		Type:         taskType(taskDefinition),
+		Status:       TaskStatusDispatched,
+		UserName:     UserName(ctx),
+		Interactive:  true,
+		Attempts:     1,
+		MaxAttempts:  1,
+		DispatchedAt: &now,
+	}
+	if err := b.store.Create(&task); err != nil {
+		log.Error().Err(err).Str("taskType", task.Type).Msg("Error while recording local task")
+		return func(error) {}
+	}
+
+	b.mu.Lock()
+	b.localTasks[task.Id] = cancel
+	b.mu.Unlock()
+
+	return func(err error) {
+		b.mu.Lock()
+		delete(b.localTasks, task.Id)
+		b.mu.Unlock()
+
+		if err != nil {
+			b.fail(task.Id, err)
+		} else {
+			b.complete(task.Id, TaskStatusCompletedWithSuccess, nil)
+		}
+	}
+}
+
+// Cancel aborts a task. A running task is cancelled on the agent, which kills the process or
+// request doing the work, and is recorded as cancelled once its caller has seen it end. A
+// queued task is cancelled before it is ever dispatched. Of the tasks run by the server
+// itself, only streaming ones can be cancelled.
+func (b *TaskBroker) Cancel(taskId string) error {
+	b.mu.Lock()
+	stream := b.streams[taskId]
+	cancelLocal, local := b.localTasks[taskId]
+	b.mu.Unlock()
+
+	if stream != nil {
+		log.Info().Str("taskId", taskId).Msg("Cancelling running task")
+		return stream.Cancel()
+	}
+	if local {
+		if cancelLocal == nil {
+			return ErrNotCancellable
+		}
+		log.Info().Str("taskId", taskId).Msg("Cancelling local task")
+		cancelLocal(ErrTaskCancelled)
+		return nil
+	}
+
+	cancelled, err := b.store.CancelQueued(taskId, time.Now())
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		log.Info().Str("taskId", taskId).Msg("Cancelled queued task")
+		return nil
+	}
+
+	exists, err := b.store.Exists(taskId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrTaskNotFound
+	}
+	return ErrTaskCompleted
+}
+
+// Queue persists the task and returns its id without waiting for it to run. The task is
+// dispatched as soon as the agent of the node is connected, even across server restarts.
+func (b *TaskBroker) Queue(ctx context.Context, nodeId uint, taskDefinition string, policy TaskPolicy) (string, error) {
+	return b.queue(ctx, nodeId, taskDefinition, policy, nil)
+}
+
+// QueueAndWait queues the task like Queue and waits up to wait for its outcome. done is false
+// if the task hasn't completed by then, in which case it goes on without anyone waiting.
+func (b *TaskBroker) QueueAndWait(ctx context.Context, nodeId uint, taskDefinition string, policy TaskPolicy, wait time.Duration) (taskId string, done bool, err error) {
+	outcome := make(chan error, 1)
+	taskId, err = b.queue(ctx, nodeId, taskDefinition, policy, outcome)
+	if err != nil {
+		return "", false, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case err := <-outcome:
+		return taskId, true, err
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	b.mu.Lock()
+	delete(b.waiters, taskId)
+	b.mu.Unlock()
+
+	// The task may have completed in the meantime
+	select {
+	case err := <-outcome:
+		return taskId, true, err
+	default:
+		return taskId, false, nil
+	}
+}
+
+func (b *TaskBroker) queue(ctx context.Context, nodeId uint, taskDefinition string, policy TaskPolicy, outcome chan error) (string, error) {
+	payload, err := ske.Encrypt(taskDefinition)
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(policy.Expiry)
+	task := Task{
+		Id:          uuid.NewString(),
+		NodeId:      nodeId,
+		Type:        taskType(taskDefinition),
+		Status:      TaskStatusQueued,
+		Payload:     payload,
+		UserName:    UserName(ctx),
+		MaxAttempts: policy.MaxAttempts,
+		Timeout:     policy.Timeout,
+		ExpiresAt:   &expiresAt,
+	}
+	if err := b.store.Create(&task); err != nil {
+		return "", err
+	}
+	log.Debug().Str("taskId", task.Id).Uint("nodeId", nodeId).Msg("Task queued")
+
+	if outcome != nil {
+		b.mu.Lock()
+		b.waiters[task.Id] = outcome
+		b.mu.Unlock()
+	}
+
+	if session := b.session(nodeId); session != nil && !b.isDraining() {
+		go b.dispatch(session, task)
+	}
+
+	return task.Id, nil
+}
+
+func (b *TaskBroker) dispatchQueuedTasks(nodeId uint, session *agentSession) {
+	b.expireQueued()
+
+	tasks, err := b.store.GetQueuedByNodeId(nodeId)
+	if err != nil {
+		log.Error().Err(err).Uint("nodeId", nodeId).Msg("Error while retrieving queued tasks")
+		return
+	}
+
+	for _, task := range tasks {
+		go b.dispatch(session, task)
+	}
+}
+
+// dispatch runs one attempt of a queued task and records the outcome. The task is claimed in
+// the store first so that it is never dispatched twice.
+func (b *TaskBroker) dispatch(session *agentSession, task Task) {
+	if b.ctx.Err() != nil || b.isDraining() {
+		return
+	}
+
+	claimed, err := b.store.Claim(task.Id, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("taskId", task.Id).Msg("Error while claiming task")
+		return
+	}
+	if !claimed {
+		return
+	}
+	attempt := task.Attempts + 1
+
+	m, err := ske.Decrypt(task.Payload)
+	if err != nil {
+		b.fail(task.Id, err)
+		return
+	}
+	if err := session.checkSupported(m); err != nil {
+		b.fail(task.Id, err)
+		return
+	}
+
+	log.Debug().Str("taskId", task.Id).Uint("attempt", attempt).Msg("Dispatching queued task")
+	var taskStatusMessage *TaskStatusMessage
+	stream := NewStream(task.Id)
+	err = session.open(stream, m)
+	if err == nil {
+		b.track(stream)
+		ctx, cancel := context.WithTimeout(b.ctx, task.timeout())
+		done := b.closeOnDone(ctx, stream)
+		taskStatusMessage, err = waitForTaskStatus(stream)
+		done()
+		cancel()
+	}
+
+	// Only a lost connection or a missing answer are worth another attempt. Tasks cut off by
+	// the shutdown of the server are requeued too, to run after the restart.
+	retry := errors.Is(err, ErrSessionClosed) || errors.Is(err, ErrTaskTimeout) ||
+		(err != nil && b.ctx.Err() != nil && !errors.Is(err, ErrTaskCancelled))
+	if retry {
+		if attempt < task.MaxAttempts && (task.ExpiresAt == nil || time.Now().Before(*task.ExpiresAt)) {
+			log.Warn().Err(err).Str("taskId", task.Id).Uint("attempt", attempt).Msg("Task attempt failed. Requeueing.")
+			if err := b.store.Requeue(task.Id); err != nil {
+				log.Error().Err(err).Str("taskId", task.Id).Msg("Error while requeueing task")
+				return
+			}
+			if b.ctx.Err() != nil {
+				return
+			}
+
+			// Retry later if the agent is still connected. Otherwise the task is dispatched
+			// again when the agent reconnects.
+			task.Attempts = attempt
+			time.AfterFunc(retryDelay, func() {
+				if session := b.session(task.NodeId); session != nil {
+					b.dispatch(session, task)
+				}
+			})
+			return
+		}
+	}
+
+	b.recordTaskStatus(task.Id, taskStatusMessage, err)
+}
+
+// timeout returns the time allowed for one attempt of the task. Tasks queued before the
+// timeout was recorded get the default one.
+func (t *Task) timeout() time.Duration {
+	if t.Timeout <= 0 {
+		return DefaultTaskPolicy.Timeout
+	}
+	return t.Timeout
+}
+
+func (b *TaskBroker) complete(taskId string, status string, err error) {
+	var result *string
+	if err != nil {
+		message := err.Error()
+		result = &message
+	}
+
+	if err := b.store.Complete(taskId, status, result, time.Now()); err != nil {
+		log.Error().Err(err).Str("taskId", taskId).Msg("Error while recording task status")
+	}
+
+	b.mu.Lock()
+	outcome, ok := b.waiters[taskId]
+	delete(b.waiters, taskId)
+	b.mu.Unlock()
+	if ok {
+		outcome <- err
+	}
+}
+
+// fail records a task that ended with an error. Cancelled tasks are recorded as such rather
+// than as failed.
+func (b *TaskBroker) fail(taskId string, err error) {
+	if errors.Is(err, ErrTaskCancelled) {
+		b.complete(taskId, TaskStatusCancelled, err)
+	} else {
+		b.complete(taskId, TaskStatusCompletedWithFailure, err)
+	}
+}
+
+func (b *TaskBroker) recordTaskStatus(taskId string, m *TaskStatusMessage, err error) {
+	if err != nil {
+		b.fail(taskId, err)
+		return
+	}
+
+	if strings.HasPrefix(m.Status, TaskStatusCompletedWithSuccess) {
+		b.complete(taskId, TaskStatusCompletedWithSuccess, nil)
+	} else {
+		b.complete(taskId, TaskStatusCompletedWithFailure, errors.New(resultOrEmpty(m)))
+	}
+}
+
+func resultOrEmpty(m *TaskStatusMessage) string {
+	if m.Result == nil {
+		return ""
+	}
+	return *m.Result
+}
+
+// waitForTaskStatus reads the stream until the agent reports the final status of the task.
+func waitForTaskStatus(stream *Stream) (*TaskStatusMessage, error) {
+	for {
+		_, data, err := stream.ReadMessage()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errNoTaskStatus
+			}
+			return nil, err
+		}
+
+		messageString := string(data)
+		messageType := taskType(messageString)
+		switch messageType {
+		case "TaskLogMessage":
+			m, err := Parse[TaskLogMessage](messageString)
+			if err == nil && m != nil {
+				log.Info().Str("level", m.Level).Str("message", m.Text).Msg("Agent Log")
+			}
+		case "TaskStatusMessage":
+			m, err := Parse[TaskStatusMessage](messageString)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(m.Status, "Completed") {
+				return m, nil
+			}
+		default:
+			log.Error().Str("messageType", messageType).Msg("Unexpected message type received from agent in task stream")
+			return nil, errUnexpectedMsg
+		}
+	}
+}
@@ -1,16 +1,59 @@
 package messages
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-func Send[T Message](c *websocket.Conn, message T) error {
-	err := c.WriteMessage(websocket.TextMessage, Serialize(message))
+// envelopeProtocolVersion is the first protocol version using Envelope on the wire. Older peers
+// use the legacy "Name {json}" framing.
+const envelopeProtocolVersion uint = 2
+
+// flowControlProtocolVersion is the first protocol version with flow control on streams. Older
+// peers neither send nor expect StreamWindowMessage.
+const flowControlProtocolVersion uint = 3
+
+// Envelope is the wire format of every message. Id uniquely identifies the message, which
+// helps when correlating logs of the server and agents.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version uint            `json:"version"`
+	Id      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// MessageWriter is implemented by *websocket.Conn, Session and Stream.
+type MessageWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+// protocolVersioner is implemented by connections that know the protocol version of the peer.
+// Messages sent over them are encoded so that the peer understands them.
+type protocolVersioner interface {
+	PeerProtocolVersion() uint
+}
+
+func Send[T Message](c MessageWriter, message T) error {
+	protocolVersion := ProtocolVersion
+	if p, ok := c.(protocolVersioner); ok {
+		protocolVersion = p.PeerProtocolVersion()
+	}
+
+	data, err := Marshal(message, protocolVersion)
+	if err != nil {
+		log.Error().Err(err).Msg("Error while encoding message")
+		return err
+	}
+
+	err = c.WriteMessage(websocket.TextMessage, data)
 	if err != nil {
 		log.Error().Err(err).Msg("Error while sending message via websocket")
 		return err
@@ -18,51 +61,139 @@ func Send[T Message](c *websocket.Conn, message T) error {
 	return nil
 }
 
-func ReceiveRaw(c *websocket.Conn) (messageType string, message string) {
-	_, messageOnWire, _ := c.ReadMessage()
+func ReceiveRaw(c *websocket.Conn) (messageType string, message string, _ error) {
+	_, messageOnWire, err := c.ReadMessage()
+	if err != nil {
+		return "", "", err
+	}
+
 	messageOnWireString := string(messageOnWire)
-	messageTypeName := strings.Split(messageOnWireString, " ")[0]
-	return messageTypeName, messageOnWireString
+	return TypeOf(messageOnWireString), messageOnWireString, nil
 }
 
 func Receive[T Message](c *websocket.Conn) (m *T, _ error) {
-	_, messageOnWire, _ := c.ReadMessage()
-	messageOnWireString := string(messageOnWire)
+	_, messageOnWire, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse[T](string(messageOnWire))
+}
+
+// Marshal encodes a message for a peer speaking the given protocol version.
+func Marshal[T any](message T, protocolVersion uint) ([]byte, error) {
+	mt, err := lookup[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
 
-	return Parse[T](messageOnWireString)
+	if protocolVersion < envelopeProtocolVersion {
+		return append([]byte(mt.name+" "), payload...), nil
+	}
+
+	return json.Marshal(Envelope{Type: mt.name, Version: mt.version, Id: uuid.NewString(), Payload: payload})
+}
+
+// Serialize encodes a message for a peer speaking the current protocol version. It panics if
+// the message type is not registered as that is a programming error.
+func Serialize[T any](message T) []byte {
+	data, err := Marshal(message, ProtocolVersion)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// decode splits a message in either framing into its envelope.
+func decode(messageOnWireString string) (*Envelope, error) {
+	if strings.HasPrefix(messageOnWireString, "{") {
+		var e Envelope
+		if err := json.Unmarshal([]byte(messageOnWireString), &e); err != nil {
+			return nil, fmt.Errorf("Invalid message envelope: %w", err)
+		}
+		if e.Type == "" {
+			return nil, errors.New("Invalid message envelope: missing type")
+		}
+		return &e, nil
+	}
+
+	// Legacy framing of protocol version 1 peers. All messages were at version 1.
+	name, payload, ok := strings.Cut(messageOnWireString, " ")
+	if !ok || name == "" {
+		return nil, errors.New("Invalid message: missing type")
+	}
+	return &Envelope{Type: name, Version: 1, Payload: json.RawMessage(payload)}, nil
 }
 
-func Serialize[T interface{}](message T) []byte {
-	messageJson, _ := json.Marshal(message)
-	typeNamePrefix := strings.Split(fmt.Sprintf("%T ", *new(T)), ".")[1]
-	messageOnWire := append([]byte(typeNamePrefix), messageJson...)
-	return messageOnWire
+// TypeOf returns the message type name of a message in either framing, or an empty string if
+// the message is malformed.
+func TypeOf(messageOnWireString string) string {
+	e, err := decode(messageOnWireString)
+	if err != nil {
+		return ""
+	}
+	return e.Type
 }
 
-func Parse[T interface{}](messageOnWireString string) (m *T, _ error) {
-	typeName := strings.Split(fmt.Sprintf("%T", *new(T)), ".")[1]
-	messageTypeName := strings.Split(messageOnWireString, " ")[0]
+// Parse decodes a message of type T. It fails if the message is of another type, of a newer
+// version than known or if the payload doesn't decode into T.
+func Parse[T any](messageOnWireString string) (m *T, _ error) {
+	mt, err := lookup[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decode(messageOnWireString)
+	if err != nil {
+		return nil, err
+	}
 
-	if messageTypeName != typeName {
-		return nil, fmt.Errorf("Expected message of type %s but received %s", typeName, messageTypeName)
+	if e.Type != mt.name {
+		return nil, fmt.Errorf("Expected message of type %s but received %s", mt.name, e.Type)
+	}
+	if e.Version > mt.version {
+		return nil, fmt.Errorf("Unsupported version %d of message %s. Latest known version is %d", e.Version, e.Type, mt.version)
 	}
 
-	messageJson := []byte(messageOnWireString[len(messageTypeName):])
+	dec := json.NewDecoder(bytes.NewReader(e.Payload))
 	var receivedMessage *T
-	json.Unmarshal(messageJson, &receivedMessage)
+	if err := dec.Decode(&receivedMessage); err != nil {
+		return nil, fmt.Errorf("Invalid payload of message %s: %w", e.Type, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Invalid payload of message %s: unexpected data after payload", e.Type)
+	}
+	if receivedMessage == nil {
+		return nil, fmt.Errorf("Invalid payload of message %s: payload is empty", e.Type)
+	}
 
 	return receivedMessage, nil
 }
 
-func GetMessageJson[T interface{}](messageOnWireString string) (m []byte, _ error) {
-	typeName := strings.Split(fmt.Sprintf("%T", *new(T)), ".")[1]
-	messageTypeName := strings.Split(messageOnWireString, " ")[0]
-
-	if messageTypeName != typeName {
-		return nil, fmt.Errorf("Expected message of type %s but received %s", typeName, messageTypeName)
+// Transcode re-encodes a message for a peer speaking the given protocol version without
+// knowing its type. Used for task definitions that were serialized before the agent receiving
+// them was known.
+func Transcode(messageOnWireString string, protocolVersion uint) (string, error) {
+	e, err := decode(messageOnWireString)
+	if err != nil {
+		return "", err
 	}
 
-	messageJson := []byte(messageOnWireString[len(messageTypeName):])
+	if protocolVersion < envelopeProtocolVersion {
+		return e.Type + " " + string(e.Payload), nil
+	}
 
-	return messageJson, nil
+	if e.Id == "" {
+		e.Id = uuid.NewString()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
@@ -0,0 +1,77 @@
+package messages
+
+import (
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// Agents that don't send a protocol version in their ConnectMessage predate the multiplexing
+// of tasks. They receive a TaskQueuedMessage on their connection for each task and open a
+// websocket of their own for it, starting with a TaskSessionMessage. The stream of such a task
+// is carried over that websocket instead of the connection of the agent, and ends when either
+// side closes it.
+
+// LegacyTaskTypes are the task types run by agents that predate protocol version 1. They
+// don't advertise them.
+var LegacyTaskTypes = []string{
+	"DockerContainerList", "DockerContainerLogs", "DockerContainerTerminal",
+	"DockerContainerStart", "DockerContainerStop", "DockerContainerRestart", "DockerContainerRemove",
+	"DockerImageList", "DockerImageRemove", "DockerImagesPrune",
+	"DockerVolumeList", "DockerVolumeRemove", "DockerVolumesPrune",
+	"DockerNetworkList", "DockerNetworkRemove", "DockerNetworksPrune",
+	"DockerComposeList", "DockerComposeGet", "DockerComposeContainerList", "DockerComposeLogs",
+	"DockerComposeDeploy", "DockerComposePull", "DockerComposeUp", "DockerComposeDown", "DockerComposeDownNoStreaming",
+	"ClusterSwarmNodeList", "SwarmNodeInfoId",
+}
+
+// NewLegacySession returns the session of an agent that predates protocol version 1.
+func NewLegacySession(ws *websocket.Conn) *Session {
+	s := NewSession(ws, 0)
+	s.legacy = true
+	return s
+}
+
+// ServeLegacyTask carries the stream of a task over the websocket the agent opened for it,
+// until either side closes it. It returns false, without answering the agent, if the session
+// has no such task waiting for the agent.
+func (s *Session) ServeLegacyTask(taskId string, ws *websocket.Conn) bool {
+	if !s.legacy {
+		return false
+	}
+
+	stream := s.get(taskId)
+	if stream == nil {
+		return false
+	}
+	stream.mu.Lock()
+	if stream.legacyConn != nil {
+		stream.mu.Unlock()
+		return false
+	}
+	stream.legacyConn = ws
+	stream.mu.Unlock()
+
+	if err := Send(NewSession(ws, 0), TaskSessionResponseMessage{Success: true}); err != nil {
+		s.remove(taskId)
+		stream.end(err)
+		return true
+	}
+	close(stream.attached)
+
+	go func() {
+		<-stream.done
+		ws.Close()
+	}()
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			// Legacy agents end their tasks by closing the websocket
+			s.remove(taskId)
+			stream.end(io.EOF)
+			return true
+		}
+		stream.push(StreamDataMessage{StreamId: taskId, Type: messageType, Data: data})
+	}
+}
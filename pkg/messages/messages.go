@@ -1,11 +1,25 @@
 package messages
 
+import "github.com/dokemon-ng/dokemon/pkg/common"
+
 type Ping struct{}
 
+// ProtocolVersion is the version of the agent protocol implemented by this build.
+//   - Version 1 multiplexes tasks as streams over the agent connection. Agents that don't send
+//     a protocol version predate it and run each task over a websocket of their own.
+//   - Version 2 wraps every message in an Envelope. See registry.go for compatibility rules.
+//   - Version 3 adds flow control to streams with StreamWindowMessage.
+const ProtocolVersion uint = 3
+
 type ConnectMessage struct {
-	ConnectionToken string `json:"connectionToken"`
-	AgentVersion    string `json:"agentVersion"`
-	AgentArch       string `json:"agentArch"` // Add this line
+	ConnectionToken string              `json:"connectionToken"`
+	AgentVersion    string              `json:"agentVersion"` // Older agents append the architecture and addresses, such as 1.7.0b-amd64@192.168.1.2
+	AgentArch       string              `json:"agentArch"`
+	TaskTypes       []string            `json:"taskTypes"` // Task types the agent can run
+	ReconnectCount  uint                `json:"reconnectCount"`
+	ProtocolVersion uint                `json:"protocolVersion"`
+	LastError       string              `json:"lastError"`         // Error that ended the previous connection
+	Network         *common.NetworkInfo `json:"network,omitempty"` // Not sent by older agents
 }
 
 type ConnectResponseMessage struct {
@@ -13,6 +27,70 @@ type ConnectResponseMessage struct {
 	Success bool   `json:"success"`
 }
 
+// EnrollRequest is posted by an agent to /agent/enroll to exchange the enrollment token it
+// was deployed with for its credential. Like CertificateRequest it is plain JSON over HTTP.
+type EnrollRequest struct {
+	Token string `json:"token"`
+}
+
+type EnrollResponse struct {
+	Credential string `json:"credential"` // Connection token used from then on
+}
+
+// AgentCredentialRotate hands a new credential to a connected agent. The agent keeps using
+// the connection it has and uses the new credential for the next ones.
+type AgentCredentialRotate struct {
+	Credential string `json:"credential"`
+}
+
+// AgentUpdate makes the agent replace its own container with one running another image. The
+// new container keeps the configuration of the current one. When Image is empty, the image of
+// the current container is used with the given Tag.
+type AgentUpdate struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+}
+
+// CertificateRequest is posted by an agent to /agent/certificate to enroll for a client
+// certificate. It is plain JSON over HTTPS rather than a websocket message.
+type CertificateRequest struct {
+	ConnectionToken string `json:"connectionToken"`
+	CSR             string `json:"csr"` // PEM encoded certificate signing request
+}
+
+type CertificateResponse struct {
+	Certificate   string `json:"certificate"`   // PEM encoded client certificate
+	CACertificate string `json:"caCertificate"` // PEM encoded CA certificate
+}
+
+// StreamOpenMessage starts a task on the agent. The stream id is the task id.
+type StreamOpenMessage struct {
+	StreamId       string `json:"streamId"`
+	TaskDefinition string `json:"taskDefinition"`
+}
+
+// StreamDataMessage carries one websocket message of a stream. Type is the websocket message
+// type (text, binary, ping or pong).
+type StreamDataMessage struct {
+	StreamId string `json:"streamId"`
+	Type     int    `json:"type"`
+	Data     []byte `json:"data"`
+}
+
+// StreamCloseMessage ends a stream. Error is empty if the stream ended normally.
+type StreamCloseMessage struct {
+	StreamId string `json:"streamId"`
+	Error    string `json:"error,omitempty"`
+}
+
+// StreamCancelMessage asks the remote side to abort the task of a stream. The stream ends
+// with ErrTaskCancelled on both sides.
+type StreamCancelMessage struct {
+	StreamId string `json:"streamId"`
+}
+
+// TaskQueuedMessage hands a task to an agent that predates protocol version 1. The agent opens
+// a websocket of its own for the task and sends TaskSessionMessage on it.
 type TaskQueuedMessage struct {
 	TaskId         string `json:"taskId"`
 	TaskDefinition string `json:"taskDefinition"`
@@ -29,6 +107,13 @@ type TaskSessionResponseMessage struct {
 	Success bool   `json:"success"`
 }
 
+// StreamWindowMessage lets the remote side send Increment more bytes of data on a stream. It
+// is sent as the data received on the stream is read.
+type StreamWindowMessage struct {
+	StreamId  string `json:"streamId"`
+	Increment int    `json:"increment"`
+}
+
 type TaskLogMessage struct {
 	Level  string `json:"level"`
 	Text   string `json:"text"`
@@ -40,8 +125,24 @@ type TaskStatusMessage struct {
 	Status string  `json:"status"`
 }
 
+// AgentStatusMessage is sent by the agent whenever the load of its task lanes changes. Tasks
+// wait in the queue of their lane while all of its workers are busy.
+type AgentStatusMessage struct {
+	Lanes []TaskLaneStatus `json:"lanes"`
+}
+
+type TaskLaneStatus struct {
+	Name      string `json:"name"`
+	Workers   int    `json:"workers"`
+	Running   int    `json:"running"`
+	Queued    int    `json:"queued"`
+	QueueSize int    `json:"queueSize"` // Tasks beyond this are rejected
+}
+
 type Message interface {
-	Ping |
+	Ping | AgentStatusMessage |
 		ConnectMessage | ConnectResponseMessage |
-		TaskQueuedMessage | TaskSessionMessage | TaskSessionResponseMessage | TaskStatusMessage | TaskLogMessage
+		TaskStatusMessage | TaskLogMessage |
+		StreamOpenMessage | StreamDataMessage | StreamCloseMessage | StreamCancelMessage | StreamWindowMessage |
+		TaskQueuedMessage | TaskSessionMessage | TaskSessionResponseMessage
 }
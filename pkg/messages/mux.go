@@ -0,0 +1,573 @@
+package messages
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Conn is the subset of *websocket.Conn used by task handlers. It is satisfied by both a
+// browser websocket (when the task runs on the server itself) and a multiplexed Stream
+// (when the task runs on an agent).
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	NextReader() (messageType int, r io.Reader, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+var (
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrSessionClosed = errors.New("agent connection closed")
+	ErrReadTimeout   = errors.New("timeout")
+	ErrTaskCancelled = errors.New("Task cancelled")
+)
+
+const (
+	// Bytes of data a stream may have in flight before its writer waits for the reader to
+	// catch up, so that a slow reader neither fills the memory of the receiving side nor holds
+	// up the other streams of the connection
+	streamWindowSize = 1 << 20
+
+	// Bytes buffered for a stream before the connection stops being read. Only reached with
+	// peers older than flowControlProtocolVersion, which don't wait for the window.
+	maxStreamBuffer = 4 * streamWindowSize
+)
+
+// Session multiplexes any number of task streams over the single persistent websocket
+// connection between an agent and the server. Each stream is identified by its task id and
+// carried as StreamOpenMessage, StreamDataMessage and StreamCloseMessage frames. The reader of
+// a stream grants its writer more data with StreamWindowMessage frames.
+type Session struct {
+	ws                  *websocket.Conn
+	writeMu             sync.Mutex
+	peerProtocolVersion uint
+	legacy              bool // The agent runs each task over a websocket of its own. See legacy.go.
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+	closed  bool
+}
+
+func NewSession(ws *websocket.Conn, peerProtocolVersion uint) *Session {
+	return &Session{
+		ws:                  ws,
+		peerProtocolVersion: peerProtocolVersion,
+		streams:             make(map[string]*Stream),
+	}
+}
+
+// PeerProtocolVersion is the protocol version spoken by the other side of the connection.
+// Messages sent through the session are encoded for it.
+func (s *Session) PeerProtocolVersion() uint {
+	return s.peerProtocolVersion
+}
+
+func (s *Session) flowControl() bool {
+	return s.peerProtocolVersion >= flowControlProtocolVersion
+}
+
+// WriteMessage serializes writes to the underlying connection. Everything written to the
+// connection, including pings, must go through the session.
+func (s *Session) WriteMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.ws.WriteMessage(messageType, data)
+}
+
+// Close sends a close frame with the reason and closes the underlying connection. The
+// connection owner notices it when its next read fails.
+func (s *Session) Close(code int, reason string) error {
+	s.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	return s.ws.Close()
+}
+
+// Open sends a StreamOpenMessage for the stream and attaches it to the session. Used by the
+// server to hand a task to the agent.
+func (s *Session) Open(stream *Stream, taskDefinition string) error {
+	if err := s.register(stream); err != nil {
+		return err
+	}
+
+	var err error
+	if s.legacy {
+		err = Send(s, TaskQueuedMessage{TaskId: stream.Id, TaskDefinition: taskDefinition})
+	} else {
+		err = Send(s, StreamOpenMessage{StreamId: stream.Id, TaskDefinition: taskDefinition})
+	}
+	if err != nil {
+		s.remove(stream.Id)
+		stream.end(err)
+		return err
+	}
+
+	return nil
+}
+
+// Accept attaches a stream that was opened by the remote side. Used by the agent when it
+// receives a StreamOpenMessage.
+func (s *Session) Accept(streamId string) (*Stream, error) {
+	stream := NewStream(streamId)
+	if err := s.register(stream); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (s *Session) register(stream *Stream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if _, ok := s.streams[stream.Id]; ok {
+		return errors.New("stream already exists")
+	}
+
+	s.streams[stream.Id] = stream
+	stream.session = s
+	// Streams of legacy agents are attached once the agent connects back for the task
+	if !s.legacy {
+		close(stream.attached)
+	}
+
+	return nil
+}
+
+func (s *Session) remove(streamId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, streamId)
+}
+
+func (s *Session) get(streamId string) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.streams[streamId]
+}
+
+// Dispatch routes stream frames to their stream. It returns false if the message is not a
+// stream frame so that the caller can handle it.
+func (s *Session) Dispatch(messageType string, messageString string) bool {
+	switch messageType {
+	case "StreamDataMessage":
+		m, err := Parse[StreamDataMessage](messageString)
+		if err != nil || m == nil {
+			log.Debug().Err(err).Msg("Invalid stream data frame received")
+			return true
+		}
+		stream := s.get(m.StreamId)
+		if stream == nil {
+			log.Debug().Str("streamId", m.StreamId).Msg("Data frame received for unknown stream")
+			return true
+		}
+		stream.push(*m)
+	case "StreamCloseMessage":
+		m, err := Parse[StreamCloseMessage](messageString)
+		if err != nil || m == nil {
+			log.Debug().Err(err).Msg("Invalid stream close frame received")
+			return true
+		}
+		stream := s.get(m.StreamId)
+		if stream == nil {
+			return true
+		}
+		s.remove(m.StreamId)
+		if m.Error != "" {
+			stream.end(errors.New(m.Error))
+		} else {
+			stream.end(io.EOF)
+		}
+	case "StreamCancelMessage":
+		m, err := Parse[StreamCancelMessage](messageString)
+		if err != nil || m == nil {
+			log.Debug().Err(err).Msg("Invalid stream cancel frame received")
+			return true
+		}
+		stream := s.get(m.StreamId)
+		if stream == nil {
+			return true
+		}
+		s.remove(m.StreamId)
+		stream.end(ErrTaskCancelled)
+	case "StreamWindowMessage":
+		m, err := Parse[StreamWindowMessage](messageString)
+		if err != nil || m == nil {
+			log.Debug().Err(err).Msg("Invalid stream window frame received")
+			return true
+		}
+		stream := s.get(m.StreamId)
+		if stream == nil {
+			return true
+		}
+		stream.grant(m.Increment)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Shutdown ends every open stream. It must be called when the underlying connection is lost
+// so that nobody stays blocked on a stream.
+func (s *Session) Shutdown(err error) {
+	if err == nil {
+		err = ErrSessionClosed
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	streams := s.streams
+	s.streams = make(map[string]*Stream)
+	s.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.end(err)
+	}
+}
+
+// Stream is one task carried over a Session. It implements Conn so that task handlers don't
+// need to know whether they are talking to a real websocket or to a multiplexed stream.
+type Stream struct {
+	Id string
+
+	session  *Session
+	attached chan struct{}
+	done     chan struct{}
+	notify   chan struct{}
+	read     chan struct{} // Signaled when frames are read
+	granted  chan struct{} // Signaled when the send window grows
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+
+	// Websocket the task of a legacy agent runs over, set before the stream is attached
+	legacyConn    *websocket.Conn
+	legacyWriteMu sync.Mutex
+
+	mu           sync.Mutex
+	frames       []StreamDataMessage
+	buffered     int // Bytes of the frames not read yet
+	consumed     int // Bytes of data read since the last window update
+	sendWindow   int // Bytes of data the remote side accepts until it grants more
+	err          error
+	readDeadline time.Time
+	pongHandler  func(string) error
+}
+
+func NewStream(id string) *Stream {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	return &Stream{
+		Id:         id,
+		attached:   make(chan struct{}),
+		done:       make(chan struct{}),
+		notify:     make(chan struct{}, 1),
+		read:       make(chan struct{}, 1),
+		granted:    make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+		sendWindow: streamWindowSize,
+	}
+}
+
+// push queues a frame received for the stream. Peers with flow control stay within the
+// window. For older peers push blocks once too much is buffered, which stops the reading of
+// the connection until the stream is read or ends.
+func (s *Stream) push(m StreamDataMessage) {
+	s.mu.Lock()
+	for s.buffered >= maxStreamBuffer {
+		s.mu.Unlock()
+		select {
+		case <-s.read:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+	}
+	s.frames = append(s.frames, m)
+	s.buffered += len(m.Data)
+	s.mu.Unlock()
+
+	signal(s.notify)
+}
+
+// grant lets the stream send n more bytes of data.
+func (s *Stream) grant(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+
+	signal(s.granted)
+}
+
+// reserve waits until the remote side accepts more data on the stream and takes n bytes of
+// the window. A message larger than what is left of the window is still sent whole.
+func (s *Stream) reserve(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.sendWindow <= 0 {
+		s.mu.Unlock()
+		select {
+		case <-s.granted:
+		case <-s.done:
+			s.mu.Lock()
+			return ErrStreamClosed
+		}
+		s.mu.Lock()
+	}
+	s.sendWindow -= n
+
+	// Other writers may be waiting for the window too
+	if s.sendWindow > 0 {
+		signal(s.granted)
+	}
+	return nil
+}
+
+// consume accounts for a frame read from the stream and returns the window to grant to the
+// remote side, if it is time to send an update.
+func (s *Stream) consume(f StreamDataMessage) int {
+	s.buffered -= len(f.Data)
+	signal(s.read)
+
+	if isControlMessage(f.Type) {
+		return 0
+	}
+	s.consumed += len(f.Data)
+	if s.consumed < streamWindowSize/2 {
+		return 0
+	}
+	increment := s.consumed
+	s.consumed = 0
+	return increment
+}
+
+// isControlMessage reports whether the websocket message type is a ping or pong. They are
+// left out of the window so that answering a ping never waits for it.
+func isControlMessage(messageType int) bool {
+	return messageType == websocket.PingMessage || messageType == websocket.PongMessage
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// end marks the stream as finished. It returns false if the stream had already ended.
+func (s *Stream) end(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	s.err = err
+	close(s.done)
+	s.cancel(err)
+	return true
+}
+
+// Done is closed when the stream has ended, either locally or remotely.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Context is cancelled when the stream ends. The cause is the error the stream ended with, so
+// work started for the task can be aborted when the task is cancelled.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Stream) ReadMessage() (int, []byte, error) {
+	for {
+		s.mu.Lock()
+		if len(s.frames) > 0 {
+			f := s.frames[0]
+			s.frames = s.frames[1:]
+			increment := s.consume(f)
+			pongHandler := s.pongHandler
+			s.mu.Unlock()
+
+			if increment > 0 && s.session.flowControl() {
+				Send(s.session, StreamWindowMessage{StreamId: s.Id, Increment: increment})
+			}
+
+			switch f.Type {
+			case websocket.PingMessage:
+				s.WriteMessage(websocket.PongMessage, f.Data)
+				continue
+			case websocket.PongMessage:
+				if pongHandler != nil {
+					if err := pongHandler(string(f.Data)); err != nil {
+						return 0, nil, err
+					}
+				}
+				continue
+			}
+
+			return f.Type, f.Data, nil
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+			s.mu.Lock()
+			pending := len(s.frames)
+			err := s.err
+			s.mu.Unlock()
+			if pending == 0 {
+				return 0, nil, err
+			}
+		case <-timeout:
+			return 0, nil, ErrReadTimeout
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *Stream) NextReader() (int, io.Reader, error) {
+	messageType, data, err := s.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return messageType, bytes.NewReader(data), nil
+}
+
+func (s *Stream) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-s.attached:
+	case <-s.done:
+		return ErrStreamClosed
+	}
+
+	select {
+	case <-s.done:
+		return ErrStreamClosed
+	default:
+	}
+
+	if s.legacyConn != nil {
+		s.legacyWriteMu.Lock()
+		defer s.legacyWriteMu.Unlock()
+		return s.legacyConn.WriteMessage(messageType, data)
+	}
+
+	if s.session.flowControl() && !isControlMessage(messageType) {
+		if err := s.reserve(len(data)); err != nil {
+			return err
+		}
+	}
+
+	return Send(s.session, StreamDataMessage{StreamId: s.Id, Type: messageType, Data: data})
+}
+
+// PeerProtocolVersion is the protocol version of the session carrying the stream.
+func (s *Stream) PeerProtocolVersion() uint {
+	select {
+	case <-s.attached:
+		return s.session.PeerProtocolVersion()
+	default:
+		return ProtocolVersion
+	}
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readDeadline = t
+	return nil
+}
+
+func (s *Stream) SetPongHandler(h func(appData string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pongHandler = h
+}
+
+// Close ends the stream and tells the remote side about it.
+func (s *Stream) Close() error {
+	return s.CloseWithError(nil)
+}
+
+// CloseWithError ends the stream and passes the error to the remote side, where it is
+// returned from ReadMessage.
+func (s *Stream) CloseWithError(err error) error {
+	m := StreamCloseMessage{StreamId: s.Id}
+	localErr := ErrStreamClosed
+	if err != nil {
+		m.Error = err.Error()
+		localErr = err
+	}
+
+	if !s.end(localErr) {
+		return nil
+	}
+
+	return notifyEnd(s, m)
+}
+
+// Cancel ends the stream and asks the remote side to abort the task.
+func (s *Stream) Cancel() error {
+	if !s.end(ErrTaskCancelled) {
+		return nil
+	}
+
+	return notifyEnd(s, StreamCancelMessage{StreamId: s.Id})
+}
+
+// notifyEnd detaches the stream from its session and sends m to the remote side. Legacy
+// agents learn about it as the websocket of the task is closed.
+func notifyEnd[T Message](s *Stream, m T) error {
+	if s.session == nil {
+		return nil
+	}
+	s.session.remove(s.Id)
+
+	select {
+	case <-s.attached:
+	default:
+		return nil
+	}
+	if s.session.legacy {
+		return nil
+	}
+	return Send(s.session, m)
+}
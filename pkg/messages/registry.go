@@ -0,0 +1,92 @@
+package messages
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Every message exchanged between the server and agents, including task definitions and task
+// results, must be registered with an explicit name and version. The name is what goes on the
+// wire, so Go types can be renamed freely.
+//
+// Compatibility rules:
+//   - Adding a field is compatible. Decoders ignore fields they don't know and peers that
+//     don't send a field leave it at its zero value, so the version stays the same.
+//   - Removing or renaming a field, or changing its type or meaning, requires a new version
+//     of the message. Decoders reject versions newer than the one they know.
+//   - Renaming a message means registering it under a new name. Agents advertise the task
+//     types they support, so the server must not send a new name to agents that don't know it.
+//   - Agents speaking protocol version 1 use the legacy "Name {json}" framing. The server keeps
+//     accepting it and answers such agents in kind, so the server can be updated first.
+
+type messageType struct {
+	name    string
+	version uint
+}
+
+var (
+	registryMu  sync.RWMutex
+	typesByGo   = make(map[reflect.Type]messageType)
+	typesByName = make(map[string]reflect.Type)
+)
+
+// Register adds a message type to the registry. It panics if the name or the type is already
+// registered as that is a programming error.
+func Register[T any](name string, version uint) {
+	t := reflect.TypeFor[T]()
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if existing, ok := typesByGo[t]; ok {
+		panic(fmt.Sprintf("messages: type %s is already registered as %s", t, existing.name))
+	}
+	if existing, ok := typesByName[name]; ok {
+		panic(fmt.Sprintf("messages: name %s is already registered for type %s", name, existing))
+	}
+
+	typesByGo[t] = messageType{name: name, version: version}
+	typesByName[name] = t
+}
+
+// IsRegistered reports whether a message name is known.
+func IsRegistered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, ok := typesByName[name]
+	return ok
+}
+
+func lookup[T any]() (messageType, error) {
+	t := reflect.TypeFor[T]()
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	mt, ok := typesByGo[t]
+	if !ok {
+		return messageType{}, fmt.Errorf("message type %s is not registered", t)
+	}
+	return mt, nil
+}
+
+func init() {
+	Register[Ping]("Ping", 1)
+	Register[ConnectMessage]("ConnectMessage", 1)
+	Register[ConnectResponseMessage]("ConnectResponseMessage", 1)
+	Register[StreamOpenMessage]("StreamOpenMessage", 1)
+	Register[StreamDataMessage]("StreamDataMessage", 1)
+	Register[StreamCloseMessage]("StreamCloseMessage", 1)
+	Register[StreamCancelMessage]("StreamCancelMessage", 1)
+	Register[StreamWindowMessage]("StreamWindowMessage", 1)
+	Register[TaskQueuedMessage]("TaskQueuedMessage", 1)
+	Register[TaskSessionMessage]("TaskSessionMessage", 1)
+	Register[TaskSessionResponseMessage]("TaskSessionResponseMessage", 1)
+	Register[TaskLogMessage]("TaskLogMessage", 1)
+	Register[TaskStatusMessage]("TaskStatusMessage", 1)
+	Register[AgentCredentialRotate]("AgentCredentialRotate", 1)
+	Register[AgentUpdate]("AgentUpdate", 1)
+	Register[AgentStatusMessage]("AgentStatusMessage", 1)
+}
@@ -0,0 +1,84 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+func ProcessTaskWithResponse[T interface{}, R interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T, timeout time.Duration) (*R, error) {
+	taskStatusMessage, err := b.Process(ctx, nodeId, string(Serialize(message)), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(taskStatusMessage.Status, "CompletedWithSuccess") {
+		if taskStatusMessage.Result == nil {
+			return nil, nil
+		}
+
+		res, err := Parse[R](*taskStatusMessage.Result)
+		if err != nil {
+			return nil, err
+		}
+		return res, err
+	} else {
+		return nil, errors.New(resultOrEmpty(taskStatusMessage))
+	}
+}
+
+func ProcessTask[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T, timeout time.Duration) error {
+	taskStatusMessage, err := b.Process(ctx, nodeId, string(Serialize(message)), timeout)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(taskStatusMessage.Status, "CompletedWithSuccess") {
+		return nil
+	} else {
+		return errors.New(resultOrEmpty(taskStatusMessage))
+	}
+}
+
+func ProcessStreamTask[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T, ws Conn) error {
+	return b.ProcessStream(ctx, nodeId, string(Serialize(message)), ws)
+}
+
+func QueueTask[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T, policy TaskPolicy) (string, error) {
+	return b.Queue(ctx, nodeId, string(Serialize(message)), policy)
+}
+
+func QueueTaskAndWait[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T, policy TaskPolicy, wait time.Duration) (string, bool, error) {
+	return b.QueueAndWait(ctx, nodeId, string(Serialize(message)), policy, wait)
+}
+
+// RecordLocalTask records a task run by the server itself. See TaskBroker.RecordLocal.
+func RecordLocalTask[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T) func(error) {
+	return b.RecordLocal(ctx, nodeId, string(Serialize(message)))
+}
+
+// RecordLocalCancellableTask records a long running task run by the server itself. See
+// TaskBroker.RecordLocalCancellable.
+func RecordLocalCancellableTask[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T) (context.Context, func(error)) {
+	return b.RecordLocalCancellable(ctx, nodeId, string(Serialize(message)))
+}
+
+// RecordLocalStreamTask records a streaming task run by the server itself. See
+// TaskBroker.RecordLocalStream.
+func RecordLocalStreamTask[T interface{}](ctx context.Context, b *TaskBroker, nodeId uint, message T, ws Conn) (Conn, func(error)) {
+	return b.RecordLocalStream(ctx, nodeId, string(Serialize(message)), ws)
+}
+
+type userNameKey struct{}
+
+// WithUserName attaches the user triggering a task to the context so that it is recorded
+// with the task.
+func WithUserName(ctx context.Context, userName string) context.Context {
+	return context.WithValue(ctx, userNameKey{}, userName)
+}
+
+func UserName(ctx context.Context) string {
+	userName, _ := ctx.Value(userNameKey{}).(string)
+	return userName
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ssl"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errClientCertificateRequired = errors.New("Client certificate required for this node")
+	errClientCertificateMismatch = errors.New("Client certificate does not belong to this node")
+)
+
+// IssueAgentCertificate enrolls an agent for a client certificate. The agent authenticates
+// with its connection token and sends a CSR so that its private key never leaves the agent.
+// Issuing a new certificate invalidates the previous one of the node, so once the node has one
+// the agent must also present it. Otherwise anyone who has seen the token could lock the agent
+// out. An admin resets the certificate of a node whose agent lost it.
+func (h *Handler) IssueAgentCertificate(c echo.Context) error {
+	var r messages.CertificateRequest
+	if err := c.Bind(&r); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	token, node, err := h.authenticateAgent(r.ConnectionToken)
+	if isTokenError(err) {
+		return c.JSON(http.StatusUnauthorized, newError(err))
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	if node.CertificateFingerprint != "" {
+		err = verifyClientCertificate(c.Request().TLS, token.NodeId, node.CertificateFingerprint)
+		if err != nil {
+			log.Warn().Uint("nodeId", token.NodeId).Err(err).Msg("Client certificate refused to agent without the current one")
+			return c.JSON(http.StatusForbidden, newError(err))
+		}
+	}
+
+	cert, err := h.ca.SignClientCertificate(r.CSR, clientCertificateCommonName(token.NodeId))
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	parsed, err := ssl.ParseCertificate(cert)
+	if err != nil {
+		panic(err)
+	}
+
+	err = h.nodeStore.UpdateCertificateFingerprint(token.NodeId, ssl.Fingerprint(parsed))
+	if err != nil {
+		panic(err)
+	}
+
+	log.Info().Uint("nodeId", token.NodeId).Msg("Client certificate issued to agent")
+
+	return ok(c, messages.CertificateResponse{Certificate: cert, CACertificate: h.ca.CertificatePEM})
+}
+
+// verifyClientCertificate checks the client certificate presented on the agent connection.
+// Nodes which enrolled for a certificate must present it; other nodes may connect with the
+// connection token alone. The TLS layer has already verified that the certificate is issued
+// by the CA.
+func verifyClientCertificate(state *tls.ConnectionState, nodeId uint, fingerprint string) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		if fingerprint != "" {
+			return errClientCertificateRequired
+		}
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName != clientCertificateCommonName(nodeId) || ssl.Fingerprint(cert) != fingerprint {
+		return errClientCertificateMismatch
+	}
+
+	return nil
+}
+
+func clientCertificateCommonName(nodeId uint) string {
+	return fmt.Sprintf("node-%d", nodeId)
+}
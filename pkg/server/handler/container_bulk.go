@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Tasks of a bulk action running at the same time, across all nodes
+const bulkConcurrency = 10
+
+var errSelectorNodeOffline = errors.New("Node is offline so its containers can't be selected")
+
+const (
+	containerActionStart   = "start"
+	containerActionStop    = "stop"
+	containerActionRestart = "restart"
+	containerActionRemove  = "remove"
+)
+
+type bulkContainerTarget struct {
+	nodeId      uint
+	containerId string
+	name        string
+	action      string
+}
+
+// BulkContainerAction runs start, stop, restart or remove on many containers, possibly on
+// several nodes. Containers are given one by one, or picked by their labels with a selector.
+// Actions run concurrently and their outcome is reported per container, in the order of the
+// items followed by the selected containers. Actions on the nodes of agents are queued, so
+// that those on offline nodes run once the agent is connected, and are reported as queued if
+// they haven't completed in time.
+func (h *Handler) BulkContainerAction(c echo.Context) error {
+	r := &bulkContainerActionRequest{}
+	if err := r.bind(c); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	ctx := taskContext(c)
+	targets := make([]bulkContainerTarget, 0, len(r.Items))
+	for _, item := range r.Items {
+		targets = append(targets, bulkContainerTarget{nodeId: item.NodeId, containerId: item.ContainerId, action: item.Action})
+	}
+	var failed []bulkContainerActionResult
+	if r.Selector != nil {
+		var selected []bulkContainerTarget
+		selected, failed = h.selectContainers(ctx, r.Selector)
+		// Containers also given as items are only acted upon once
+		for _, t := range selected {
+			if !slices.ContainsFunc(targets, func(o bulkContainerTarget) bool { return o.nodeId == t.nodeId && o.containerId == t.containerId }) {
+				targets = append(targets, t)
+			}
+		}
+	}
+
+	results := make([]bulkContainerActionResult, len(targets))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bulkConcurrency)
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := bulkContainerActionResult{NodeId: t.nodeId, ContainerId: t.containerId, Name: t.name, Action: t.action}
+			online := h.isNodeOnline(t.nodeId)
+			sem <- struct{}{}
+			taskId, done, err := h.runContainerAction(ctx, t.nodeId, t.containerId, t.action, r.Force, online)
+			<-sem
+			result.TaskId = taskId
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case done:
+				result.Ok = true
+			default:
+				result.Queued = true
+				result.NodeOffline = !online
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	return ok(c, newBulkContainerActionResponse(append(results, failed...)))
+}
+
+// selectContainers lists the containers of the selected nodes and picks those with all the
+// labels of the selector. Nodes whose containers can't be listed are reported as failures.
+func (h *Handler) selectContainers(ctx context.Context, s *bulkContainerSelectorRequest) ([]bulkContainerTarget, []bulkContainerActionResult) {
+	nodeIds := s.NodeIds
+	if len(nodeIds) == 0 {
+		nodes, err := h.nodeStore.GetAll()
+		if err != nil {
+			panic(err)
+		}
+		for _, n := range nodes {
+			nodeIds = append(nodeIds, n.Id)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	targets := []bulkContainerTarget{}
+	failed := []bulkContainerActionResult{}
+	for _, nodeId := range nodeIds {
+		// The containers of offline nodes are unknown, so nothing can be queued for them
+		if !h.isNodeOnline(nodeId) {
+			mu.Lock()
+			failed = append(failed, bulkContainerActionResult{NodeId: nodeId, Action: s.Action, NodeOffline: true, Error: errSelectorNodeOffline.Error()})
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := dockerapi.DockerContainerList{All: true}
+			var res *dockerapi.DockerContainerListResponse
+			var err error
+			if nodeId == 1 {
+				done := messages.RecordLocalTask(ctx, h.taskBroker, 1, req)
+				res, err = dockerapi.ContainerList(&req)
+				done(err)
+			} else {
+				res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerList, dockerapi.DockerContainerListResponse](ctx, h.taskBroker, nodeId, req, defaultTimeout)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, bulkContainerActionResult{NodeId: nodeId, Action: s.Action, Error: fmt.Sprintf("Error while listing containers: %s", err)})
+				return
+			}
+			for _, item := range res.Items {
+				if matchesLabels(item.Labels, s.Labels) {
+					targets = append(targets, bulkContainerTarget{nodeId: nodeId, containerId: item.Id, name: item.Name, action: s.Action})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Listed concurrently, so sorted for a stable order
+	slices.SortFunc(targets, func(a, b bulkContainerTarget) int {
+		return cmp.Or(cmp.Compare(a.nodeId, b.nodeId), cmp.Compare(a.name, b.name), cmp.Compare(a.containerId, b.containerId))
+	})
+	slices.SortFunc(failed, func(a, b bulkContainerActionResult) int {
+		return cmp.Compare(a.NodeId, b.NodeId)
+	})
+
+	return targets, failed
+}
+
+// matchesLabels reports whether the labels have all the selector entries, which are either a
+// key or a key=value pair like in Docker label filters.
+func matchesLabels(labels map[string]string, selector []string) bool {
+	for _, s := range selector {
+		key, value, hasValue := strings.Cut(s, "=")
+		actual, ok := labels[key]
+		if !ok || (hasValue && actual != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// runContainerAction runs the action on the node of the server. For other nodes the action is
+// queued and, if the node is online, its outcome is awaited. done is false while the queued
+// task hasn't completed.
+func (h *Handler) runContainerAction(ctx context.Context, nodeId uint, containerId string, action string, force bool, online bool) (taskId string, done bool, err error) {
+	switch action {
+	case containerActionStart:
+		return runOrQueueTask(ctx, h.taskBroker, nodeId, online, dockerapi.DockerContainerStart{Id: containerId}, dockerapi.ContainerStart)
+	case containerActionStop:
+		return runOrQueueTask(ctx, h.taskBroker, nodeId, online, dockerapi.DockerContainerStop{Id: containerId}, dockerapi.ContainerStop)
+	case containerActionRestart:
+		return runOrQueueTask(ctx, h.taskBroker, nodeId, online, dockerapi.DockerContainerRestart{Id: containerId}, dockerapi.ContainerRestart)
+	case containerActionRemove:
+		return runOrQueueTask(ctx, h.taskBroker, nodeId, online, dockerapi.DockerContainerRemove{Id: containerId, Force: force}, dockerapi.ContainerRemove)
+	default:
+		return "", false, fmt.Errorf("Unknown action %s", action)
+	}
+}
+
+// runOrQueueTask runs a task without a result locally for the node of the server. For other
+// nodes the task is queued, and awaited for up to its timeout if the node is online.
+func runOrQueueTask[T any](ctx context.Context, b *messages.TaskBroker, nodeId uint, online bool, m T, local func(*T) error) (string, bool, error) {
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(ctx, b, 1, m)
+		err := local(&m)
+		done(err)
+		return "", true, err
+	}
+
+	if !online {
+		taskId, err := messages.QueueTask(ctx, b, nodeId, m, bulkTaskPolicy)
+		return taskId, false, err
+	}
+
+	return messages.QueueTaskAndWait(ctx, b, nodeId, m, bulkTaskPolicy, bulkTaskPolicy.Timeout)
+}
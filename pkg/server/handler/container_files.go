@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const containerFilesChunkSize = 32 << 10
+
+// ListContainerFiles lists a directory of a running container.
+func (h *Handler) ListContainerFiles(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerFilesList{Id: c.Param("id")}
+	r := &dockerContainerFilesListRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	var res *dockerapi.DockerContainerFilesListResponse
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
+		res, err = dockerapi.ContainerFilesList(&m)
+		done(err)
+	} else {
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerFilesList, dockerapi.DockerContainerFilesListResponse](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return ok(c, res)
+}
+
+// DownloadContainerFiles streams a file or directory of a container as a tar archive. Regular
+// files are sent as they are unless a tar archive is asked for.
+func (h *Handler) DownloadContainerFiles(c echo.Context) error {
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerFilesDownload{Id: c.Param("id"), MaxSize: maxContainerFilesDownloadSize}
+	r := &dockerContainerFilesDownloadRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	// The archive is passed on as it arrives. Closing the reader stops the task.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	stats := make(chan *dockerapi.ContainerFileStat, 1)
+	conn := newEventConn(taskContext(c), func(messageType int, data []byte) error {
+		if messageType == websocket.BinaryMessage {
+			_, err := pw.Write(data)
+			return err
+		}
+
+		var e dockerapi.ContainerFilesEvent
+		if err := json.Unmarshal(data, &e); err != nil || e.Type == "" {
+			// Notices of the task broker, such as the node being offline
+			pw.CloseWithError(errors.New(strings.Trim(string(data), "\n *")))
+			return nil
+		}
+		switch e.Type {
+		case dockerapi.ContainerFilesEventStat:
+			select {
+			case stats <- e.Stat:
+			default:
+			}
+		case dockerapi.ContainerFilesEventDone:
+			pw.Close()
+		case dockerapi.ContainerFilesEventError:
+			pw.CloseWithError(errors.New(e.Error))
+		}
+		return nil
+	})
+	defer conn.Close()
+
+	go func() {
+		defer close(stats)
+
+		var err error
+		if nodeId == 1 {
+			taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, m, conn)
+			err = dockerapi.ContainerFilesDownload(&m, taskConn)
+			done(err)
+		} else {
+			err = messages.ProcessStreamTask[dockerapi.DockerContainerFilesDownload](taskContext(c), h.taskBroker, uint(nodeId), m, conn)
+		}
+
+		// The outcome is normally known from the events already, in which case this is a no-op
+		if err == nil {
+			err = errors.New("File copy ended unexpectedly")
+		}
+		pw.CloseWithError(err)
+	}()
+
+	stat := <-stats
+	if stat == nil {
+		_, err := io.Copy(io.Discard, pr)
+		if err == nil {
+			err = errors.New("File copy ended without the file")
+		}
+		return unprocessableEntity(c, err)
+	}
+
+	asFile := r.Format == "file" || (r.Format == "" && stat.IsRegularFile())
+	if !asFile {
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", stat.Name+".tar"))
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-tar")
+		c.Response().WriteHeader(http.StatusOK)
+		_, err = io.Copy(c.Response(), pr)
+		return err
+	}
+
+	if !stat.IsRegularFile() {
+		return unprocessableEntity(c, fmt.Errorf("%s is not a regular file. Download it as a tar archive instead", stat.Name))
+	}
+
+	tr := tar.NewReader(pr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", stat.Name))
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(hdr.Size, 10))
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = io.Copy(c.Response(), tr)
+	if err != nil {
+		return err
+	}
+
+	// The end of the archive is read too so that the task completes rather than fails
+	io.Copy(io.Discard, pr)
+	return nil
+}
+
+// UploadContainerFiles extracts files into an existing directory of a container. The body is
+// either a tar archive or a multipart form with the files in file fields.
+func (h *Handler) UploadContainerFiles(c echo.Context) error {
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerFilesUpload{Id: c.Param("id"), MaxSize: maxContainerFilesUploadSize}
+	r := &dockerContainerFilesUploadRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	req := c.Request()
+	if req.ContentLength > maxContainerFilesUploadSize {
+		return unprocessableEntity(c, fmt.Errorf("Upload is larger than the limit of %d MiB", maxContainerFilesUploadSize>>20))
+	}
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxContainerFilesUploadSize)
+
+	var archive io.ReadCloser
+	switch contentType := req.Header.Get(echo.HeaderContentType); {
+	case strings.HasPrefix(contentType, echo.MIMEMultipartForm):
+		form, err := c.MultipartForm()
+		if err != nil {
+			return unprocessableEntity(c, err)
+		}
+		defer form.RemoveAll()
+		if len(form.File["file"]) == 0 {
+			return unprocessableEntity(c, errors.New("file is required"))
+		}
+		archive = filesArchive(form.File["file"])
+	case strings.HasPrefix(contentType, "application/x-tar"):
+		archive = req.Body
+	default:
+		return unprocessableEntity(c, errors.New("Body should be a tar archive or a multipart form"))
+	}
+	defer archive.Close()
+
+	// Sending stops once the task has replied, which it may do before the end if it fails
+	replied := make(chan struct{})
+	input := make(chan connMessage)
+	go sendArchive(archive, input, replied)
+
+	var outcome *dockerapi.ContainerFilesEvent
+	conn := newEventConn(taskContext(c), func(messageType int, data []byte) error {
+		var e dockerapi.ContainerFilesEvent
+		if err := json.Unmarshal(data, &e); err != nil || e.Type == "" {
+			return nil // Not an event, such as a notice of the task broker
+		}
+		if outcome == nil {
+			outcome = &e
+			close(replied)
+		}
+		return nil
+	}).withInput(input)
+	defer conn.Close()
+
+	if nodeId == 1 {
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, m, conn)
+		err = dockerapi.ContainerFilesUpload(&m, taskConn)
+		done(err)
+	} else {
+		err = messages.ProcessStreamTask[dockerapi.DockerContainerFilesUpload](taskContext(c), h.taskBroker, uint(nodeId), m, conn)
+	}
+
+	if outcome == nil {
+		if err == nil {
+			err = errors.New("File copy ended without a result")
+		}
+		return unprocessableEntity(c, err)
+	}
+	if outcome.Type == dockerapi.ContainerFilesEventError {
+		return unprocessableEntity(c, errors.New(outcome.Error))
+	}
+
+	return noContent(c)
+}
+
+// sendArchive sends the archive to the task in binary messages followed by a done event, or
+// an error event if it can't be read.
+func sendArchive(archive io.Reader, input chan<- connMessage, replied <-chan struct{}) {
+	defer close(input)
+
+	send := func(m connMessage) bool {
+		select {
+		case input <- m:
+			return true
+		case <-replied:
+			return false
+		}
+	}
+	event := func(e dockerapi.ContainerFilesEvent) connMessage {
+		dat, _ := json.Marshal(e)
+		return connMessage{messageType: websocket.TextMessage, data: dat}
+	}
+
+	buf := make([]byte, containerFilesChunkSize)
+	for {
+		n, err := archive.Read(buf)
+		if n > 0 && !send(connMessage{messageType: websocket.BinaryMessage, data: slices.Clone(buf[:n])}) {
+			return
+		}
+		if err == io.EOF {
+			send(event(dockerapi.ContainerFilesEvent{Type: dockerapi.ContainerFilesEventDone}))
+			return
+		}
+		if err != nil {
+			send(event(dockerapi.ContainerFilesEvent{Type: dockerapi.ContainerFilesEventError, Error: err.Error()}))
+			return
+		}
+	}
+}
+
+// filesArchive returns a tar archive of the uploaded files, written as it is read.
+func filesArchive(files []*multipart.FileHeader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		for _, fh := range files {
+			if err := addArchiveFile(tw, fh); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+func addArchiveFile(tw *tar.Writer, fh *multipart.FileHeader) error {
+	name := path.Base(fh.Filename)
+	if name == "." || name == "/" || name == ".." {
+		return fmt.Errorf("Invalid file name %q", fh.Filename)
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     fh.Size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -1,9 +1,15 @@
 package handler
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
@@ -31,9 +37,111 @@ func (h *Handler) GetContainerList(c echo.Context) error {
 
 	var res *dockerapi.DockerContainerListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.ContainerList(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerList, dockerapi.DockerContainerListResponse](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerList, dockerapi.DockerContainerListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return ok(c, res)
+}
+
+// CreateContainer creates and starts a container, pulling its image first if needed. With
+// stream=true the progress is streamed as newline delimited JSON events ending with a result
+// or an error event. Otherwise the response is sent once the container is started.
+func (h *Handler) CreateContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerCreate{}
+	r := &dockerContainerCreateRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	stream := c.QueryParam("stream") == "true"
+	streaming := false
+	var outcome *dockerapi.ContainerCreateEvent
+	write := func(e dockerapi.ContainerCreateEvent) error {
+		if !streaming {
+			c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+			c.Response().WriteHeader(http.StatusOK)
+			streaming = true
+		}
+		err := json.NewEncoder(c.Response()).Encode(e)
+		c.Response().Flush()
+		return err
+	}
+
+	conn := newEventConn(taskContext(c), func(messageType int, data []byte) error {
+		var e dockerapi.ContainerCreateEvent
+		if err := json.Unmarshal(data, &e); err != nil || e.Type == "" {
+			return nil // Not an event, such as a notice of the task broker
+		}
+		if e.Type != dockerapi.ContainerCreateEventProgress {
+			outcome = &e
+		}
+		if !stream {
+			return nil
+		}
+		return write(e)
+	})
+	defer conn.Close()
+
+	if nodeId == 1 {
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, m, conn)
+		err = dockerapi.ContainerCreate(&m, taskConn)
+		done(err)
+	} else {
+		err = messages.ProcessStreamTask[dockerapi.DockerContainerCreate](taskContext(c), h.taskBroker, uint(nodeId), m, conn)
+	}
+
+	if outcome == nil {
+		if err == nil {
+			err = errors.New("Container create ended without a result")
+		}
+		if !streaming {
+			return unprocessableEntity(c, err)
+		}
+		return write(dockerapi.ContainerCreateEvent{Type: dockerapi.ContainerCreateEventError, Error: err.Error()})
+	}
+
+	if streaming {
+		return nil
+	}
+	if outcome.Type == dockerapi.ContainerCreateEventError {
+		return unprocessableEntity(c, errors.New(outcome.Error))
+	}
+
+	return c.JSON(http.StatusCreated, containerCreatedResponse{Id: outcome.Id, Warnings: outcome.Warnings})
+}
+
+func (h *Handler) GetContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	req := dockerapi.DockerContainerInspect{Id: c.Param("id")}
+
+	var res *dockerapi.DockerContainerInspectResponse
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
+		res, err = dockerapi.ContainerInspect(&req)
+		done(err)
+	} else {
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerInspect, dockerapi.DockerContainerInspectResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -58,9 +166,11 @@ func (h *Handler) StartContainer(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.ContainerStart(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerContainerStart](uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerContainerStart](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -84,10 +194,18 @@ func (h *Handler) StopContainer(c echo.Context) error {
 		return unprocessableEntity(c, err)
 	}
 
+	// The agent must be given time to wait for the container to stop
+	timeout := defaultTimeout
+	if m.Timeout != nil {
+		timeout += time.Duration(*m.Timeout) * time.Second
+	}
+
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.ContainerStop(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerContainerStop](uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerContainerStop](taskContext(c), h.taskBroker, uint(nodeId), m, timeout)
 	}
 
 	if err != nil {
@@ -112,9 +230,11 @@ func (h *Handler) RestartContainer(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.ContainerRestart(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerContainerRestart](uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerContainerRestart](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -139,9 +259,127 @@ func (h *Handler) RemoveContainer(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.ContainerRemove(&m)
+		done(err)
+	} else {
+		err = messages.ProcessTask(taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return noContent(c)
+}
+
+func (h *Handler) PauseContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerPause{}
+	r := &dockerContainerPauseRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
+		err = dockerapi.ContainerPause(taskContext(c), &m)
+		done(err)
+	} else {
+		err = messages.ProcessTask[dockerapi.DockerContainerPause](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return noContent(c)
+}
+
+func (h *Handler) UnpauseContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerUnpause{}
+	r := &dockerContainerUnpauseRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
+		err = dockerapi.ContainerUnpause(taskContext(c), &m)
+		done(err)
+	} else {
+		err = messages.ProcessTask[dockerapi.DockerContainerUnpause](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return noContent(c)
+}
+
+func (h *Handler) KillContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerKill{}
+	r := &dockerContainerKillRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
+		err = dockerapi.ContainerKill(taskContext(c), &m)
+		done(err)
+	} else {
+		err = messages.ProcessTask[dockerapi.DockerContainerKill](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return noContent(c)
+}
+
+func (h *Handler) RenameContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerRename{}
+	r := &dockerContainerRenameRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
+		err = dockerapi.ContainerRename(taskContext(c), &m)
+		done(err)
 	} else {
-		err = messages.ProcessTask(uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerContainerRename](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -151,13 +389,77 @@ func (h *Handler) RemoveContainer(c echo.Context) error {
 	return noContent(c)
 }
 
+// RecreateContainer replaces a standalone container with one running the latest version of
+// its image and the same settings.
+func (h *Handler) RecreateContainer(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerRecreate{}
+	r := &dockerContainerRecreateRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	var res *dockerapi.DockerContainerRecreateResponse
+	if nodeId == 1 {
+		ctx, done := messages.RecordLocalCancellableTask(taskContext(c), h.taskBroker, 1, m)
+		res, err = dockerapi.ContainerRecreate(ctx, &m)
+		done(err)
+	} else {
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerRecreate, dockerapi.DockerContainerRecreateResponse](taskContext(c), h.taskBroker, uint(nodeId), m, recreateTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return ok(c, res)
+}
+
+// RecreateStaleContainers recreates all the standalone containers of the node whose image is
+// stale. Failures are reported per container.
+func (h *Handler) RecreateStaleContainers(c echo.Context) error {
+	var err error
+
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	m := dockerapi.DockerContainerRecreateStale{}
+
+	var res *dockerapi.DockerContainerRecreateStaleResponse
+	if nodeId == 1 {
+		ctx, done := messages.RecordLocalCancellableTask(taskContext(c), h.taskBroker, 1, m)
+		res, err = dockerapi.ContainerRecreateStale(ctx, &m)
+		done(err)
+	} else {
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerContainerRecreateStale, dockerapi.DockerContainerRecreateStaleResponse](taskContext(c), h.taskBroker, uint(nodeId), m, recreateStaleTimeout)
+	}
+
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	return ok(c, res)
+}
+
 func (h *Handler) ViewContainerLogs(c echo.Context) error {
 	nodeId, err := strconv.Atoi(c.Param("nodeId"))
 	if err != nil {
 		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
 	}
 
-	id := c.Param("id")
+	req := dockerapi.DockerContainerLogs{Id: c.Param("id")}
+	r := &dockerContainerLogsRequest{}
+	if err := r.bind(c, &req.ContainerLogsOptions); err != nil {
+		return unprocessableEntity(c, err)
+	}
 
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
@@ -166,14 +468,15 @@ func (h *Handler) ViewContainerLogs(c echo.Context) error {
 	}
 	defer ws.Close()
 
-	req := dockerapi.DockerContainerLogs{Id: id}
 	if nodeId == 1 {
-		err := dockerapi.ContainerLogs(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ContainerLogs(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ContainerLogs")
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerContainerLogs](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerContainerLogs](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ContainerLogs ProcessStreamTask")
 		}
@@ -182,7 +485,112 @@ func (h *Handler) ViewContainerLogs(c echo.Context) error {
 	return nil
 }
 
-func (h *Handler) OpenContainerTerminal(c echo.Context) error {
+// DownloadContainerLogs returns the logs of a container as a file, compressed with gzip if
+// asked for. The X-Logs-Truncated header tells whether older lines were left out. The logs are
+// passed on as they arrive from the task.
+func (h *Handler) DownloadContainerLogs(c echo.Context) error {
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	req := dockerapi.DockerContainerLogsDownload{Id: c.Param("id")}
+	r := &dockerContainerLogsDownloadRequest{}
+	if err := r.bind(c, &req.ContainerLogsOptions); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	// Closing the reader stops the task
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	starts := make(chan *dockerapi.ContainerLogsDownloadEvent, 1)
+	conn := newEventConn(taskContext(c), func(messageType int, data []byte) error {
+		if messageType == websocket.BinaryMessage {
+			_, err := pw.Write(data)
+			return err
+		}
+
+		var e dockerapi.ContainerLogsDownloadEvent
+		if err := json.Unmarshal(data, &e); err != nil || e.Type == "" {
+			// Notices of the task broker, such as the node being offline
+			pw.CloseWithError(errors.New(strings.Trim(string(data), "\n *")))
+			return nil
+		}
+		switch e.Type {
+		case dockerapi.ContainerLogsDownloadEventStart:
+			select {
+			case starts <- &e:
+			default:
+			}
+		case dockerapi.ContainerLogsDownloadEventDone:
+			pw.Close()
+		case dockerapi.ContainerLogsDownloadEventError:
+			pw.CloseWithError(errors.New(e.Error))
+		}
+		return nil
+	})
+	defer conn.Close()
+
+	go func() {
+		defer close(starts)
+
+		var err error
+		if nodeId == 1 {
+			taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, conn)
+			err = dockerapi.ContainerLogsDownload(&req, taskConn)
+			done(err)
+		} else {
+			err = messages.ProcessStreamTask[dockerapi.DockerContainerLogsDownload](taskContext(c), h.taskBroker, uint(nodeId), req, conn)
+		}
+
+		// The outcome is normally known from the events already, in which case this is a no-op
+		if err == nil {
+			err = errors.New("Logs download ended unexpectedly")
+		}
+		pw.CloseWithError(err)
+	}()
+
+	start := <-starts
+	if start == nil {
+		_, err := io.Copy(io.Discard, pr)
+		if err == nil {
+			err = errors.New("Logs download ended without the logs")
+		}
+		return unprocessableEntity(c, err)
+	}
+
+	c.Response().Header().Set("X-Logs-Truncated", strconv.FormatBool(start.Truncated))
+	fileName := fmt.Sprintf("%s-%s.log", shortContainerId(req.Id), time.Now().UTC().Format("20060102-150405"))
+
+	if r.Format == "gzip" {
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName+".gz"))
+		c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+		c.Response().WriteHeader(http.StatusOK)
+
+		zw := gzip.NewWriter(c.Response())
+		zw.Name = fileName
+		if _, err := io.Copy(zw, pr); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName))
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = io.Copy(c.Response(), pr)
+	return err
+}
+
+func shortContainerId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func (h *Handler) ViewContainerStats(c echo.Context) error {
 	nodeId, err := strconv.Atoi(c.Param("nodeId"))
 	if err != nil {
 		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
@@ -190,21 +598,59 @@ func (h *Handler) OpenContainerTerminal(c echo.Context) error {
 
 	id := c.Param("id")
 
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		log.Error().Err(err).Msg("Error while upgrading from http to websocket")
+		return err
+	}
+	defer ws.Close()
+
+	req := dockerapi.DockerContainerStats{Id: id}
+	if nodeId == 1 {
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ContainerStats(&req, taskConn)
+		done(err)
+		if err != nil {
+			log.Debug().Err(err).Msg("Error while calling ContainerStats")
+		}
+	} else {
+		err = messages.ProcessStreamTask[dockerapi.DockerContainerStats](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
+		if err != nil {
+			log.Debug().Err(err).Msg("Error while calling ContainerStats ProcessStreamTask")
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) OpenContainerTerminal(c echo.Context) error {
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	req := dockerapi.DockerContainerTerminal{Id: c.Param("id")}
+	r := &dockerContainerTerminalRequest{}
+	if err := r.bind(c, &req); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
 	defer ws.Close()
 
-	req := dockerapi.DockerContainerTerminal{Id: id}
 	if nodeId == 1 {
-		err = dockerapi.ContainerTerminal(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err = dockerapi.ContainerTerminal(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ContainerTerminal ProcessStreamTask")
 			return unprocessableEntity(c, err)
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerContainerTerminal](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerContainerTerminal](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ContainerTerminal ProcessStreamTask")
 		}
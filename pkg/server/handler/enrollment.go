@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// EnrollAgent exchanges the enrollment token an agent was deployed with for its credential.
+// The enrollment token can be used only once and before it expires. Credentials, including
+// tokens issued before enrollment tokens existed, are returned unchanged so that agents can
+// always call this on startup.
+func (h *Handler) EnrollAgent(c echo.Context) error {
+	var r messages.EnrollRequest
+	if err := c.Bind(&r); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	token, err := decryptToken(r.Token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, newError(err))
+	}
+
+	if !token.isEnrollment() {
+		_, _, err := h.authenticateAgent(r.Token)
+		if isTokenError(err) {
+			return c.JSON(http.StatusUnauthorized, newError(err))
+		}
+		if err != nil {
+			panic(err)
+		}
+		return ok(c, messages.EnrollResponse{Credential: r.Token})
+	}
+
+	if token.isExpired() {
+		return c.JSON(http.StatusUnauthorized, newError(errTokenExpired))
+	}
+
+	credential, err := newCredential(token.NodeId)
+	if err != nil {
+		panic(err)
+	}
+
+	consumed, err := h.nodeStore.ConsumeEnrollmentToken(token.NodeId, crypto.HashString(r.Token), crypto.HashString(credential))
+	if err != nil {
+		panic(err)
+	}
+	if !consumed {
+		return c.JSON(http.StatusUnauthorized, newError(errInvalidToken))
+	}
+
+	// An agent still connected with the previous credential is replaced by the new one
+	h.taskBroker.Disconnect(token.NodeId, "Node enrolled again")
+
+	log.Info().Uint("nodeId", token.NodeId).Msg("Agent enrolled")
+
+	return ok(c, messages.EnrollResponse{Credential: credential})
+}
@@ -49,3 +49,7 @@ func routeIntExpectedError(paramName string) error {
 func queryGte1ExpectedError(paramName string) error {
 	return errors.New("Parameter `" + paramName + "` in query string should be greater than or equal to 1.")
 }
+
+func queryTimeExpectedError(paramName string) error {
+	return errors.New("Parameter `" + paramName + "` in query string should be an RFC 3339 timestamp.")
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// eventConn stands in for the browser websocket of a stream task so that the task can serve a
+// plain HTTP request. The messages of the task are passed to onMessage. Nothing is sent to the
+// task unless messages are given with withInput. The task ends if the request is cancelled or
+// the connection is closed.
+type eventConn struct {
+	ctx       context.Context
+	onMessage func(messageType int, data []byte) error
+	input     <-chan connMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type connMessage struct {
+	messageType int
+	data        []byte
+}
+
+func newEventConn(ctx context.Context, onMessage func(messageType int, data []byte) error) *eventConn {
+	return &eventConn{ctx: ctx, onMessage: onMessage, closed: make(chan struct{})}
+}
+
+// withInput sends the messages of input to the task. The connection stays open once input is
+// closed, so that the task can still reply.
+func (c *eventConn) withInput(input <-chan connMessage) *eventConn {
+	c.input = input
+	return c
+}
+
+// Context makes the request context the task context of the tasks the server runs itself.
+func (c *eventConn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *eventConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m, ok := <-c.input:
+		if ok {
+			return m.messageType, m.data, nil
+		}
+	case <-c.closed:
+		return 0, nil, io.EOF
+	case <-c.ctx.Done():
+		return 0, nil, io.EOF
+	}
+
+	select {
+	case <-c.closed:
+	case <-c.ctx.Done():
+	}
+	return 0, nil, io.EOF
+}
+
+func (c *eventConn) NextReader() (int, io.Reader, error) {
+	mt, _, err := c.ReadMessage()
+	return mt, nil, err
+}
+
+func (c *eventConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.closed:
+		return errors.New("connection closed")
+	default:
+	}
+
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return nil
+	}
+	return c.onMessage(messageType, data)
+}
+
+func (c *eventConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *eventConn) SetPongHandler(h func(appData string) error) {
+}
+
+func (c *eventConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
@@ -6,6 +6,9 @@
 
 	"github.com/dokemon-ng/dokemon/web"
 
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ssl"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/presence"
 	"github.com/dokemon-ng/dokemon/pkg/server/store"
 
 	"github.com/labstack/echo/v4"
@@ -23,11 +26,42 @@ type Handler struct {
 	variableStore                   store.VariableStore
 	variableValueStore              store.VariableValueStore
 	fileSystemComposeLibraryStore   store.FileSystemComposeLibraryStore
+	taskStore                       store.TaskStore
+	taskBroker                      *messages.TaskBroker
+	presence                        *presence.Registry
+	ca                              *ssl.CertificateAuthority
 	composeProjectsPath             string
 }
 
 var defaultTimeout = 30 * time.Second
 
+// Agent updates are queued until the agent is connected. They are not retried as the update
+// itself disconnects the agent.
+var agentUpdateTaskPolicy = messages.TaskPolicy{
+	MaxAttempts: 1,
+	Expiry:      24 * time.Hour,
+	Timeout:     10 * time.Minute, // Includes pulling the agent image
+}
+
+// Container actions of bulk requests are queued for the nodes of agents. Those not run within
+// the hour are expired, as starting or stopping containers much later would be a surprise.
+var bulkTaskPolicy = messages.TaskPolicy{
+	MaxAttempts: 3,
+	Expiry:      time.Hour,
+	Timeout:     defaultTimeout,
+}
+
+var (
+	recreateTimeout      = 10 * time.Minute // Includes pulling the image
+	recreateStaleTimeout = time.Hour
+)
+
+// Limits of the files copied from and to containers, in bytes
+var (
+	maxContainerFilesDownloadSize int64 = 512 << 20
+	maxContainerFilesUploadSize   int64 = 100 << 20
+)
+
 func NewHandler(
 	composeProjectsPath string,
 	composeLibraryStore store.ComposeLibraryStore,
@@ -41,6 +75,10 @@ func NewHandler(
 	variableStore store.VariableStore,
 	variableValueStore store.VariableValueStore,
 	fileSystemComposeLibraryStore store.FileSystemComposeLibraryStore,
+	taskStore store.TaskStore,
+	taskBroker *messages.TaskBroker,
+	presence *presence.Registry,
+	ca *ssl.CertificateAuthority,
 ) *Handler {
 	return &Handler{
 		composeProjectsPath:             composeProjectsPath,
@@ -55,6 +93,10 @@ func NewHandler(
 		variableStore:                   variableStore,
 		variableValueStore:              variableValueStore,
 		fileSystemComposeLibraryStore:   fileSystemComposeLibraryStore,
+		taskStore:                       taskStore,
+		taskBroker:                      taskBroker,
+		presence:                        presence,
+		ca:                              ca,
 	}
 }
 
@@ -64,6 +106,8 @@ func (h *Handler) Register(e *echo.Echo) {
 	})
 
 	e.GET("/ws", h.HandleWebSocket) // This won't have versioning as we can't expect customers to update agents for new versions
+	e.POST("/agent/enroll", h.EnrollAgent)
+	e.POST("/agent/certificate", h.IssueAgentCertificate)
 
 	v1 := e.Group("/api/v1")
 
@@ -99,34 +143,58 @@ func (h *Handler) Register(e *echo.Echo) {
 	nodes.PUT("/:id", h.UpdateNode)
 	nodes.PATCH("/:id", h.UpdateNodeContainerBaseUrl)
 	nodes.GET("", h.GetNodeList)
+	nodes.GET("/outdated", h.GetOutdatedNodeList)
+	nodes.GET("/presence", h.GetNodePresenceList)
+	nodes.GET("/presence/ws", h.GetNodePresenceFeed)
 	nodes.GET("/:id", h.GetNodeById)
 	nodes.GET("/head/:id", h.GetNodeHeadById)
 	nodes.DELETE("/:id", h.DeleteNodeById)
 	nodes.GET("/uniquename", h.IsUniqueNodeName)
 	nodes.GET("/:id/uniquename", h.IsUniqueNodeNameExcludeItself)
 	nodes.POST("/:id/generatetoken", h.GenerateRegistrationToken)
+	nodes.POST("/:id/rotatetoken", h.RotateNodeToken)
+	nodes.POST("/:id/revoketoken", h.RevokeNodeToken)
+	nodes.POST("/:id/resetcertificate", h.ResetNodeCertificate)
+	nodes.POST("/:id/updateagent", h.UpdateNodeAgent)
+	nodes.GET("/:id/taskqueue", h.GetNodeTaskQueue)
 
-	containers := nodes.Group("/:nodeId/containers")
+	containers := nodes.Group("/:nodeId/containers", h.requireNodeOnline)
 	containers.GET("", h.GetContainerList)
+	containers.POST("", h.CreateContainer)
 	containers.POST("/start", h.StartContainer)
 	containers.POST("/stop", h.StopContainer)
 	containers.POST("/restart", h.RestartContainer)
 	containers.POST("/remove", h.RemoveContainer)
+	containers.POST("/pause", h.PauseContainer)
+	containers.POST("/unpause", h.UnpauseContainer)
+	containers.POST("/kill", h.KillContainer)
+	containers.POST("/rename", h.RenameContainer)
+	containers.POST("/recreate", h.RecreateContainer)
+	containers.POST("/recreate/stale", h.RecreateStaleContainers)
+	containers.GET("/:id", h.GetContainer)
 	containers.GET("/:id/logs", h.ViewContainerLogs)
+	containers.GET("/:id/logs/download", h.DownloadContainerLogs)
 	containers.GET("/:id/terminal", h.OpenContainerTerminal)
+	containers.GET("/:id/stats", h.ViewContainerStats)
+	containers.GET("/:id/files", h.DownloadContainerFiles)
+	containers.POST("/:id/files", h.UploadContainerFiles)
+	containers.GET("/:id/files/list", h.ListContainerFiles)
 
-	images := nodes.Group("/:nodeId/images")
+	bulkContainers := v1.Group("/containers")
+	bulkContainers.POST("/bulk", h.BulkContainerAction)
+
+	images := nodes.Group("/:nodeId/images", h.requireNodeOnline)
 	images.GET("", h.GetImageList)
 	images.POST("/remove", h.RemoveImage)
 	images.POST("/prune", h.PruneImages)
 
-	volumes := nodes.Group("/:nodeId/volumes")
+	volumes := nodes.Group("/:nodeId/volumes", h.requireNodeOnline)
 	volumes.GET("", h.GetVolumeList)
 	volumes.POST("/remove", h.RemoveVolume)
 	volumes.POST("/prune", h.PruneVolumes)
 	volumes.POST("/create", h.CreateVolume)
 
-	networks := nodes.Group("/:nodeId/networks")
+	networks := nodes.Group("/:nodeId/networks", h.requireNodeOnline)
 	networks.GET("", h.GetNetworkList)
 	networks.POST("/remove", h.RemoveNetwork)
 	networks.POST("/prune", h.PruneNetworks)
@@ -162,6 +230,7 @@ func (h *Handler) Register(e *echo.Echo) {
 	node_compose_project.DELETE("/:id", h.DeleteNodeComposeProject)
 	node_compose_project.GET("/:id/containers", h.GetNodeComposeContainerList)
 	node_compose_project.GET("/:id/logs", h.GetNodeComposeLogs)
+	node_compose_project.GET("/:id/stats", h.GetNodeComposeStats)
 	node_compose_project.GET("/:id/deploy", h.GetNodeComposeDeploy)
 	node_compose_project.GET("/:id/pull", h.GetNodeComposePull)
 	node_compose_project.GET("/:id/up", h.GetNodeComposeUp)
@@ -185,6 +254,11 @@ func (h *Handler) Register(e *echo.Echo) {
 	variables.GET("/uniquename", h.IsUniqueVariableName)
 	variables.GET("/:id/uniquename", h.IsUniqueVariableNameExcludeItself)
 
+	tasks := v1.Group("/tasks")
+	tasks.GET("", h.GetTaskList)
+	tasks.GET("/:id", h.GetTaskById)
+	tasks.DELETE("/:id", h.CancelTask)
+
 	disk_usage := v1.Group("/disk")
 	disk_usage.GET("", h.GetDiskUsage)
 	disk_usage.POST("/cache/prune", h.PruneBuildCache)
@@ -193,7 +267,7 @@ func (h *Handler) Register(e *echo.Echo) {
 	variablevalues.PUT("", h.CreateOrUpdateVariableValue)
 	variablevalues.GET("", h.GetVariableValue)
 
-	swarm_cluster := nodes.Group("/:nodeId/swarm")
+	swarm_cluster := nodes.Group("/:nodeId/swarm", h.requireNodeOnline)
 	swarm_cluster.GET("/nodes", h.GetSwarmClusterNodesList) // nodeId/swarm/nodes?role=manager&status=ready&availability=active
 	swarm_cluster.GET("/info", h.GetSwarmClusterInfo)
 	swarm_cluster.GET("/:id", h.GetSwarmNodeByID)
@@ -22,9 +22,11 @@ func (h *Handler) GetImageList(c echo.Context) error {
 
 	var res *dockerapi.DockerImageListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.ImageList(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerImageList, dockerapi.DockerImageListResponse](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerImageList, dockerapi.DockerImageListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -49,9 +51,11 @@ func (h *Handler) RemoveImage(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.ImageRemove(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerImageRemove](uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerImageRemove](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -77,9 +81,11 @@ func (h *Handler) PruneImages(c echo.Context) error {
 
 	var res *dockerapi.DockerImagesPruneResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		res, err = dockerapi.ImagesPrune(&m)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerImagesPrune, dockerapi.DockerImagesPruneResponse](uint(nodeId), m, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerImagesPrune, dockerapi.DockerImagesPruneResponse](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -23,10 +23,12 @@ func (h *Handler) CreateNetwork(c echo.Context) error {
 
 	var res *dockerapi.DockerNetworkCreateResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		res, err = dockerapi.NetworkCreate(&m)
+		done(err)
 	} else {
 		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerNetworkCreate, dockerapi.DockerNetworkCreateResponse](
-			uint(nodeId), m, defaultTimeout)
+			taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -48,9 +50,11 @@ func (h *Handler) GetNetworkList(c echo.Context) error {
 
 	var res *dockerapi.DockerNetworkListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.NetworkList(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerNetworkList, dockerapi.DockerNetworkListResponse](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerNetworkList, dockerapi.DockerNetworkListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -75,9 +79,11 @@ func (h *Handler) RemoveNetwork(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.NetworkRemove(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerNetworkRemove](uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerNetworkRemove](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -99,9 +105,11 @@ func (h *Handler) PruneNetworks(c echo.Context) error {
 
 	var res *dockerapi.DockerNetworksPruneResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		res, err = dockerapi.NetworksPrune(&m)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerNetworksPrune, dockerapi.DockerNetworksPruneResponse](uint(nodeId), m, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerNetworksPrune, dockerapi.DockerNetworksPruneResponse](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
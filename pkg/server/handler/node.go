@@ -1,14 +1,14 @@
 package handler
 
 import (
-	"encoding/json"
 	"errors"
 	"slices"
 	"strconv"
 	"time"
 
+	"github.com/dokemon-ng/dokemon/pkg/common"
 	"github.com/dokemon-ng/dokemon/pkg/crypto"
-	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/dokemon-ng/dokemon/pkg/server/model"
 
 	"github.com/labstack/echo/v4"
@@ -158,7 +158,7 @@ func (h *Handler) GetNodeList(c echo.Context) error {
 		rows[idx].LastPing = &lastPing
 	}
 
-	return ok(c, newPageResponse[nodeHead](newNodeHeadList(rows), uint(p), uint(s), uint(totalRows)))
+	return ok(c, newPageResponse[nodeHead](newNodeHeadList(rows, h.isNodeOnline), uint(p), uint(s), uint(totalRows)))
 }
 
 func (h *Handler) GetNodeHeadById(c echo.Context) error {
@@ -183,7 +183,7 @@ func (h *Handler) GetNodeHeadById(c echo.Context) error {
 		m.LastPing = &lastPing
 	}
 
-	return ok(c, newNodeHead(m))
+	return ok(c, newNodeHead(m, h.isNodeOnline(m.Id)))
 }
 
 func (h *Handler) GetNodeById(c echo.Context) error {
@@ -238,6 +238,9 @@ func (h *Handler) IsUniqueNodeNameExcludeItself(c echo.Context) error {
 	return ok(c, newUniqueResponse(unique))
 }
 
+// GenerateRegistrationToken issues an enrollment token for deploying the agent of the node.
+// The agent exchanges it for its credential when it starts. An agent already connected keeps
+// running until the token is used.
 func (h *Handler) GenerateRegistrationToken(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -248,6 +251,11 @@ func (h *Handler) GenerateRegistrationToken(c echo.Context) error {
 		return unprocessableEntity(c, errors.New("Token cannot be generated for this node"))
 	}
 
+	r := &nodeTokenRequest{}
+	if err := r.bind(c); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
 	m, err := h.nodeStore.GetById(uint(id))
 	if err != nil {
 		panic(err)
@@ -257,15 +265,207 @@ func (h *Handler) GenerateRegistrationToken(c echo.Context) error {
 		return resourceNotFound(c, "Node")
 	}
 
-	tokenBytes, _ := json.Marshal(Token{NodeId: uint(id)})
-	encryptedToken, _ := ske.Encrypt(string(tokenBytes))
+	encryptedToken, expiresAt, err := newEnrollmentToken(uint(id), r.ttl())
+	if err != nil {
+		panic(err)
+	}
+
+	err = h.nodeStore.UpdateEnrollmentToken(uint(id), crypto.HashString(encryptedToken), expiresAt)
+	if err != nil {
+		panic(err)
+	}
+
+	return ok(c, newAgentRegistrationTokenResponse(encryptedToken, expiresAt, h.ca.Fingerprint()))
+}
+
+// RotateNodeToken replaces the credential of a connected agent without disconnecting it. The
+// new credential is sent to the agent and only replaces the old one once the agent confirms
+// that it stored it.
+func (h *Handler) RotateNodeToken(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("id"))
+	}
+
+	if id == 1 {
+		return unprocessableEntity(c, errors.New("Token cannot be rotated for this node"))
+	}
+
+	exists, err := h.nodeStore.Exists(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	if !exists {
+		return resourceNotFound(c, "Node")
+	}
+
+	if !h.taskBroker.IsNodeConnected(uint(id)) {
+		return unprocessableEntity(c, messages.ErrNodeOffline)
+	}
+
+	credential, err := newCredential(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	tokenHash := crypto.HashString(credential)
+	err = h.nodeStore.UpdatePendingTokenHash(uint(id), tokenHash)
+	if err != nil {
+		panic(err)
+	}
+
+	// If this fails after the agent stored the credential, the pending credential is
+	// confirmed when the agent connects with it
+	err = messages.ProcessTask(taskContext(c), h.taskBroker, uint(id), messages.AgentCredentialRotate{Credential: credential}, defaultTimeout)
+	if err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	err = h.nodeStore.PromotePendingTokenHash(uint(id), tokenHash)
+	if err != nil {
+		panic(err)
+	}
+
+	return noContent(c)
+}
+
+// RevokeNodeToken invalidates every token of the node and disconnects its agent. The node has
+// to be registered again with a new enrollment token.
+func (h *Handler) RevokeNodeToken(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("id"))
+	}
+
+	if id == 1 {
+		return unprocessableEntity(c, errors.New("Token cannot be revoked for this node"))
+	}
+
+	exists, err := h.nodeStore.Exists(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	if !exists {
+		return resourceNotFound(c, "Node")
+	}
+
+	err = h.nodeStore.RevokeTokens(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	h.taskBroker.Disconnect(uint(id), "Token revoked")
+
+	return noContent(c)
+}
+
+// ResetNodeCertificate forgets the client certificate of the node and disconnects its agent,
+// which then enrolls for a new one with its connection token alone.
+func (h *Handler) ResetNodeCertificate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("id"))
+	}
+
+	if id == 1 {
+		return unprocessableEntity(c, errors.New("Certificate cannot be reset for this node"))
+	}
+
+	exists, err := h.nodeStore.Exists(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	if !exists {
+		return resourceNotFound(c, "Node")
+	}
+
+	err = h.nodeStore.UpdateCertificateFingerprint(uint(id), "")
+	if err != nil {
+		panic(err)
+	}
+
+	h.taskBroker.Disconnect(uint(id), "Client certificate reset")
+
+	return noContent(c)
+}
+
+// UpdateNodeAgent makes the agent of the node replace its container with one running the
+// requested image. The update is queued, so that agents which are offline are updated once
+// they reconnect. The agent reconnects once the new container has started.
+func (h *Handler) UpdateNodeAgent(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("id"))
+	}
+
+	if id == 1 {
+		return unprocessableEntity(c, errors.New("The server is updated by recreating its container"))
+	}
+
+	m := messages.AgentUpdate{}
+	r := &nodeAgentUpdateRequest{}
+	if err := r.bind(c, &m); err != nil {
+		return unprocessableEntity(c, err)
+	}
+
+	exists, err := h.nodeStore.Exists(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	if !exists {
+		return resourceNotFound(c, "Node")
+	}
+
+	taskId, err := messages.QueueTask(taskContext(c), h.taskBroker, uint(id), m, agentUpdateTaskPolicy)
+	if err != nil {
+		panic(err)
+	}
 
-	tokenHash := crypto.HashString(encryptedToken)
-	m.TokenHash = &tokenHash
-	err = h.nodeStore.Update(m)
+	return accepted(c, taskId)
+}
+
+// GetOutdatedNodeList returns the nodes whose agent is older than the server.
+func (h *Handler) GetOutdatedNodeList(c echo.Context) error {
+	rows, err := h.nodeStore.GetAll()
 	if err != nil {
 		panic(err)
 	}
 
-	return ok(c, newAgentRegistrationTokenResponse(encryptedToken))
+	items := []nodeHead{}
+	for _, r := range rows {
+		if isAgentOutdated(&r) {
+			items = append(items, newNodeHead(&r, h.isNodeOnline(r.Id)))
+		}
+	}
+
+	return ok(c, outdatedNodeListResponse{Items: items, ServerVersion: common.Version})
+}
+
+// GetNodeTaskQueue returns the load of the task lanes last reported by the agent of the node.
+// The server runs the tasks of its own node directly, so that node has no lanes.
+func (h *Handler) GetNodeTaskQueue(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("id"))
+	}
+
+	m, err := h.nodeStore.GetById(uint(id))
+	if err != nil {
+		panic(err)
+	}
+
+	if m == nil {
+		return resourceNotFound(c, "Node")
+	}
+
+	if id == 1 {
+		return ok(c, newNodeTaskQueueResponse(true, nil, time.Time{}))
+	}
+
+	status, reportedAt := h.taskBroker.AgentStatus(uint(id))
+	return ok(c, newNodeTaskQueueResponse(h.taskBroker.IsNodeConnected(uint(id)), status, reportedAt))
 }
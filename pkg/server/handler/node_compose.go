@@ -49,9 +49,11 @@ func (h *Handler) GetNodeComposeProjectList(c echo.Context) error {
 
 	var res *dockerapi.DockerComposeListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.ComposeList(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerComposeList, dockerapi.DockerComposeListResponse](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerComposeList, dockerapi.DockerComposeListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -91,9 +93,11 @@ func (h *Handler) GetNodeComposeProject(c echo.Context) error {
 
 	var res *dockerapi.ComposeItem
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.ComposeGet(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerComposeGet, dockerapi.ComposeItem](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerComposeGet, dockerapi.ComposeItem](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -123,9 +127,11 @@ func (h *Handler) GetNodeComposeContainerList(c echo.Context) error {
 
 	var res *dockerapi.DockerComposeContainerListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.ComposeContainerList(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerComposeContainerList, dockerapi.DockerComposeContainerListResponse](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerComposeContainerList, dockerapi.DockerComposeContainerListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -511,12 +517,14 @@ func (h *Handler) GetNodeComposeDeploy(c echo.Context) error {
 
 	req := dockerapi.DockerComposeDeploy{ProjectName: ncp.ProjectName, Definition: definition, Variables: variables}
 	if nodeId == 1 {
-		err := dockerapi.ComposeDeploy(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ComposeDeploy(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ComposeDeploy")
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerComposeDeploy](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerComposeDeploy](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ComposeDeploy ProcessStreamTask")
 		}
@@ -567,12 +575,14 @@ func (h *Handler) GetNodeComposePull(c echo.Context) error {
 
 	req := dockerapi.DockerComposePull{ProjectName: ncp.ProjectName, Definition: definition, Variables: variables}
 	if nodeId == 1 {
-		err := dockerapi.ComposePull(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ComposePull(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ComposePull")
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerComposePull](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerComposePull](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ComposePull ProcessStreamTask")
 		}
@@ -623,12 +633,14 @@ func (h *Handler) GetNodeComposeUp(c echo.Context) error {
 
 	req := dockerapi.DockerComposeUp{ProjectName: ncp.ProjectName, Definition: definition, Variables: variables}
 	if nodeId == 1 {
-		err := dockerapi.ComposeUp(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ComposeUp(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling DockerComposeUp")
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerComposeUp](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerComposeUp](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling DockerComposeUp ProcessStreamTask")
 		}
@@ -662,12 +674,14 @@ func (h *Handler) GetNodeComposeDown(c echo.Context) error {
 
 	req := dockerapi.DockerComposeDown{ProjectName: ncp.ProjectName}
 	if nodeId == 1 {
-		err := dockerapi.ComposeDown(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ComposeDown(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling DockerComposeDown")
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerComposeDown](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerComposeDown](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling DockerComposeDown ProcessStreamTask")
 		}
@@ -701,12 +715,14 @@ func (h *Handler) GetNodeComposeLogs(c echo.Context) error {
 
 	req := dockerapi.DockerComposeLogs{ProjectName: ncp.ProjectName}
 	if nodeId == 1 {
-		err := dockerapi.ComposeLogs(&req, ws)
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ComposeLogs(&req, taskConn)
+		done(err)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ComposeLogs")
 		}
 	} else {
-		err = messages.ProcessStreamTask[dockerapi.DockerComposeLogs](uint(nodeId), req, ws)
+		err = messages.ProcessStreamTask[dockerapi.DockerComposeLogs](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
 		if err != nil {
 			log.Debug().Err(err).Msg("Error while calling ComposeLogs ProcessStreamTask")
 		}
@@ -715,6 +731,47 @@ func (h *Handler) GetNodeComposeLogs(c echo.Context) error {
 	return nil
 }
 
+func (h *Handler) GetNodeComposeStats(c echo.Context) error {
+	nodeId, err := strconv.Atoi(c.Param("nodeId"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("nodeId should be an integer"))
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("id should be an integer"))
+	}
+
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		log.Error().Err(err).Msg("Error while upgrading from http to websocket")
+		return err
+	}
+	defer ws.Close()
+
+	ncp, err := h.nodeComposeProjectStore.GetById(uint(nodeId), uint(id))
+	if err != nil {
+		return unprocessableEntity(c, errors.New("Project not found"))
+	}
+
+	req := dockerapi.DockerComposeStats{ProjectName: ncp.ProjectName}
+	if nodeId == 1 {
+		taskConn, done := messages.RecordLocalStreamTask(taskContext(c), h.taskBroker, 1, req, ws)
+		err := dockerapi.ComposeStats(&req, taskConn)
+		done(err)
+		if err != nil {
+			log.Debug().Err(err).Msg("Error while calling ComposeStats")
+		}
+	} else {
+		err = messages.ProcessStreamTask[dockerapi.DockerComposeStats](taskContext(c), h.taskBroker, uint(nodeId), req, ws)
+		if err != nil {
+			log.Debug().Err(err).Msg("Error while calling ComposeStats ProcessStreamTask")
+		}
+	}
+
+	return nil
+}
+
 func (h *Handler) DeleteNodeComposeProject(c echo.Context) error {
 	nodeId, err := strconv.Atoi(c.Param("nodeId"))
 	if err != nil {
@@ -734,9 +791,11 @@ func (h *Handler) DeleteNodeComposeProject(c echo.Context) error {
 	req := dockerapi.DockerComposeDownNoStreaming{ProjectName: ncp.ProjectName}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		err = dockerapi.ComposeDownNoStreaming(&req)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerComposeDownNoStreaming](uint(nodeId), req, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerComposeDownNoStreaming](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/presence"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// isNodeOnline reports whether tasks can be run on the node. The server runs the tasks of its
+// own node, which is always online.
+func (h *Handler) isNodeOnline(nodeId uint) bool {
+	return nodeId == 1 || h.presence.IsOnline(nodeId)
+}
+
+// requireNodeOnline fails requests for nodes whose agent is not connected instead of letting
+// them wait for a task that can't run. Websocket requests go through so that the reason can
+// be shown in the stream.
+func (h *Handler) requireNodeOnline(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		nodeId, err := strconv.Atoi(c.Param("nodeId"))
+		if err != nil || c.IsWebSocket() || h.isNodeOnline(uint(nodeId)) {
+			return next(c)
+		}
+
+		return unprocessableEntity(c, messages.ErrNodeOffline)
+	}
+}
+
+// GetNodePresenceList returns the nodes whose agent is connected.
+func (h *Handler) GetNodePresenceList(c echo.Context) error {
+	return ok(c, nodePresenceListResponse{Items: h.presence.List()})
+}
+
+// GetNodePresenceFeed streams the online and offline transitions of nodes. It starts with an
+// online event for every connected node. The stream ends if the browser can't keep up, in
+// which case it should reconnect.
+func (h *Handler) GetNodePresenceFeed(c echo.Context) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	nodes, events, unsubscribe := h.presence.Subscribe()
+	defer unsubscribe()
+
+	// Nothing is expected from the browser, but reading is how its leaving is noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, n := range nodes {
+		err := ws.WriteJSON(presence.Event{NodeId: n.NodeId, Online: true, At: n.ConnectedAt})
+		if err != nil {
+			return nil
+		}
+	}
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				log.Debug().Msg("Presence feed closed")
+				return nil
+			}
+			err := ws.WriteJSON(e)
+			if err != nil {
+				log.Debug().Err(err).Msg("Error while sending presence event to browser")
+				return nil
+			}
+		}
+	}
+}
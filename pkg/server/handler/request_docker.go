@@ -1,8 +1,15 @@
 package handler
 
 import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
 
+	timetypes "github.com/docker/docker/api/types/time"
 	"github.com/labstack/echo/v4"
 )
 
@@ -24,7 +31,8 @@ func (r *dockerContainerStartRequest) bind(c echo.Context, m *dockerapi.DockerCo
 }
 
 type dockerContainerStopRequest struct {
-	Id string `json:"id" validate:"required,max=100"`
+	Id      string `json:"id" validate:"required,max=100"`
+	Timeout *int   `json:"timeout" validate:"omitempty,min=0,max=3600"`
 }
 
 func (r *dockerContainerStopRequest) bind(c echo.Context, m *dockerapi.DockerContainerStop) error {
@@ -37,6 +45,7 @@ func (r *dockerContainerStopRequest) bind(c echo.Context, m *dockerapi.DockerCon
 	}
 
 	m.Id = r.Id
+	m.Timeout = r.Timeout
 	return nil
 }
 
@@ -76,6 +85,356 @@ func (r *dockerContainerRemoveRequest) bind(c echo.Context, m *dockerapi.DockerC
 	return nil
 }
 
+type dockerContainerPauseRequest struct {
+	Id string `json:"id" validate:"required,max=100"`
+}
+
+func (r *dockerContainerPauseRequest) bind(c echo.Context, m *dockerapi.DockerContainerPause) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Id = r.Id
+	return nil
+}
+
+type dockerContainerUnpauseRequest struct {
+	Id string `json:"id" validate:"required,max=100"`
+}
+
+func (r *dockerContainerUnpauseRequest) bind(c echo.Context, m *dockerapi.DockerContainerUnpause) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Id = r.Id
+	return nil
+}
+
+type dockerContainerKillRequest struct {
+	Id     string `json:"id" validate:"required,max=100"`
+	Signal string `json:"signal" validate:"omitempty,max=20,printascii"`
+}
+
+func (r *dockerContainerKillRequest) bind(c echo.Context, m *dockerapi.DockerContainerKill) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Id = r.Id
+	m.Signal = r.Signal
+	return nil
+}
+
+type dockerContainerRenameRequest struct {
+	Id   string `json:"id" validate:"required,max=100"`
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+func (r *dockerContainerRenameRequest) bind(c echo.Context, m *dockerapi.DockerContainerRename) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Id = r.Id
+	m.Name = r.Name
+	return nil
+}
+
+type dockerContainerCreateRequest struct {
+	Image         string                         `json:"image" validate:"required,max=255"`
+	Name          string                         `json:"name" validate:"omitempty,max=100"`
+	Cmd           []string                       `json:"cmd"`
+	Env           []string                       `json:"env" validate:"dive,required"`
+	Ports         []dockerContainerPortRequest   `json:"ports" validate:"dive"`
+	Volumes       []dockerContainerVolumeRequest `json:"volumes" validate:"dive"`
+	Networks      []string                       `json:"networks" validate:"dive,required,max=100"`
+	RestartPolicy string                         `json:"restartPolicy" validate:"omitempty,oneof=no always unless-stopped on-failure"`
+	MaxRetries    int                            `json:"maxRetries" validate:"min=0"`
+	Labels        map[string]string              `json:"labels"`
+	Memory        int64                          `json:"memory" validate:"min=0"`
+	Cpus          float64                        `json:"cpus" validate:"min=0"`
+	Pull          string                         `json:"pull" validate:"omitempty,oneof=always missing never"`
+	Start         *bool                          `json:"start"`
+}
+
+type dockerContainerPortRequest struct {
+	HostIp        string `json:"hostIp" validate:"omitempty,ip"`
+	HostPort      uint16 `json:"hostPort"`
+	ContainerPort uint16 `json:"containerPort" validate:"required"`
+	Protocol      string `json:"protocol" validate:"omitempty,oneof=tcp udp sctp"`
+}
+
+type dockerContainerVolumeRequest struct {
+	Source   string `json:"source" validate:"required,max=4096"`
+	Target   string `json:"target" validate:"required,max=4096"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+func (r *dockerContainerCreateRequest) bind(c echo.Context, m *dockerapi.DockerContainerCreate) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Image = r.Image
+	m.Name = r.Name
+	m.Cmd = r.Cmd
+	m.Env = r.Env
+	for _, p := range r.Ports {
+		m.Ports = append(m.Ports, dockerapi.PortMapping{HostIp: p.HostIp, HostPort: p.HostPort, ContainerPort: p.ContainerPort, Protocol: p.Protocol})
+	}
+	for _, v := range r.Volumes {
+		m.Volumes = append(m.Volumes, dockerapi.VolumeMapping{Source: v.Source, Target: v.Target, ReadOnly: v.ReadOnly})
+	}
+	m.Networks = r.Networks
+	m.RestartPolicy = r.RestartPolicy
+	m.MaxRetries = r.MaxRetries
+	m.Labels = r.Labels
+	m.Memory = r.Memory
+	m.Cpus = r.Cpus
+	m.Pull = r.Pull
+	m.NoStart = r.Start != nil && !*r.Start
+	return nil
+}
+
+type dockerContainerRecreateRequest struct {
+	Id string `json:"id" validate:"required,max=100"`
+}
+
+func (r *dockerContainerRecreateRequest) bind(c echo.Context, m *dockerapi.DockerContainerRecreate) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Id = r.Id
+	return nil
+}
+
+type bulkContainerActionRequest struct {
+	Items    []bulkContainerActionItemRequest `json:"items" validate:"max=500,dive"`
+	Selector *bulkContainerSelectorRequest    `json:"selector"`
+	Force    bool                             `json:"force"` // Remove running containers
+}
+
+type bulkContainerActionItemRequest struct {
+	NodeId      uint   `json:"nodeId" validate:"required"`
+	ContainerId string `json:"containerId" validate:"required,max=100"`
+	Action      string `json:"action" validate:"required,oneof=start stop restart remove"`
+}
+
+// bulkContainerSelectorRequest picks the containers with all the labels, given as key or
+// key=value, on the nodes. All nodes are searched if none are given.
+type bulkContainerSelectorRequest struct {
+	Labels  []string `json:"labels" validate:"min=1,max=20,dive,required,max=255"`
+	NodeIds []uint   `json:"nodeIds" validate:"max=500"`
+	Action  string   `json:"action" validate:"required,oneof=start stop restart remove"`
+}
+
+func (r *bulkContainerActionRequest) bind(c echo.Context) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	if len(r.Items) == 0 && r.Selector == nil {
+		return errors.New("items or selector is required")
+	}
+	return nil
+}
+
+type dockerContainerTerminalRequest struct {
+	Cmd        string `query:"cmd" validate:"max=255"` // Split on spaces
+	User       string `query:"user" validate:"max=100"`
+	WorkingDir string `query:"workdir" validate:"max=255"`
+	Cols       uint   `query:"cols" validate:"max=1000"`
+	Rows       uint   `query:"rows" validate:"max=1000"`
+}
+
+func (r *dockerContainerTerminalRequest) bind(c echo.Context, m *dockerapi.DockerContainerTerminal) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Cmd = strings.Fields(r.Cmd)
+	m.User = r.User
+	m.WorkingDir = r.WorkingDir
+	m.Cols = r.Cols
+	m.Rows = r.Rows
+	return nil
+}
+
+type dockerContainerFilesListRequest struct {
+	Path string `query:"path" validate:"required,max=4096"`
+}
+
+func (r *dockerContainerFilesListRequest) bind(c echo.Context, m *dockerapi.DockerContainerFilesList) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	if !path.IsAbs(r.Path) {
+		return errors.New("path should be absolute")
+	}
+
+	m.Path = r.Path
+	return nil
+}
+
+type dockerContainerFilesDownloadRequest struct {
+	Path   string `query:"path" validate:"required,max=4096"`
+	Format string `query:"format" validate:"omitempty,oneof=tar file"`
+}
+
+func (r *dockerContainerFilesDownloadRequest) bind(c echo.Context, m *dockerapi.DockerContainerFilesDownload) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	if !path.IsAbs(r.Path) {
+		return errors.New("path should be absolute")
+	}
+
+	m.Path = r.Path
+	return nil
+}
+
+type dockerContainerFilesUploadRequest struct {
+	Path string `query:"path" validate:"required,max=4096"`
+}
+
+// Echo only binds query parameters for GET and DELETE, so they are bound explicitly
+func (r *dockerContainerFilesUploadRequest) bind(c echo.Context, m *dockerapi.DockerContainerFilesUpload) error {
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	if !path.IsAbs(r.Path) {
+		return errors.New("path should be absolute")
+	}
+
+	m.Path = r.Path
+	return nil
+}
+
+type dockerContainerLogsRequest struct {
+	Tail       string `query:"tail" validate:"omitempty,max=20"`
+	Since      string `query:"since" validate:"omitempty,max=50"`
+	Until      string `query:"until" validate:"omitempty,max=50"`
+	Timestamps bool   `query:"timestamps"`
+	Stream     string `query:"stream" validate:"omitempty,oneof=stdout stderr all"`
+	Follow     *bool  `query:"follow"`
+}
+
+func (r *dockerContainerLogsRequest) bind(c echo.Context, m *dockerapi.ContainerLogsOptions) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	return r.options(m)
+}
+
+func (r *dockerContainerLogsRequest) options(m *dockerapi.ContainerLogsOptions) error {
+	if r.Tail != "" && r.Tail != "all" {
+		if n, err := strconv.Atoi(r.Tail); err != nil || n < 0 {
+			return errors.New("tail should be a number of lines or all")
+		}
+	}
+	// Checked here as the Docker client of an agent would only fail once the task is running
+	if r.Since != "" {
+		if _, err := timetypes.GetTimestamp(r.Since, time.Now()); err != nil {
+			return errors.New("since should be a timestamp or a duration such as 10m")
+		}
+	}
+	if r.Until != "" {
+		if _, err := timetypes.GetTimestamp(r.Until, time.Now()); err != nil {
+			return errors.New("until should be a timestamp or a duration such as 10m")
+		}
+	}
+
+	m.Tail = r.Tail
+	m.Since = r.Since
+	m.Until = r.Until
+	m.Timestamps = r.Timestamps
+	if r.Stream != "all" {
+		m.Stream = r.Stream
+	}
+	m.NoFollow = r.Follow != nil && !*r.Follow
+	return nil
+}
+
+type dockerContainerLogsDownloadRequest struct {
+	dockerContainerLogsRequest
+	Format string `query:"format" validate:"omitempty,oneof=text gzip"`
+}
+
+// Echo doesn't bind the fields of embedded structs, so the options are bound on their own
+func (r *dockerContainerLogsDownloadRequest) bind(c echo.Context, m *dockerapi.ContainerLogsOptions) error {
+	if err := r.dockerContainerLogsRequest.bind(c, m); err != nil {
+		return err
+	}
+
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	// A download is for the whole logs unless told otherwise, within the size limit
+	if m.Tail == "" {
+		m.Tail = "all"
+	}
+	return nil
+}
+
 type dockerImageRemoveRequest struct {
 	Id    string `json:"id" validate:"required,max=100"`
 	Force bool   `json:"force"`
@@ -1,6 +1,10 @@
 package handler
 
 import (
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/common"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/dokemon-ng/dokemon/pkg/server/model"
 
 	"github.com/labstack/echo/v4"
@@ -67,3 +71,50 @@ func (r *nodeContainerBaseUrlUpdateRequest) bind(c echo.Context, m *model.Node)
 
 	return nil
 }
+
+type nodeTokenRequest struct {
+	TtlMinutes uint `json:"ttlMinutes" validate:"lte=43200"` // Defaults to a day. At most 30 days.
+}
+
+func (r *nodeTokenRequest) bind(c echo.Context) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *nodeTokenRequest) ttl() time.Duration {
+	if r.TtlMinutes == 0 {
+		return defaultEnrollmentTokenTtl
+	}
+
+	return time.Duration(r.TtlMinutes) * time.Minute
+}
+
+type nodeAgentUpdateRequest struct {
+	Image string `json:"image"` // Image reference. Defaults to the image of the agent with the tag.
+	Tag   string `json:"tag"`   // Defaults to the version of the server
+}
+
+func (r *nodeAgentUpdateRequest) bind(c echo.Context, m *messages.AgentUpdate) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	m.Image = r.Image
+	m.Tag = r.Tag
+	if m.Image == "" && m.Tag == "" {
+		m.Tag = common.Version
+	}
+
+	return nil
+}
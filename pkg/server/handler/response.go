@@ -20,6 +20,10 @@ type entityCreatedResponse struct {
 	Id any `json:"id"`
 }
 
+type taskQueuedResponse struct {
+	TaskId string `json:"taskId"`
+}
+
 type uniqueResponse struct {
 	Unique bool `json:"unique"`
 }
@@ -47,6 +51,12 @@ func created(c echo.Context, id any) error {
 	return c.JSON(http.StatusCreated, entityCreatedResponse{Id: id})
 }
 
+// accepted answers requests whose work was queued as a task. Its outcome is found in the task
+// history.
+func accepted(c echo.Context, taskId string) error {
+	return c.JSON(http.StatusAccepted, taskQueuedResponse{TaskId: taskId})
+}
+
 func noContent(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
@@ -1 +1,40 @@
 package handler
+
+type containerCreatedResponse struct {
+	Id       string   `json:"id"`
+	Warnings []string `json:"warnings"`
+}
+
+type bulkContainerActionResult struct {
+	NodeId      uint   `json:"nodeId"`
+	ContainerId string `json:"containerId"`
+	Name        string `json:"name,omitempty"` // Only known for containers picked by the selector
+	Action      string `json:"action"`
+	TaskId      string `json:"taskId,omitempty"` // Task queued for the node of an agent
+	Ok          bool   `json:"ok"`
+	Queued      bool   `json:"queued"`                // Not completed yet. Its outcome is found with the task id.
+	NodeOffline bool   `json:"nodeOffline,omitempty"` // Queued until the agent connects, or left out of the selection
+	Error       string `json:"error,omitempty"`
+}
+
+type bulkContainerActionResponse struct {
+	Succeeded int                         `json:"succeeded"`
+	Queued    int                         `json:"queued"`
+	Failed    int                         `json:"failed"`
+	Items     []bulkContainerActionResult `json:"items"`
+}
+
+func newBulkContainerActionResponse(results []bulkContainerActionResult) *bulkContainerActionResponse {
+	res := &bulkContainerActionResponse{Items: results}
+	for _, r := range results {
+		switch {
+		case r.Ok:
+			res.Succeeded++
+		case r.Queued:
+			res.Queued++
+		default:
+			res.Failed++
+		}
+	}
+	return res
+}
@@ -1,15 +1,32 @@
 package handler
 
 import (
+	"encoding/json"
+	"strings"
 	"time"
 
+	"github.com/dokemon-ng/dokemon/pkg/common"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/dokemon-ng/dokemon/pkg/server/model"
+	"github.com/dokemon-ng/dokemon/pkg/server/presence"
+
+	"github.com/rs/zerolog/log"
 )
 
 type nodeResponse struct {
-	EnvironmentId *uint  `json:"environmentId"`
-	Name          string `json:"name"`
-	Id            uint   `json:"id"`
+	EnvironmentId *uint                `json:"environmentId"`
+	Network       *nodeNetworkResponse `json:"network"` // Not reported by older agents
+	Name          string               `json:"name"`
+	Id            uint                 `json:"id"`
+}
+
+type nodeNetworkResponse struct {
+	Hostname       string                    `json:"hostname"`
+	PrimaryIp      string                    `json:"primaryIp"`
+	DefaultGateway string                    `json:"defaultGateway"`
+	ZeroTierIps    []string                  `json:"zeroTierIps"`
+	TailscaleIps   []string                  `json:"tailscaleIps"`
+	Interfaces     []common.NetworkInterface `json:"interfaces"`
 }
 
 func newNodeResponse(m *model.Node) *nodeResponse {
@@ -17,54 +34,151 @@ func newNodeResponse(m *model.Node) *nodeResponse {
 		Id:            m.Id,
 		Name:          m.Name,
 		EnvironmentId: m.EnvironmentId,
+		Network:       newNodeNetworkResponse(m),
 	}
 }
 
-type nodeHead struct {
-	ContainerBaseUrl *string `json:"containerBaseUrl"`
-	Name             string  `json:"name"`
-	AgentVersion     string  `json:"agentVersion"`
-	Environment      string  `json:"environment"`
-	Id               uint    `json:"id"`
-	Online           bool    `json:"online"`
-	Registered       bool    `json:"registered"`
-}
-
-func newNodeHead(m *model.Node) nodeHead {
-	online := false
-	if m.LastPing != nil {
-		online = m.LastPing.After(time.Now().Add(time.Minute * -2))
+func newNodeNetworkResponse(m *model.Node) *nodeNetworkResponse {
+	if m.NetworkInterfaces == "" {
+		return nil
 	}
 
+	interfaces := []common.NetworkInterface{}
+	err := json.Unmarshal([]byte(m.NetworkInterfaces), &interfaces)
+	if err != nil {
+		log.Warn().Err(err).Uint("nodeId", m.Id).Msg("Invalid network interfaces stored for node")
+	}
+
+	return &nodeNetworkResponse{
+		Hostname:       m.Hostname,
+		PrimaryIp:      m.PrimaryIp,
+		DefaultGateway: m.DefaultGateway,
+		ZeroTierIps:    splitCommaList(m.ZeroTierIps),
+		TailscaleIps:   splitCommaList(m.TailscaleIps),
+		Interfaces:     interfaces,
+	}
+}
+
+func splitCommaList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+type nodeHead struct {
+	ContainerBaseUrl    *string    `json:"containerBaseUrl"`
+	EnrollmentExpiresAt *time.Time `json:"enrollmentExpiresAt"` // Set while an enrollment token is unused
+	TaskTypes           []string   `json:"taskTypes"`
+	Name                string     `json:"name"`
+	AgentVersion        string     `json:"agentVersion"`
+	Environment         string     `json:"environment"`
+	LastError           string     `json:"lastError"`
+	Id                  uint       `json:"id"`
+	ReconnectCount      uint       `json:"reconnectCount"`
+	ProtocolVersion     uint       `json:"protocolVersion"`
+	Online              bool       `json:"online"`
+	Registered          bool       `json:"registered"`
+	ClientCert          bool       `json:"clientCert"` // Agent enrolled for a client certificate
+	Outdated            bool       `json:"outdated"`   // Agent is older than the server
+}
+
+func newNodeHead(m *model.Node, online bool) nodeHead {
 	environment := ""
 	if m.Environment != nil {
 		environment = m.Environment.Name
 	}
+
+	taskTypes := splitCommaList(m.TaskTypes)
+
 	return nodeHead{
-		Id:               m.Id,
-		Name:             m.Name,
-		AgentVersion:     m.AgentVersion,
-		Environment:      environment,
-		Online:           online,
-		Registered:       m.LastPing != nil,
-		ContainerBaseUrl: m.ContainerBaseUrl,
+		Id:                  m.Id,
+		Name:                m.Name,
+		AgentVersion:        m.AgentVersion,
+		Environment:         environment,
+		LastError:           m.LastError,
+		ReconnectCount:      m.ReconnectCount,
+		ProtocolVersion:     m.ProtocolVersion,
+		TaskTypes:           taskTypes,
+		Online:              online,
+		Registered:          m.LastPing != nil,
+		ClientCert:          m.CertificateFingerprint != "",
+		Outdated:            isAgentOutdated(m),
+		ContainerBaseUrl:    m.ContainerBaseUrl,
+		EnrollmentExpiresAt: m.EnrollmentExpiresAt,
 	}
 }
 
-func newNodeHeadList(rows []model.Node) []nodeHead {
+// isAgentOutdated reports whether the agent of the node runs an older version than the
+// server. The server node has no agent.
+func isAgentOutdated(m *model.Node) bool {
+	if m.Id == 1 || m.AgentVersion == "" {
+		return false
+	}
+
+	return common.CompareVersions(common.AgentVersionNumber(m.AgentVersion), common.Version) < 0
+}
+
+func newNodeHeadList(rows []model.Node, isOnline func(nodeId uint) bool) []nodeHead {
 	headRows := make([]nodeHead, len(rows))
 	for i, r := range rows {
-		headRows[i] = newNodeHead(&r)
+		headRows[i] = newNodeHead(&r, isOnline(r.Id))
 	}
 	return headRows
 }
 
+type outdatedNodeListResponse struct {
+	Items         []nodeHead `json:"items"`
+	ServerVersion string     `json:"serverVersion"`
+}
+
 type agentRegistrationTokenResponse struct {
-	Token string `json:"token"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	Token         string    `json:"token"`
+	CAFingerprint string    `json:"caFingerprint"` // Value for the CA_FINGERPRINT variable of the agent
 }
 
-func newAgentRegistrationTokenResponse(token string) *agentRegistrationTokenResponse {
+func newAgentRegistrationTokenResponse(token string, expiresAt time.Time, caFingerprint string) *agentRegistrationTokenResponse {
 	return &agentRegistrationTokenResponse{
-		Token: token,
+		ExpiresAt:     expiresAt,
+		Token:         token,
+		CAFingerprint: caFingerprint,
+	}
+}
+
+type nodePresenceListResponse struct {
+	Items []presence.Node `json:"items"`
+}
+
+type taskLaneResponse struct {
+	Name      string `json:"name"`
+	Workers   int    `json:"workers"`
+	Running   int    `json:"running"`
+	Queued    int    `json:"queued"`
+	QueueSize int    `json:"queueSize"`
+}
+
+type nodeTaskQueueResponse struct {
+	ReportedAt *time.Time         `json:"reportedAt"`
+	Lanes      []taskLaneResponse `json:"lanes"` // Empty for agents which don't report their load
+	Online     bool               `json:"online"`
+}
+
+func newNodeTaskQueueResponse(online bool, m *messages.AgentStatusMessage, reportedAt time.Time) *nodeTaskQueueResponse {
+	r := &nodeTaskQueueResponse{Online: online, Lanes: []taskLaneResponse{}}
+	if m == nil {
+		return r
+	}
+
+	r.ReportedAt = &reportedAt
+	for _, l := range m.Lanes {
+		r.Lanes = append(r.Lanes, taskLaneResponse{
+			Name:      l.Name,
+			Workers:   l.Workers,
+			Running:   l.Running,
+			Queued:    l.Queued,
+			QueueSize: l.QueueSize,
+		})
 	}
+	return r
 }
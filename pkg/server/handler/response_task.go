@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+)
+
+type taskHead struct {
+	CreatedAt    time.Time  `json:"createdAt"`
+	DispatchedAt *time.Time `json:"dispatchedAt"`
+	CompletedAt  *time.Time `json:"completedAt"`
+	Result       *string    `json:"result"`
+	Id           string     `json:"id"`
+	Type         string     `json:"type"`
+	Status       string     `json:"status"`
+	UserName     string     `json:"userName"`
+	DurationMs   int64      `json:"durationMs"`
+	NodeId       uint       `json:"nodeId"`
+	Attempts     uint       `json:"attempts"`
+	Interactive  bool       `json:"interactive"`
+}
+
+func newTaskHead(m *model.Task) taskHead {
+	return taskHead{
+		Id:           m.Id,
+		NodeId:       m.NodeId,
+		Type:         m.Type,
+		Status:       m.Status,
+		UserName:     m.UserName,
+		Result:       m.Result,
+		DurationMs:   m.DurationMs,
+		Attempts:     m.Attempts,
+		Interactive:  m.Interactive,
+		CreatedAt:    m.CreatedAt,
+		DispatchedAt: m.DispatchedAt,
+		CompletedAt:  m.CompletedAt,
+	}
+}
+
+func newTaskHeadList(rows []model.Task) []taskHead {
+	headRows := make([]taskHead, len(rows))
+	for i, r := range rows {
+		headRows[i] = newTaskHead(&r)
+	}
+	return headRows
+}
@@ -36,9 +36,11 @@ func (h *Handler) GetSwarmClusterNodesList(c echo.Context) error {
 
 	var response *dockerapi.ClusterSwarmNodeListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		response, err = dockerapi.GetSwarmClusterNodesList(&req)
+		done(err)
 	} else {
-		response, err = messages.ProcessTaskWithResponse[dockerapi.ClusterSwarmNodeList, dockerapi.ClusterSwarmNodeListResponse](uint(nodeId), req, defaultTimeout)
+		response, err = messages.ProcessTaskWithResponse[dockerapi.ClusterSwarmNodeList, dockerapi.ClusterSwarmNodeListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -67,9 +69,11 @@ func (h *Handler) GetSwarmNodeByID(c echo.Context) error {
 	var response *dockerapi.SwarmNodeInfoDetailsResponse
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		response, err = dockerapi.GetSwarmNodeByID(&m)
+		done(err)
 	} else {
-		response, err = messages.ProcessTaskWithResponse[dockerapi.SwarmNodeInfoId, dockerapi.SwarmNodeInfoDetailsResponse](uint(nodeId), m, defaultTimeout)
+		response, err = messages.ProcessTaskWithResponse[dockerapi.SwarmNodeInfoId, dockerapi.SwarmNodeInfoDetailsResponse](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 	if err != nil {
 		return unprocessableEntity(c, err)
@@ -97,9 +101,11 @@ func (h *Handler) RemoveSwarmClusterNode(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.SwarmClusterNodeRemove(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask(uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask(taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 	return err
 }
@@ -131,9 +137,11 @@ func (h *Handler) UpdateSwarmClusterNode(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, swarmUpdateRequest)
 		err = dockerapi.SwarmClusterUpdateNode(&swarmUpdateRequest)
+		done(err)
 	} else {
-		err = messages.ProcessTask(uint(nodeId), swarmUpdateRequest, defaultTimeout)
+		err = messages.ProcessTask(taskContext(c), h.taskBroker, uint(nodeId), swarmUpdateRequest, defaultTimeout)
 	}
 	if err != nil {
 		return err
@@ -170,9 +178,11 @@ func (h *Handler) PromoteOrDemoteSwarmClusterNode(c echo.Context) error {
 		Action: request.Action,
 	}
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, updateRequest)
 		err = dockerapi.SwarmClusterPromoteOrDemoteNode(&updateRequest)
+		done(err)
 	} else {
-		err = messages.ProcessTask(uint(nodeId), updateRequest, defaultTimeout)
+		err = messages.ProcessTask(taskContext(c), h.taskBroker, uint(nodeId), updateRequest, defaultTimeout)
 	}
 	if err != nil {
 		return err
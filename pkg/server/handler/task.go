@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (h *Handler) GetTaskList(c echo.Context) error {
+	p, err := strconv.Atoi(c.QueryParam("p"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("p"))
+	}
+
+	if p < 1 {
+		return unprocessableEntity(c, queryGte1ExpectedError("p"))
+	}
+
+	s, err := strconv.Atoi(c.QueryParam("s"))
+	if err != nil {
+		return unprocessableEntity(c, routeIntExpectedError("s"))
+	}
+
+	if s < 1 {
+		return unprocessableEntity(c, queryGte1ExpectedError("s"))
+	}
+
+	filter := store.TaskFilter{
+		Type:   c.QueryParam("type"),
+		Status: c.QueryParam("status"),
+	}
+	if value := c.QueryParam("nodeId"); value != "" {
+		nodeId, err := strconv.Atoi(value)
+		if err != nil {
+			return unprocessableEntity(c, routeIntExpectedError("nodeId"))
+		}
+		id := uint(nodeId)
+		filter.NodeId = &id
+	}
+	if value := c.QueryParam("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return unprocessableEntity(c, queryTimeExpectedError("from"))
+		}
+		filter.From = &from
+	}
+	if value := c.QueryParam("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return unprocessableEntity(c, queryTimeExpectedError("to"))
+		}
+		filter.To = &to
+	}
+	if filter.From != nil && filter.To != nil && !filter.From.Before(*filter.To) {
+		return unprocessableEntity(c, errors.New("Parameter `from` should be before `to`."))
+	}
+
+	rows, totalRows, err := h.taskStore.GetList(filter, uint(p), uint(s))
+	if err != nil {
+		panic(err)
+	}
+
+	return ok(c, newPageResponse[taskHead](newTaskHeadList(rows), uint(p), uint(s), uint(totalRows)))
+}
+
+func (h *Handler) GetTaskById(c echo.Context) error {
+	m, err := h.taskStore.GetById(c.Param("id"))
+	if err != nil {
+		panic(err)
+	}
+
+	if m == nil {
+		return resourceNotFound(c, "Task")
+	}
+
+	return ok(c, newTaskHead(m))
+}
+
+func (h *Handler) CancelTask(c echo.Context) error {
+	err := h.taskBroker.Cancel(c.Param("id"))
+	if err != nil {
+		if err == messages.ErrTaskNotFound {
+			return resourceNotFound(c, "Task")
+		}
+		return unprocessableEntity(c, err)
+	}
+
+	return noContent(c)
+}
+
+// taskContext returns the context for tasks run on behalf of the request. It carries the
+// logged in user so that tasks are attributed to them in the task history.
+func taskContext(c echo.Context) context.Context {
+	userName, _ := c.Get("userName").(string)
+	return messages.WithUserName(c.Request().Context(), userName)
+}
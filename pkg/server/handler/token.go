@@ -1,5 +1,68 @@
 package handler
 
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
+)
+
+const (
+	// Enrollment tokens are shown to the user when registering a node. They expire and can
+	// only be exchanged once, for a credential.
+	tokenKindEnrollment = "enrollment"
+	// Credentials are kept by the agent and used on every connection until rotated or revoked.
+	tokenKindCredential = "credential"
+
+	defaultEnrollmentTokenTtl = 24 * time.Hour
+)
+
+var errTokenExpired = errors.New("Token expired")
+
 type Token struct {
-	NodeId uint
+	ExpiresAt *time.Time `json:",omitempty"`
+	Kind      string     `json:",omitempty"` // Empty for tokens issued before enrollment. They are credentials.
+	NodeId    uint
+}
+
+func (t *Token) isEnrollment() bool {
+	return t.Kind == tokenKindEnrollment
+}
+
+func (t *Token) isExpired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+func newEnrollmentToken(nodeId uint, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl).UTC()
+	encryptedToken, err := encryptToken(Token{NodeId: nodeId, Kind: tokenKindEnrollment, ExpiresAt: &expiresAt})
+	return encryptedToken, expiresAt, err
+}
+
+func newCredential(nodeId uint) (string, error) {
+	return encryptToken(Token{NodeId: nodeId, Kind: tokenKindCredential})
+}
+
+func encryptToken(t Token) (string, error) {
+	tokenBytes, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	return ske.Encrypt(string(tokenBytes))
+}
+
+func decryptToken(encryptedToken string) (*Token, error) {
+	tokenJson, err := ske.Decrypt(encryptedToken)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var t Token
+	if err := json.Unmarshal([]byte(tokenJson), &t); err != nil {
+		return nil, errInvalidToken
+	}
+
+	return &t, nil
 }
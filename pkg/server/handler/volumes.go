@@ -23,10 +23,12 @@ func (h *Handler) CreateVolume(c echo.Context) error {
 
 	var res *dockerapi.DockerVolumeCreateResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		res, err = dockerapi.VolumeCreate(&m)
+		done(err)
 	} else {
 		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerVolumeCreate, dockerapi.DockerVolumeCreateResponse](
-			uint(nodeId), m, defaultTimeout)
+			taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -48,9 +50,11 @@ func (h *Handler) GetVolumeList(c echo.Context) error {
 
 	var res *dockerapi.DockerVolumeListResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, req)
 		res, err = dockerapi.VolumeList(&req)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerVolumeList, dockerapi.DockerVolumeListResponse](uint(nodeId), req, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerVolumeList, dockerapi.DockerVolumeListResponse](taskContext(c), h.taskBroker, uint(nodeId), req, defaultTimeout)
 	}
 
 	if err != nil {
@@ -75,9 +79,11 @@ func (h *Handler) RemoveVolume(c echo.Context) error {
 	}
 
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		err = dockerapi.VolumeRemove(&m)
+		done(err)
 	} else {
-		err = messages.ProcessTask[dockerapi.DockerVolumeRemove](uint(nodeId), m, defaultTimeout)
+		err = messages.ProcessTask[dockerapi.DockerVolumeRemove](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
@@ -103,9 +109,11 @@ func (h *Handler) PruneVolumes(c echo.Context) error {
 
 	var res *dockerapi.DockerVolumesPruneResponse
 	if nodeId == 1 {
+		done := messages.RecordLocalTask(taskContext(c), h.taskBroker, 1, m)
 		res, err = dockerapi.VolumesPrune(&m)
+		done(err)
 	} else {
-		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerVolumesPrune, dockerapi.DockerVolumesPruneResponse](uint(nodeId), m, defaultTimeout)
+		res, err = messages.ProcessTaskWithResponse[dockerapi.DockerVolumesPrune, dockerapi.DockerVolumesPruneResponse](taskContext(c), h.taskBroker, uint(nodeId), m, defaultTimeout)
 	}
 
 	if err != nil {
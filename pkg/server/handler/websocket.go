@@ -1,15 +1,13 @@
 package handler
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"errors"
-	"io"
-	"strings"
-	"time"
 
+	"github.com/dokemon-ng/dokemon/pkg/common"
 	"github.com/dokemon-ng/dokemon/pkg/crypto"
-	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
 	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -23,13 +21,16 @@ func (h *Handler) HandleWebSocket(c echo.Context) error {
 	}
 	defer ws.Close()
 
-	messageType, messageString := messages.ReceiveRaw(ws)
+	messageType, messageString, err := messages.ReceiveRaw(ws)
+	if err != nil {
+		return err
+	}
 
 	switch messageType {
 	case "ConnectMessage":
-		handleConnect(h, ws, messageString)
+		handleConnect(h, ws, c.Request().TLS, messageString)
 	case "TaskSessionMessage":
-		handleTaskSession(h, ws, messageString)
+		handleTaskSession(h, ws, c.Request().TLS, messageString)
 	default:
 		ws.Close()
 		return errors.New("invalid message")
@@ -38,204 +39,200 @@ func (h *Handler) HandleWebSocket(c echo.Context) error {
 	return nil
 }
 
-func handleConnect(h *Handler, ws *websocket.Conn, messageString string) {
-	m, _ := messages.Parse[messages.ConnectMessage](messageString)
+func handleConnect(h *Handler, ws *websocket.Conn, tlsState *tls.ConnectionState, messageString string) {
+	m, err := messages.Parse[messages.ConnectMessage](messageString)
+	if err != nil {
+		log.Warn().Err(err).Msg("Invalid connect message received from agent")
+		return
+	}
+
+	// Everything sent to the agent, including the response to this message, must be encoded
+	// for the protocol version it speaks
+	session := messages.NewSession(ws, m.ProtocolVersion)
+	taskTypes := m.TaskTypes
+	if m.ProtocolVersion == 0 {
+		session = messages.NewLegacySession(ws)
+		taskTypes = messages.LegacyTaskTypes
+	}
 
-	token, ok := validateConnection(h, ws, m.ConnectionToken)
+	token, ok := validateConnection(h, ws, session, tlsState, m.ConnectionToken)
 	if !ok {
 		return
 	}
 
 	if m.AgentVersion != "" {
-		h.nodeStore.UpdateAgentVersion(token.NodeId, m.AgentVersion)
+		// Older agents append their architecture and addresses, which is only kept as the
+		// network info of newer agents
+		agentVersion := common.AgentVersionNumber(m.AgentVersion)
+		h.nodeStore.UpdateAgentVersion(token.NodeId, agentVersion)
+		if common.CompareVersions(agentVersion, common.Version) < 0 {
+			log.Warn().Uint("nodeId", token.NodeId).Str("agentVersion", m.AgentVersion).Str("serverVersion", common.Version).Msg("Agent is older than the server")
+		}
 	}
 
-	messages.Send[messages.ConnectResponseMessage](ws, messages.ConnectResponseMessage{Success: true})
-	if m.AgentVersion != "" {
-		log.Info().Uint("nodeId", token.NodeId).Str("agentVersion", m.AgentVersion).Msg("Agent connected")
-	} else {
-		log.Info().Uint("nodeId", token.NodeId).Msg("Agent connected")
+	if m.Network != nil {
+		err := h.nodeStore.UpdateNetworkInfo(token.NodeId, m.Network)
+		if err != nil {
+			log.Error().Err(err).Msg("Error while updating network info")
+		}
 	}
 
-	err := h.nodeStore.UpdateLastPing(token.NodeId, time.Now())
+	if m.ProtocolVersion == 0 {
+		log.Warn().Uint("nodeId", token.NodeId).Str("agentVersion", m.AgentVersion).Msg("Agent predates task multiplexing and opens a connection per task. Please update the agent")
+	}
+
+	err = h.nodeStore.UpdateCapabilities(token.NodeId, m.ProtocolVersion, taskTypes)
+	if err != nil {
+		log.Error().Err(err).Msg("Error while updating agent capabilities")
+	}
+
+	err = h.nodeStore.UpdateReconnectInfo(token.NodeId, m.ReconnectCount, m.LastError)
 	if err != nil {
-		log.Error().Err(err).Msg("Error while updating initial ping time")
+		log.Error().Err(err).Msg("Error while updating reconnect info")
 	}
 
-	connectionClosed := make(chan bool)
+	messages.Send[messages.ConnectResponseMessage](session, messages.ConnectResponseMessage{Success: true})
+	if m.AgentVersion != "" {
+		log.Info().Uint("nodeId", token.NodeId).Str("agentVersion", m.AgentVersion).Uint("protocolVersion", m.ProtocolVersion).Uint("reconnectCount", m.ReconnectCount).Msg("Agent connected")
+	} else {
+		log.Info().Uint("nodeId", token.NodeId).Uint("protocolVersion", m.ProtocolVersion).Uint("reconnectCount", m.ReconnectCount).Msg("Agent connected")
+	}
+
+	connectionId := h.presence.Connected(token.NodeId)
+
+	connectionClosed := make(chan bool, 1)
+
+	// Registered before reading so that the first status reported by the agent is kept
+	h.taskBroker.RegisterSession(token.NodeId, session, taskTypes)
 
 	go func() {
 		for {
-			_, err := messages.Receive[messages.Ping](ws)
+			_, message, err := ws.ReadMessage()
 			if err != nil {
-				log.Info().Uint("nodeId", token.NodeId).Msg("Agent disconnected")
-				err := h.nodeStore.UpdateLastPing(token.NodeId, time.Now().Add(-2*time.Minute))
-				if err != nil {
-					log.Error().Err(err).Msg("Error while updating ping time after agent disconnected")
+				log.Info().Err(err).Uint("nodeId", token.NodeId).Msg("Agent disconnected")
+				session.Shutdown(messages.ErrSessionClosed)
+				if updateErr := h.nodeStore.UpdateLastError(token.NodeId, err.Error()); updateErr != nil {
+					log.Error().Err(updateErr).Msg("Error while updating last error after agent disconnected")
 				}
+				h.presence.Disconnected(token.NodeId, connectionId, err.Error())
 				connectionClosed <- true
 				return
-			} else {
-				err := h.nodeStore.UpdateLastPing(token.NodeId, time.Now())
+			}
+
+			messageString := string(message)
+			messageType := messages.TypeOf(messageString)
+			if session.Dispatch(messageType, messageString) {
+				continue
+			}
+
+			switch messageType {
+			case "Ping":
+				h.presence.Seen(token.NodeId, connectionId)
+			case "AgentStatusMessage":
+				m, err := messages.Parse[messages.AgentStatusMessage](messageString)
 				if err != nil {
-					log.Error().Err(err).Msg("Error while updating ping time")
+					log.Warn().Err(err).Uint("nodeId", token.NodeId).Msg("Invalid agent status received")
+					continue
 				}
+				h.taskBroker.UpdateAgentStatus(token.NodeId, session, m)
+			default:
+				log.Warn().Str("messageType", messageType).Uint("nodeId", token.NodeId).Msg("Unexpected message type received from agent")
 			}
 		}
 	}()
 
-	nodeId := token.NodeId
-	if messages.TaskQueue[nodeId] == nil {
-		log.Debug().Uint("nodeId", nodeId).Msg("Building TaskQueue")
-		messages.TaskQueue[nodeId] = make(chan messages.TaskQueuedMessage)
-	}
-
-outer:
-	for {
-		select {
-		case <-connectionClosed:
-			break outer
-		case queuedTask := <-messages.TaskQueue[nodeId]:
-			log.Debug().Str("taskId", queuedTask.TaskId).Msg("Sending task")
-			err := messages.Send[messages.TaskQueuedMessage](ws, queuedTask)
-			if err != nil {
-				log.Warn().Str("taskId", queuedTask.TaskId).Msg("Error while sending task to agent")
-				return
-			}
-		}
-	}
+	<-connectionClosed
+	h.taskBroker.UnregisterSession(token.NodeId, session)
 }
 
-func handleTaskSession(h *Handler, wsAgent *websocket.Conn, messageString string) {
-	defer wsAgent.Close()
-
-	tsm, _ := messages.Parse[messages.TaskSessionMessage](messageString)
-
-	_, ok := validateConnection(h, wsAgent, tsm.ConnectionToken)
-	if !ok {
+// handleTaskSession serves the websocket that an agent predating protocol version 1 opens for
+// each task it is given.
+func handleTaskSession(h *Handler, ws *websocket.Conn, tlsState *tls.ConnectionState, messageString string) {
+	m, err := messages.Parse[messages.TaskSessionMessage](messageString)
+	if err != nil {
+		log.Warn().Err(err).Msg("Invalid task session message received from agent")
 		return
 	}
 
-	if !messages.TaskExists(tsm.TaskId) {
-		messages.Send[messages.TaskSessionResponseMessage](wsAgent, messages.TaskSessionResponseMessage{Success: false, Message: "Task does not exist"})
+	session := messages.NewSession(ws, 0)
+	token, ok := validateConnection(h, ws, session, tlsState, m.ConnectionToken)
+	if !ok {
 		return
 	}
 
-	messages.Send[messages.TaskSessionResponseMessage](wsAgent, messages.TaskSessionResponseMessage{Success: true})
-
-	if !tsm.Stream {
-		for {
-			messageType, messageString := messages.ReceiveRaw(wsAgent)
-
-			switch messageType {
-			case "TaskLogMessage":
-				m, _ := messages.Parse[messages.TaskLogMessage](messageString)
-				log.Info().Str("level", m.Level).Str("message", m.Text).Msg("Agent Log")
-			case "TaskStatusMessage":
-				m, _ := messages.Parse[messages.TaskStatusMessage](messageString)
-				if strings.HasPrefix(m.Status, "Completed") {
-					messages.TaskResponses[tsm.TaskId] <- messageString
-					return
-				}
-			default:
-				log.Error().Str("messageType", messageType).Msg("Unexpected message type received from agent in Task Session")
-				return
-			}
-		}
-	} else {
-		wsBrowser := messages.TaskSockets[tsm.TaskId]
-
-		var taskStatusMessage messages.TaskStatusMessage
-
-		browseClosedSession := false
-		go func() {
-			// Read from browser and send to agent
-			for {
-				mt, dat, err := wsBrowser.ReadMessage()
-				if err != nil {
-					if err == io.EOF {
-						message := "EOF"
-						taskStatusMessage = messages.TaskStatusMessage{Status: "CompletedWithSuccess", Result: &message}
-						browseClosedSession = true
-						wsAgent.Close()
-						break
-					}
-					log.Debug().Err(err).Msg("Error while reading streaming message from browser")
-					message := err.Error()
-					taskStatusMessage = messages.TaskStatusMessage{Status: "CompletedWithFailure", Result: &message}
-					browseClosedSession = true
-					wsAgent.Close()
-					break
-				}
+	if !h.taskBroker.ServeLegacyTask(token.NodeId, m.TaskId, ws) {
+		messages.Send[messages.TaskSessionResponseMessage](session, messages.TaskSessionResponseMessage{Success: false, Message: "Task does not exist"})
+	}
+}
 
-				err = wsAgent.WriteMessage(mt, dat)
-				if err != nil {
-					log.Debug().Err(err).Msg("Error while sending streaming message to agent")
-					message := err.Error()
-					taskStatusMessage = messages.TaskStatusMessage{Status: "CompletedWithFailure", Result: &message}
-					wsAgent.Close()
-					break
-				}
-			}
-		}()
+var (
+	errInvalidToken    = errors.New("Invalid token")
+	errEnrollmentToken = errors.New("Enrollment tokens are not supported by this agent. Please update the agent")
+)
 
-		// Read from agent and send to browser
-	outer:
-		for {
-			mt, dat, err := wsAgent.ReadMessage()
-			if err != nil {
-				if browseClosedSession {
-					log.Debug().Err(err).Msg("Browser closed connection")
-				}
-				if err == io.EOF {
-					message := "EOF"
-					taskStatusMessage = messages.TaskStatusMessage{Status: "CompletedWithSuccess", Result: &message}
-					break outer
-				}
+// authenticateAgent resolves the node an agent credential belongs to. Credentials which can't
+// be decrypted or were replaced are rejected with errInvalidToken. A pending credential is
+// accepted too, and confirmed, in case the agent stored it but the rotation was not completed.
+func (h *Handler) authenticateAgent(encryptedConnectionToken string) (*Token, *model.Node, error) {
+	connectionToken, err := decryptToken(encryptedConnectionToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if connectionToken.isEnrollment() {
+		return nil, nil, errEnrollmentToken
+	}
+	if connectionToken.isExpired() {
+		return nil, nil, errTokenExpired
+	}
 
-				log.Debug().Err(err).Msg("Error while reading streaming message from agent")
-				message := err.Error()
-				taskStatusMessage = messages.TaskStatusMessage{Status: "CompletedWithFailure", Result: &message}
-				break outer
-			}
+	t, err := h.nodeStore.GetById(connectionToken.NodeId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t == nil {
+		return nil, nil, errInvalidToken
+	}
 
-			err = wsBrowser.WriteMessage(mt, dat)
-			if err != nil {
-				log.Debug().Err(err).Msg("Error while sending streaming message to browser")
-				message := err.Error()
-				taskStatusMessage = messages.TaskStatusMessage{Status: "CompletedWithFailure", Result: &message}
-				break outer
-			}
+	hash := crypto.HashString(encryptedConnectionToken)
+	switch {
+	case t.TokenHash != nil && hash == *t.TokenHash:
+	case t.PendingTokenHash != nil && hash == *t.PendingTokenHash:
+		err := h.nodeStore.PromotePendingTokenHash(t.Id, hash)
+		if err != nil {
+			return nil, nil, err
 		}
-
-		messages.TaskResponses[tsm.TaskId] <- string(messages.Serialize[messages.TaskStatusMessage](taskStatusMessage))
+	default:
+		return nil, nil, errInvalidToken
 	}
+
+	return connectionToken, t, nil
 }
 
-func validateConnection(h *Handler, ws *websocket.Conn, encryptedConnectionToken string) (*Token, bool) {
-	connectionTokenJson, err := ske.Decrypt(encryptedConnectionToken)
+func validateConnection(h *Handler, ws *websocket.Conn, session *messages.Session, tlsState *tls.ConnectionState, encryptedConnectionToken string) (*Token, bool) {
+	connectionToken, node, err := h.authenticateAgent(encryptedConnectionToken)
 	if err != nil {
+		message := err.Error()
+		if !isTokenError(err) {
+			log.Error().Err(err).Msg("Error while retrieving Node")
+			message = "Internal server error"
+		}
+		messages.Send[messages.ConnectResponseMessage](session, messages.ConnectResponseMessage{Success: false, Message: message})
 		ws.Close()
 		return nil, false
 	}
 
-	var connectionToken Token
-	json.Unmarshal([]byte(connectionTokenJson), &connectionToken)
-
-	t, err := h.nodeStore.GetById(connectionToken.NodeId)
+	err = verifyClientCertificate(tlsState, connectionToken.NodeId, node.CertificateFingerprint)
 	if err != nil {
-		log.Error().Err(err).Msg("Error while retrieving Node")
-		messages.Send[messages.ConnectResponseMessage](ws, messages.ConnectResponseMessage{Success: false, Message: "Internal server error"})
+		log.Warn().Err(err).Uint("nodeId", connectionToken.NodeId).Msg("Rejected agent with invalid client certificate")
+		messages.Send[messages.ConnectResponseMessage](session, messages.ConnectResponseMessage{Success: false, Message: err.Error()})
+		h.nodeStore.UpdateLastError(connectionToken.NodeId, err.Error())
 		ws.Close()
 		return nil, false
 	}
 
-	hash := crypto.HashString(encryptedConnectionToken)
-	if hash != *t.TokenHash {
-		messages.Send[messages.ConnectResponseMessage](ws, messages.ConnectResponseMessage{Success: false, Message: "Invalid token"})
-		ws.Close()
-		return nil, false
-	}
+	return connectionToken, true
+}
 
-	return &connectionToken, true
+func isTokenError(err error) bool {
+	return errors.Is(err, errInvalidToken) || errors.Is(err, errEnrollmentToken) || errors.Is(err, errTokenExpired)
 }
@@ -3,13 +3,32 @@
 import "time"
 
 type Node struct {
-	EnvironmentId    *uint
-	Environment      *Environment
-	TokenHash        *string `gorm:"unique;size:100"`
-	LastPing         *time.Time
-	ContainerBaseUrl *string `gorm:"size:255"`
-	Name             string  `gorm:"unique;size:50"`
-	AgentVersion     string  `gorm:"size:20"`
-	Architecture     string  `json:"architecture" gorm:"-"`
-	Id               uint
+	EnvironmentId       *uint
+	Environment         *Environment
+	TokenHash           *string `gorm:"unique;size:100"` // Credential of the agent
+	PendingTokenHash    *string `gorm:"unique;size:100"` // Credential sent to the agent during rotation. Valid until the agent confirms it.
+	EnrollmentTokenHash *string `gorm:"unique;size:100"` // Unused enrollment token
+	EnrollmentExpiresAt *time.Time
+	LastPing            *time.Time
+	ContainerBaseUrl    *string `gorm:"size:255"`
+	Name                string  `gorm:"unique;size:50"`
+	AgentVersion        string  `gorm:"size:20"`
+	ReconnectCount      uint
+	LastError           string `gorm:"size:255"`
+	TaskTypes           string // Comma separated task types advertised by the agent
+	ProtocolVersion     uint
+	Architecture        string `json:"architecture" gorm:"-"`
+	Id                  uint
+
+	// Network of the host as reported by the agent when it connects
+	Hostname          string `gorm:"size:255"`
+	PrimaryIp         string `gorm:"size:45"`
+	DefaultGateway    string `gorm:"size:45"`
+	ZeroTierIps       string // Comma separated
+	TailscaleIps      string // Comma separated
+	NetworkInterfaces string // JSON encoded []common.NetworkInterface
+
+	// SHA-256 fingerprint of the client certificate issued to the agent. Once set, the agent
+	// must present that certificate when connecting.
+	CertificateFingerprint string `gorm:"size:64"`
 }
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+)
+
+// The statuses are recorded by the task broker
+const (
+	TaskStatusQueued               = messages.TaskStatusQueued
+	TaskStatusDispatched           = messages.TaskStatusDispatched
+	TaskStatusCompletedWithSuccess = messages.TaskStatusCompletedWithSuccess
+	TaskStatusCompletedWithFailure = messages.TaskStatusCompletedWithFailure
+	TaskStatusExpired              = messages.TaskStatusExpired
+	TaskStatusCancelled            = messages.TaskStatusCancelled
+)
+
+type Task struct {
+	ExpiresAt    *time.Time
+	DispatchedAt *time.Time `gorm:"index"`
+	CompletedAt  *time.Time
+	Result       *string
+	CreatedAt    time.Time `gorm:"index;index:idx_tasks_node_id_created_at,priority:2"`
+	UpdatedAt    time.Time
+	Id           string `gorm:"primaryKey;size:36"`
+	Type         string `gorm:"size:100"`
+	Status       string `gorm:"size:30;index"`
+	Payload      string // Encrypted task definition. Empty for interactive tasks as they are never re-dispatched.
+	UserName     string `gorm:"size:255"` // User who triggered the task
+	DurationMs   int64  // Time between the last dispatch and completion
+	TimeoutMs    int64  // Time allowed for one attempt of a queued task
+	NodeId       uint   `gorm:"index;index:idx_tasks_node_id_created_at,priority:1"`
+	Attempts     uint
+	MaxAttempts  uint
+	Interactive  bool
+}
@@ -0,0 +1,232 @@
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/server/store"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Last pings are written to the database at most this often
+const DefaultFlushPeriod = 30 * time.Second
+
+// Events are dropped for subscribers which fall this far behind. Their feed is closed so that
+// they can resubscribe and start over from a fresh snapshot.
+const subscriberBuffer = 64
+
+// Event is an online or offline transition of a node.
+type Event struct {
+	NodeId uint      `json:"nodeId"`
+	Online bool      `json:"online"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"` // Why the node went offline
+}
+
+// Node is the presence of a connected node.
+type Node struct {
+	NodeId      uint      `json:"nodeId"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+type connection struct {
+	id uint64
+	Node
+}
+
+// Registry keeps track of which agents are connected, as told by their connections. Handlers
+// ask it whether a node is online instead of inferring it from the last ping in the database,
+// which is only written periodically.
+type Registry struct {
+	nodeStore   store.NodeStore
+	flushPeriod time.Duration
+	done        chan struct{}
+	stopped     chan struct{}
+
+	mu          sync.Mutex
+	lastId      uint64
+	connections map[uint]*connection // NodeId is the map key
+	pending     map[uint]time.Time   // Last pings not yet written to the database
+	subscribers map[chan Event]struct{}
+}
+
+func NewRegistry(nodeStore store.NodeStore, flushPeriod time.Duration) *Registry {
+	return &Registry{
+		nodeStore:   nodeStore,
+		flushPeriod: flushPeriod,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		connections: make(map[uint]*connection),
+		pending:     make(map[uint]time.Time),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Start writes the last pings to the database periodically until the registry is closed.
+func (r *Registry) Start() {
+	go func() {
+		defer close(r.stopped)
+
+		ticker := time.NewTicker(r.flushPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.done:
+				r.Flush()
+				return
+			case <-ticker.C:
+				r.Flush()
+			}
+		}
+	}()
+}
+
+// Close stops the periodic writes after writing the pending last pings. Subscribers' feeds
+// are closed.
+func (r *Registry) Close() {
+	close(r.done)
+	<-r.stopped
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for ch := range r.subscribers {
+		close(ch)
+		delete(r.subscribers, ch)
+	}
+}
+
+// Connected records a new connection of the agent of the node. It replaces any previous
+// connection of the node. The returned id must be passed to Disconnected.
+func (r *Registry) Connected(nodeId uint) uint64 {
+	now := time.Now()
+
+	r.mu.Lock()
+	r.lastId++
+	id := r.lastId
+	_, wasOnline := r.connections[nodeId]
+	r.connections[nodeId] = &connection{id: id, Node: Node{NodeId: nodeId, ConnectedAt: now, LastSeen: now}}
+	delete(r.pending, nodeId)
+	if !wasOnline {
+		r.publish(Event{NodeId: nodeId, Online: true, At: now})
+	}
+	r.mu.Unlock()
+
+	// Written right away as the first ping marks the node as registered
+	err := r.nodeStore.UpdateLastPing(nodeId, now)
+	if err != nil {
+		log.Error().Err(err).Uint("nodeId", nodeId).Msg("Error while updating initial ping time")
+	}
+
+	return id
+}
+
+// Seen records that the agent of the node is still there, typically when it pings.
+func (r *Registry) Seen(nodeId uint, connectionId uint64) {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.connections[nodeId]
+	if !ok || c.id != connectionId {
+		return
+	}
+	c.LastSeen = now
+	r.pending[nodeId] = now
+}
+
+// Disconnected records that a connection of the agent of the node was lost. A newer connection
+// of the same node is left alone.
+func (r *Registry) Disconnected(nodeId uint, connectionId uint64, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.connections[nodeId]
+	if !ok || c.id != connectionId {
+		return
+	}
+	delete(r.connections, nodeId)
+	r.pending[nodeId] = c.LastSeen
+	r.publish(Event{NodeId: nodeId, Online: false, At: time.Now(), Reason: reason})
+}
+
+// IsOnline reports whether the agent of the node is connected.
+func (r *Registry) IsOnline(nodeId uint) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.connections[nodeId]
+	return ok
+}
+
+// List returns the connected nodes.
+func (r *Registry) List() []Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list()
+}
+
+func (r *Registry) list() []Node {
+	nodes := make([]Node, 0, len(r.connections))
+	for _, c := range r.connections {
+		nodes = append(nodes, c.Node)
+	}
+	return nodes
+}
+
+// Subscribe returns the connected nodes along with a feed of the transitions that follow.
+// The feed is closed if the subscriber falls behind or the registry is closed. The returned
+// function must be called once the feed is no longer read.
+func (r *Registry) Subscribe() ([]Node, <-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if _, ok := r.subscribers[ch]; ok {
+			delete(r.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return r.list(), ch, unsubscribe
+}
+
+// publish must be called with the mutex held.
+func (r *Registry) publish(e Event) {
+	for ch := range r.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(r.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Flush writes the pending last pings to the database in one go.
+func (r *Registry) Flush() {
+	r.mu.Lock()
+	pings := r.pending
+	r.pending = make(map[uint]time.Time)
+	r.mu.Unlock()
+
+	if len(pings) == 0 {
+		return
+	}
+
+	err := r.nodeStore.UpdateLastPings(pings)
+	if err != nil {
+		log.Error().Err(err).Int("count", len(pings)).Msg("Error while updating ping times")
+	}
+}
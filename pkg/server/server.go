@@ -1,23 +1,28 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dokemon-ng/dokemon/pkg/common"
 	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
 	"github.com/dokemon-ng/dokemon/pkg/crypto/ssl"
 	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/dokemon-ng/dokemon/pkg/server/handler"
 	"github.com/dokemon-ng/dokemon/pkg/server/model"
+	"github.com/dokemon-ng/dokemon/pkg/server/presence"
 	"github.com/dokemon-ng/dokemon/pkg/server/requestutil"
 	"github.com/dokemon-ng/dokemon/pkg/server/router"
 	"github.com/dokemon-ng/dokemon/pkg/server/store"
@@ -33,12 +38,19 @@
 )
 
 type Server struct {
-	Echo       *echo.Echo
-	handler    *handler.Handler
-	dataPath   string
-	sslEnabled bool
+	Echo            *echo.Echo
+	handler         *handler.Handler
+	taskBroker      *messages.TaskBroker
+	presence        *presence.Registry
+	ca              *ssl.CertificateAuthority
+	db              *gorm.DB
+	dataPath        string
+	sslEnabled      bool
+	shutdownTimeout time.Duration // Time allowed for running tasks to end on shutdown
 }
 
+const defaultShutdownTimeout = time.Minute
+
 func getArchitecture() string {
 	switch runtime.GOARCH {
 	case "amd64":
@@ -52,220 +64,7 @@ func getArchitecture() string {
 	}
 }
 
-func logAllNetworkInterfaces() {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get network interfaces")
-		return
-	}
-
-	for _, iface := range interfaces {
-		logData := log.Info().
-			Str("interface", iface.Name).
-			Str("flags", iface.Flags.String()).
-			Str("hardware", iface.HardwareAddr.String())
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			logData.Msg("Interface (failed to get addresses)")
-			continue
-		}
-
-		var ips []string
-		for _, addr := range addrs {
-			ipnet, ok := addr.(*net.IPNet)
-			if ok {
-				ips = append(ips, ipnet.IP.String())
-			}
-		}
-		logData.Strs("ips", ips).Msg("Network interface details")
-	}
-}
-
-func getMainIP() string {
-	log.Debug().Msg("Starting IP detection")
-
-	// Log all interfaces first
-	logAllNetworkInterfaces()
-
-	// Get all relevant IPs
-	localIP := getLocalNetworkIP()
-	log.Debug().Str("localIP", localIP).Msg("Got local IP from getLocalNetworkIP()")
-
-	// Get all network interfaces
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get network interfaces")
-		return ""
-	}
-
-	// Collect all ZeroTier and Tailscale IPs
-	var ztIPs, tsIPs []string
-
-	for _, iface := range interfaces {
-		ifaceName := iface.Name
-
-		if strings.HasPrefix(ifaceName, "zt") {
-			if ip := getInterfaceIP(ifaceName); ip != "" {
-				log.Debug().Str("interface", ifaceName).Str("ip", ip).Msg("Found ZeroTier IP")
-				ztIPs = append(ztIPs, "zt:"+ip)
-			}
-		}
-
-		if strings.HasPrefix(ifaceName, "tailscale") {
-			if ip := getInterfaceIP(ifaceName); ip != "" {
-				log.Debug().Str("interface", ifaceName).Str("ip", ip).Msg("Found Tailscale IP")
-				tsIPs = append(tsIPs, "ts:"+ip)
-			}
-		}
-	}
-
-	// Build the version string components
-	var components []string
-	if localIP != "" {
-		components = append(components, localIP)
-	}
-	components = append(components, ztIPs...)
-	components = append(components, tsIPs...)
-
-	result := strings.Join(components, "+")
-	log.Debug().Strs("components", components).Str("result", result).Msg("Final IP components")
-
-	return result
-}
-
-func getLocalNetworkIP() string {
-	// Try Docker bridge method first
-	if ip := getHostIPViaDockerBridge(); ip != "" {
-		return ip
-	}
-
-	// Try default route method
-	if ip := getIPFromDefaultRoute(); ip != "" {
-		return ip
-	}
-
-	// Try Docker bridge IP method
-	if ip := getIPFromDockerBridge(); ip != "" {
-		return ip
-	}
-
-	return ""
-}
-
-func getInterfaceIP(ifaceName string) string {
-	iface, err := net.InterfaceByName(ifaceName)
-	if err != nil {
-		return ""
-	}
-
-	addrs, err := iface.Addrs()
-	if err != nil {
-		return ""
-	}
-
-	for _, addr := range addrs {
-		ipNet, ok := addr.(*net.IPNet)
-		if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() {
-			continue
-		}
-		return ipNet.IP.String()
-	}
-	return ""
-}
-
-func getHostIPViaDockerBridge() string {
-	cmd := exec.Command("sh", "-c", "ip route | awk '/default/ {print $3}'")
-	output, err := cmd.Output()
-	if err == nil {
-		gatewayIP := strings.TrimSpace(string(output))
-		if net.ParseIP(gatewayIP) != nil && !isDockerIP(gatewayIP) {
-			log.Debug().Str("source", "docker bridge gateway").Str("ip", gatewayIP).Msg("Found host IP")
-			return gatewayIP
-		}
-	}
-	return ""
-}
-
-func getIPFromDefaultRoute() string {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return ""
-	}
-
-	for _, iface := range ifaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, addr := range addrs {
-			ipNet, ok := addr.(*net.IPNet)
-			if !ok || ipNet.IP.To4() == nil {
-				continue
-			}
-			ip := ipNet.IP.String()
-			if !isDockerIP(ip) {
-				log.Debug().Str("source", "host interface "+iface.Name).Str("ip", ip).Msg("Found host IP")
-				return ip
-			}
-		}
-	}
-	return ""
-}
-
-func getIPFromDockerBridge() string {
-	cmd := exec.Command("sh", "-c", "ip -4 addr show docker0 | grep -oP '(?<=inet\\s)\\d+(\\.\\d+){3}'")
-	output, err := cmd.Output()
-	if err == nil {
-		ip := strings.TrimSpace(string(output))
-		if net.ParseIP(ip) != nil {
-			parts := strings.Split(ip, ".")
-			if len(parts) == 4 {
-				parts[3] = fmt.Sprintf("%d", atoi(parts[3])+1)
-				hostIP := strings.Join(parts, ".")
-				log.Debug().Str("source", "docker0 bridge").Str("ip", hostIP).Msg("Derived host IP")
-				return hostIP
-			}
-		}
-	}
-	return ""
-}
-
-func atoi(s string) int {
-	i := 0
-	for _, c := range s {
-		i = i*10 + int(c-'0')
-	}
-	return i
-}
-
-func isDockerIP(ip string) bool {
-	excludedPrefixes := []string{
-		"172.17.", "172.18.", "172.19.", "172.20.",
-		"192.168.99.", "100.", "169.254.", "127.",
-	}
-	for _, prefix := range excludedPrefixes {
-		if strings.HasPrefix(ip, prefix) {
-			return true
-		}
-	}
-	return false
-}
-
-func getFullVersion() string {
-	ip := getMainIP()
-	if ip != "" {
-		return fmt.Sprintf("%s-%s@%s", common.Version, getArchitecture(), ip)
-	}
-	return fmt.Sprintf("%s-%s", common.Version, getArchitecture())
-}
-
-func NewServer(dbConnectionString string, dataPath string, logLevel string, sslEnabled string, stalenessCheck string) *Server {
+func NewServer(dbConnectionString string, dataPath string, logLevel string, sslEnabled string, stalenessCheck string, shutdownTimeout string, taskRetention string) *Server {
 	s := Server{}
 
 	setLogLevel(logLevel)
@@ -277,8 +76,9 @@ func NewServer(dbConnectionString string, dataPath string, logLevel string, sslE
 		Str("arch", runtime.GOARCH).
 		Msg("Starting Dokémon")
 
-	// log.Info().Msgf("Starting Dokémon v%s-%s", common.Version, runtime.GOARCH)
-	log.Info().Msgf("Starting Dokémon Server %s", getFullVersion())
+	log.Info().Msgf("Starting Dokémon Server %s-%s", common.Version, getArchitecture())
+	network := common.GetNetworkInfo()
+	common.LogNetworkInfo(network)
 
 	if dataPath == "" {
 		dataPath = "/data"
@@ -291,15 +91,52 @@ func NewServer(dbConnectionString string, dataPath string, logLevel string, sslE
 
 	s.sslEnabled = sslEnabled == "1"
 
+	s.shutdownTimeout = defaultShutdownTimeout
+	if shutdownTimeout != "" {
+		d, err := time.ParseDuration(shutdownTimeout)
+		if err != nil || d < 0 {
+			log.Warn().Str("shutdownTimeout", shutdownTimeout).Msg("Invalid shutdown timeout. Using default")
+		} else {
+			s.shutdownTimeout = d
+		}
+	}
+
+	retention := messages.DefaultTaskRetention
+	if taskRetention != "" {
+		d, err := time.ParseDuration(taskRetention)
+		if err != nil || d < 0 {
+			log.Warn().Str("taskRetention", taskRetention).Msg("Invalid task retention. Using default")
+		} else {
+			retention = d
+		}
+	}
+
 	composeProjectsPath := path.Join(dataPath, "/compose")
 	initCompose(composeProjectsPath)
 	initEncryption(dataPath)
+	s.ca = initCertificateAuthority(path.Join(dataPath, "certs"))
 	db, err := initDatabase(dbConnectionString)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error while initializing database")
 	}
+	s.db = db
 
 	// Setup stores
+	taskStore := store.NewSqlTaskStore(db)
+	s.taskBroker = messages.NewTaskBroker(store.NewBrokerTaskStore(taskStore), retention)
+	err = s.taskBroker.Start()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while starting task broker")
+	}
+
+	nodeStore := store.NewSqlNodeStore(db)
+	err = nodeStore.UpdateNetworkInfo(1, &network)
+	if err != nil {
+		log.Error().Err(err).Msg("Error while updating network info of the server node")
+	}
+	s.presence = presence.NewRegistry(nodeStore, presence.DefaultFlushPeriod)
+	s.presence.Start()
+
 	sqlNodeComposeProjectStore := store.NewSqlNodeComposeProjectStore(db, composeProjectsPath)
 	h := handler.NewHandler(
 		composeProjectsPath,
@@ -307,13 +144,17 @@ func NewServer(dbConnectionString string, dataPath string, logLevel string, sslE
 		store.NewSqlCredentialStore(db),
 		store.NewSqlEnvironmentStore(db),
 		store.NewSqlUserStore(db),
-		store.NewSqlNodeStore(db),
+		nodeStore,
 		sqlNodeComposeProjectStore,
 		store.NewSqlNodeComposeProjectVariableStore(db),
 		store.NewSqlSettingStore(db),
 		store.NewSqlVariableStore(db),
 		store.NewSqlVariableValueStore(db),
 		store.NewLocalFileSystemComposeLibraryStore(db, composeProjectsPath),
+		taskStore,
+		s.taskBroker,
+		s.presence,
+		s.ca,
 	)
 
 	err = sqlNodeComposeProjectStore.UpdateOldVersionRecords()
@@ -367,6 +208,21 @@ func initEncryption(dataPath string) {
 	ske.Init(string(keyBytes))
 }
 
+func initCertificateAuthority(certsDirPath string) *ssl.CertificateAuthority {
+	err := os.MkdirAll(certsDirPath, os.ModePerm)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while creating certs directory")
+	}
+
+	ca, err := ssl.LoadOrCreateCertificateAuthority(path.Join(certsDirPath, "ca.crt"), path.Join(certsDirPath, "ca.key"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while initializing certificate authority")
+	}
+	log.Info().Str("fingerprint", ca.Fingerprint()).Msg("Agent CA fingerprint")
+
+	return ca
+}
+
 func initDatabase(dbConnectionString string) (*gorm.DB, error) {
 	db, err := gorm.Open(sqlite.Open(dbConnectionString), &gorm.Config{})
 	if err != nil {
@@ -381,6 +237,7 @@ func initDatabase(dbConnectionString string) (*gorm.DB, error) {
 		&model.NodeComposeProject{},
 		&model.NodeComposeProjectVariable{},
 		&model.Setting{},
+		&model.Task{},
 		&model.User{},
 		&model.Variable{},
 		&model.VariableValue{},
@@ -419,16 +276,75 @@ func (s *Server) Run(addr string) {
 			keyPath := path.Join(certsDirPath, "server.key")
 			s.generateSelfSignedCerts(certsDirPath, certPath, keyPath)
 
+			cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load SSL certificate")
+			}
+
+			// Agents that enrolled for a client certificate present it here. Browsers are
+			// not asked for one as no certificate they hold is issued by the agent CA.
 			httpsAddr := ":9443"
+			s.Echo.TLSServer.Addr = httpsAddr
+			s.Echo.TLSServer.TLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    s.ca.Pool(),
+			}
+
 			log.Info().Str("address", httpsAddr).Msg("Starting HTTPS server")
-			if err := s.Echo.StartTLS(httpsAddr, certPath, keyPath); err != nil && err != http.ErrServerClosed {
+			if err := s.Echo.StartServer(s.Echo.TLSServer); err != nil && err != http.ErrServerClosed {
 				log.Fatal().Err(err).Msg("Failed to start HTTPS server")
 			}
 		}()
 	}
 
-	// Block forever (or until interrupt)
-	select {}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	s.Shutdown()
+}
+
+// Shutdown stops accepting requests and tasks, waits up to the shutdown timeout for running
+// tasks such as compose deployments to end, and then closes the connections of agents and
+// the database.
+func (s *Server) Shutdown() {
+	log.Info().Dur("timeout", s.shutdownTimeout).Msg("Shutting down. Waiting for running tasks to end")
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	// The servers stop accepting requests right away, but browsers and agents connected
+	// over websockets are left alone until the tasks have ended
+	var wg sync.WaitGroup
+	for _, srv := range []*http.Server{s.Echo.Server, s.Echo.TLSServer} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				log.Warn().Err(err).Str("address", srv.Addr).Msg("Error while shutting down web server")
+				srv.Close()
+			}
+		}()
+	}
+
+	err := s.taskBroker.Drain(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Shutdown timeout reached. Ending running tasks")
+	}
+	s.taskBroker.Close()
+	wg.Wait()
+	s.presence.Close()
+
+	sqlDB, err := s.db.DB()
+	if err == nil {
+		err = sqlDB.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error while closing database")
+	}
+
+	log.Info().Msg("Shutdown complete")
 }
 
 func (s *Server) authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
@@ -463,9 +379,9 @@ func (s *Server) generateSelfSignedCerts(certDirPath string, certPath string, ke
 		}
 	}
 	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
-		log.Debug().Msg("SSL certificate file does not exist. Generating self-signed certificate...")
+		log.Debug().Msg("SSL certificate file does not exist. Generating certificate issued by the agent CA...")
 
-		cert, key, err := ssl.GenerateSelfSignedCert()
+		cert, key, err := s.ca.IssueServerCertificate()
 		if err != nil {
 			panic(err)
 		}
@@ -487,6 +403,8 @@ func (s *Server) generateSelfSignedCerts(certDirPath string, certPath string, ke
 		if err != nil {
 			panic(err)
 		}
+	} else if cert, err := os.ReadFile(certPath); err == nil && !s.ca.IsIssuedBy(string(cert)) {
+		log.Warn().Str("path", certPath).Msg("SSL certificate is not issued by the agent CA. Agents pinning the CA fingerprint will not be able to connect. Delete the certificate to have it reissued or pin the certificate fingerprint instead")
 	}
 }
 
@@ -3,6 +3,7 @@
 import (
 	"time"
 
+	"github.com/dokemon-ng/dokemon/pkg/common"
 	"github.com/dokemon-ng/dokemon/pkg/server/model"
 )
 
@@ -26,9 +27,21 @@ type NodeStore interface {
 	Update(m *model.Node) error
 	UpdateAgentVersion(id uint, version string) error
 	UpdateLastPing(id uint, t time.Time) error
+	UpdateLastPings(pings map[uint]time.Time) error
+	UpdateNetworkInfo(id uint, info *common.NetworkInfo) error
+	UpdateReconnectInfo(id uint, reconnectCount uint, lastError string) error
+	UpdateCapabilities(id uint, protocolVersion uint, taskTypes []string) error
+	UpdateCertificateFingerprint(id uint, fingerprint string) error
+	UpdateEnrollmentToken(id uint, tokenHash string, expiresAt time.Time) error
+	ConsumeEnrollmentToken(id uint, enrollmentTokenHash string, tokenHash string) (bool, error)
+	UpdatePendingTokenHash(id uint, tokenHash string) error
+	PromotePendingTokenHash(id uint, tokenHash string) error
+	RevokeTokens(id uint) error
+	UpdateLastError(id uint, lastError string) error
 	UpdateContainerBaseUrl(id uint, url *string) error
 	GetById(id uint) (*model.Node, error)
 	GetList(pageNo, pageSize uint) ([]model.Node, int64, error)
+	GetAll() ([]model.Node, error)
 	DeleteById(id uint) error
 	Exists(id uint) (bool, error)
 
@@ -36,6 +49,30 @@ type NodeStore interface {
 	IsUniqueNameExcludeItself(name string, id uint) (bool, error)
 }
 
+// TaskFilter narrows down the task history. Zero values don't filter.
+type TaskFilter struct {
+	NodeId *uint
+	From   *time.Time // Inclusive
+	To     *time.Time // Exclusive
+	Type   string
+	Status string
+}
+
+type TaskStore interface {
+	Create(m *model.Task) error
+	Update(m *model.Task) error
+	GetById(id string) (*model.Task, error)
+	GetList(filter TaskFilter, pageNo, pageSize uint) ([]model.Task, int64, error)
+	GetQueuedByNodeId(nodeId uint) ([]model.Task, error)
+	Claim(id string, t time.Time) (bool, error)
+	Complete(id string, status string, result *string, t time.Time) error
+	CancelQueued(id string, t time.Time) (bool, error)
+	Requeue(id string) error
+	ExpireQueued(t time.Time) (int64, error)
+	RecoverDispatched(t time.Time) error
+	DeleteFinished(before time.Time) (int64, error)
+}
+
 type NodeComposeProjectStore interface {
 	Create(m *model.NodeComposeProject) error
 	Update(m *model.NodeComposeProject) error
@@ -1,9 +1,12 @@
 package store
 
 import (
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
+	"github.com/dokemon-ng/dokemon/pkg/common"
 	"github.com/dokemon-ng/dokemon/pkg/server/model"
 
 	"gorm.io/gorm"
@@ -39,6 +42,120 @@ func (s *SqlNodeStore) UpdateLastPing(id uint, t time.Time) error {
 	return db.Error
 }
 
+// UpdateLastPings records the last pings of many nodes at once.
+func (s *SqlNodeStore) UpdateLastPings(pings map[uint]time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for id, t := range pings {
+			err := tx.Model(&model.Node{}).Where("id = ?", id).Update("last_ping", t).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SqlNodeStore) UpdateNetworkInfo(id uint, info *common.NetworkInfo) error {
+	interfaces, err := json.Marshal(info.Interfaces)
+	if err != nil {
+		return err
+	}
+
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"hostname":           truncate(info.Hostname, 255),
+		"primary_ip":         info.PrimaryIp,
+		"default_gateway":    info.DefaultGateway,
+		"zero_tier_ips":      strings.Join(info.ZeroTierIps, ","),
+		"tailscale_ips":      strings.Join(info.TailscaleIps, ","),
+		"network_interfaces": string(interfaces),
+	})
+
+	return db.Error
+}
+
+func (s *SqlNodeStore) UpdateReconnectInfo(id uint, reconnectCount uint, lastError string) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"reconnect_count": reconnectCount,
+		"last_error":      truncate(lastError, 255),
+	})
+
+	return db.Error
+}
+
+func (s *SqlNodeStore) UpdateCapabilities(id uint, protocolVersion uint, taskTypes []string) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"protocol_version": protocolVersion,
+		"task_types":       strings.Join(taskTypes, ","),
+	})
+
+	return db.Error
+}
+
+func (s *SqlNodeStore) UpdateCertificateFingerprint(id uint, fingerprint string) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Update("certificate_fingerprint", fingerprint)
+
+	return db.Error
+}
+
+func (s *SqlNodeStore) UpdateEnrollmentToken(id uint, tokenHash string, expiresAt time.Time) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"enrollment_token_hash": tokenHash,
+		"enrollment_expires_at": expiresAt,
+	})
+
+	return db.Error
+}
+
+// ConsumeEnrollmentToken replaces the credential of the node with a new one if the enrollment
+// token is still unused. It returns false if the token was already consumed or replaced, so
+// that every enrollment token can be exchanged only once.
+func (s *SqlNodeStore) ConsumeEnrollmentToken(id uint, enrollmentTokenHash string, tokenHash string) (bool, error) {
+	db := s.db.Model(&model.Node{}).Where("id = ? AND enrollment_token_hash = ?", id, enrollmentTokenHash).Updates(map[string]interface{}{
+		"token_hash":              tokenHash,
+		"pending_token_hash":      nil,
+		"enrollment_token_hash":   nil,
+		"enrollment_expires_at":   nil,
+		"certificate_fingerprint": "",
+	})
+
+	return db.RowsAffected == 1, db.Error
+}
+
+func (s *SqlNodeStore) UpdatePendingTokenHash(id uint, tokenHash string) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Update("pending_token_hash", tokenHash)
+
+	return db.Error
+}
+
+// PromotePendingTokenHash makes the pending credential the credential of the node, which
+// invalidates the previous one. Nothing happens if the pending credential was replaced.
+func (s *SqlNodeStore) PromotePendingTokenHash(id uint, tokenHash string) error {
+	db := s.db.Model(&model.Node{}).Where("id = ? AND pending_token_hash = ?", id, tokenHash).Updates(map[string]interface{}{
+		"token_hash":         tokenHash,
+		"pending_token_hash": nil,
+	})
+
+	return db.Error
+}
+
+func (s *SqlNodeStore) RevokeTokens(id uint) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"token_hash":              nil,
+		"pending_token_hash":      nil,
+		"enrollment_token_hash":   nil,
+		"enrollment_expires_at":   nil,
+		"certificate_fingerprint": "",
+	})
+
+	return db.Error
+}
+
+func (s *SqlNodeStore) UpdateLastError(id uint, lastError string) error {
+	db := s.db.Model(&model.Node{}).Where("id = ?", id).Update("last_error", truncate(lastError, 255))
+
+	return db.Error
+}
+
 func (s *SqlNodeStore) UpdateContainerBaseUrl(id uint, url *string) error {
 	db := s.db.Model(&model.Node{}).Where("id = ?", id).Update("container_base_url", url)
 
@@ -94,6 +211,14 @@ func (s *SqlNodeStore) GetList(pageNo, pageSize uint) ([]model.Node, int64, erro
 	return l, count, nil
 }
 
+func (s *SqlNodeStore) GetAll() ([]model.Node, error) {
+	var l []model.Node
+
+	err := s.db.Order("nodes.name asc").Model(&model.Node{}).Joins("Environment").Find(&l).Error
+
+	return l, err
+}
+
 func (s *SqlNodeStore) IsUniqueName(name string) (bool, error) {
 	var count int64
 
@@ -113,3 +238,11 @@ func (s *SqlNodeStore) IsUniqueNameExcludeItself(name string, id uint) (bool, er
 
 	return count == 0, nil
 }
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+
+	return s[:length]
+}
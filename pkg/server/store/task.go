@@ -0,0 +1,188 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+
+	"gorm.io/gorm"
+)
+
+type SqlTaskStore struct {
+	db *gorm.DB
+}
+
+func NewSqlTaskStore(db *gorm.DB) *SqlTaskStore {
+	return &SqlTaskStore{
+		db: db,
+	}
+}
+
+func (s *SqlTaskStore) Create(m *model.Task) error {
+	return s.db.Create(m).Error
+}
+
+func (s *SqlTaskStore) Update(m *model.Task) error {
+	return s.db.Save(m).Error
+}
+
+func (s *SqlTaskStore) GetById(id string) (*model.Task, error) {
+	var m model.Task
+
+	if err := s.db.Where("id = ?", id).First(&m).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+func (s *SqlTaskStore) GetList(filter TaskFilter, pageNo, pageSize uint) ([]model.Task, int64, error) {
+	var (
+		l     []model.Task
+		count int64
+	)
+
+	db := s.db.Model(&model.Task{})
+	if filter.NodeId != nil {
+		db = db.Where("node_id = ?", *filter.NodeId)
+	}
+	if filter.Type != "" {
+		db = db.Where("type = ?", filter.Type)
+	}
+	if filter.Status != "" {
+		db = db.Where("status = ?", filter.Status)
+	}
+	if filter.From != nil {
+		db = db.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		db = db.Where("created_at < ?", *filter.To)
+	}
+
+	if err := db.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	err := db.Offset(int((pageNo - 1) * pageSize)).Limit(int(pageSize)).Order("created_at desc").Find(&l).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return l, count, nil
+}
+
+func (s *SqlTaskStore) GetQueuedByNodeId(nodeId uint) ([]model.Task, error) {
+	var l []model.Task
+
+	err := s.db.Where("node_id = ? and status = ?", nodeId, model.TaskStatusQueued).Order("created_at asc").Find(&l).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Claim atomically moves a queued task to dispatched. It returns false if the task was already
+// claimed by someone else.
+func (s *SqlTaskStore) Claim(id string, t time.Time) (bool, error) {
+	db := s.db.Model(&model.Task{}).
+		Where("id = ? and status = ?", id, model.TaskStatusQueued).
+		Updates(map[string]interface{}{
+			"status":        model.TaskStatusDispatched,
+			"attempts":      gorm.Expr("attempts + 1"),
+			"dispatched_at": t,
+		})
+	if db.Error != nil {
+		return false, db.Error
+	}
+
+	return db.RowsAffected == 1, nil
+}
+
+func (s *SqlTaskStore) Complete(id string, status string, result *string, t time.Time) error {
+	var m model.Task
+	if err := s.db.Select("dispatched_at").Where("id = ?", id).First(&m).Error; err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"status":       status,
+		"result":       result,
+		"completed_at": t,
+	}
+	if m.DispatchedAt != nil {
+		updates["duration_ms"] = t.Sub(*m.DispatchedAt).Milliseconds()
+	}
+
+	return s.db.Model(&model.Task{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// CancelQueued atomically moves a queued task to cancelled. It returns false if the task is not
+// queued anymore.
+func (s *SqlTaskStore) CancelQueued(id string, t time.Time) (bool, error) {
+	db := s.db.Model(&model.Task{}).
+		Where("id = ? and status = ?", id, model.TaskStatusQueued).
+		Updates(map[string]interface{}{
+			"status":       model.TaskStatusCancelled,
+			"completed_at": t,
+		})
+	if db.Error != nil {
+		return false, db.Error
+	}
+
+	return db.RowsAffected == 1, nil
+}
+
+func (s *SqlTaskStore) Requeue(id string) error {
+	db := s.db.Model(&model.Task{}).Where("id = ?", id).Update("status", model.TaskStatusQueued)
+
+	return db.Error
+}
+
+func (s *SqlTaskStore) ExpireQueued(t time.Time) (int64, error) {
+	db := s.db.Model(&model.Task{}).
+		Where("status = ? and expires_at is not null and expires_at < ?", model.TaskStatusQueued, t).
+		Updates(map[string]interface{}{
+			"status":       model.TaskStatusExpired,
+			"completed_at": t,
+		})
+
+	return db.RowsAffected, db.Error
+}
+
+// DeleteFinished deletes the tasks created before the given time which are not queued or
+// running anymore.
+func (s *SqlTaskStore) DeleteFinished(before time.Time) (int64, error) {
+	db := s.db.
+		Where("created_at < ? and status not in ?", before, []string{model.TaskStatusQueued, model.TaskStatusDispatched}).
+		Delete(&model.Task{})
+
+	return db.RowsAffected, db.Error
+}
+
+// RecoverDispatched fixes up tasks that were dispatched when the server stopped. Interactive
+// tasks have lost their caller so they are failed. Queued tasks go back to the queue if they
+// have attempts left.
+func (s *SqlTaskStore) RecoverDispatched(t time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := "Server restarted while task was running"
+
+		err := tx.Model(&model.Task{}).
+			Where("status = ? and (interactive = ? or attempts >= max_attempts)", model.TaskStatusDispatched, true).
+			Updates(map[string]interface{}{
+				"status":       model.TaskStatusCompletedWithFailure,
+				"result":       result,
+				"completed_at": t,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&model.Task{}).
+			Where("status = ?", model.TaskStatusDispatched).
+			Update("status", model.TaskStatusQueued).Error
+	})
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+)
+
+// BrokerTaskStore is the messages.TaskStore of the task broker, kept in the task table.
+type BrokerTaskStore struct {
+	*SqlTaskStore
+}
+
+func NewBrokerTaskStore(s *SqlTaskStore) *BrokerTaskStore {
+	return &BrokerTaskStore{
+		SqlTaskStore: s,
+	}
+}
+
+func (s *BrokerTaskStore) Create(t *messages.Task) error {
+	m := model.Task{
+		ExpiresAt:    t.ExpiresAt,
+		DispatchedAt: t.DispatchedAt,
+		Id:           t.Id,
+		Type:         t.Type,
+		Status:       t.Status,
+		Payload:      t.Payload,
+		UserName:     t.UserName,
+		NodeId:       t.NodeId,
+		Attempts:     t.Attempts,
+		MaxAttempts:  t.MaxAttempts,
+		TimeoutMs:    t.Timeout.Milliseconds(),
+		Interactive:  t.Interactive,
+	}
+
+	return s.SqlTaskStore.Create(&m)
+}
+
+func (s *BrokerTaskStore) Exists(id string) (bool, error) {
+	var count int64
+
+	if err := s.db.Model(&model.Task{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *BrokerTaskStore) GetQueuedByNodeId(nodeId uint) ([]messages.Task, error) {
+	l, err := s.SqlTaskStore.GetQueuedByNodeId(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]messages.Task, 0, len(l))
+	for _, m := range l {
+		tasks = append(tasks, messages.Task{
+			ExpiresAt:    m.ExpiresAt,
+			DispatchedAt: m.DispatchedAt,
+			Id:           m.Id,
+			Type:         m.Type,
+			Status:       m.Status,
+			Payload:      m.Payload,
+			UserName:     m.UserName,
+			NodeId:       m.NodeId,
+			Attempts:     m.Attempts,
+			MaxAttempts:  m.MaxAttempts,
+			Timeout:      time.Duration(m.TimeoutMs) * time.Millisecond,
+			Interactive:  m.Interactive,
+		})
+	}
+	return tasks, nil
+}
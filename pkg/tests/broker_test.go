@@ -0,0 +1,526 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+	"github.com/dokemon-ng/dokemon/pkg/server/store"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// testTaskTypes are the task types advertised by the fake agent
+var testTaskTypes = []string{"DockerVolumeList", "DockerComposeDownNoStreaming"}
+
+func newTaskStore(t *testing.T) *store.SqlTaskStore {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&model.Task{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	return store.NewSqlTaskStore(db)
+}
+
+func newTaskBroker(t *testing.T) (*messages.TaskBroker, store.TaskStore) {
+	taskStore := newTaskStore(t)
+	broker := messages.NewTaskBroker(store.NewBrokerTaskStore(taskStore), messages.DefaultTaskRetention)
+	if err := broker.Start(); err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	t.Cleanup(broker.Close)
+
+	return broker, taskStore
+}
+
+// completeTask plays the agent side of a task by reporting the given result.
+func completeTask(stream *messages.Stream, result string) {
+	defer stream.Close()
+	messages.Send(stream, messages.TaskStatusMessage{Status: model.TaskStatusCompletedWithSuccess, Result: &result})
+}
+
+func TestBrokerProcessesTaskWithResponse(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		if messages.TypeOf(taskDefinition) != "DockerVolumeList" {
+			stream.Close()
+			return
+		}
+		completeTask(stream, string(messages.Serialize(dockerapi.DockerVolumeListResponse{})))
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	res, err := messages.ProcessTaskWithResponse[dockerapi.DockerVolumeList, dockerapi.DockerVolumeListResponse](
+		context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("process task: %v", err)
+	}
+	if res == nil {
+		t.Fatalf("expected a response")
+	}
+}
+
+func TestBrokerFailsFastWhenNodeOffline(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+
+	err := messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	if err != messages.ErrNodeOffline {
+		t.Fatalf("expected ErrNodeOffline, got %v", err)
+	}
+}
+
+func TestBrokerRejectsTaskNotSupportedByAgent(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	opened := make(chan string, 1)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		opened <- taskDefinition
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	err := messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerVolumeCreate{Name: "data"}, 5*time.Second)
+	if !errors.Is(err, messages.ErrTaskNotSupported) {
+		t.Fatalf("expected ErrTaskNotSupported, got %v", err)
+	}
+
+	select {
+	case taskDefinition := <-opened:
+		t.Fatalf("unsupported task was sent to the agent: %s", taskDefinition)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBrokerCancelClosesAgentStream(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	agentErr := make(chan error, 1)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		_, _, err := stream.ReadMessage()
+		agentErr <- err
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := messages.ProcessTask(ctx, broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	select {
+	case err := <-agentErr:
+		if err == nil || err.Error() != context.Canceled.Error() {
+			t.Fatalf("expected agent stream to end with cancellation, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent stream was not closed")
+	}
+
+	err = messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 100*time.Millisecond)
+	if err != messages.ErrTaskTimeout {
+		t.Fatalf("expected ErrTaskTimeout, got %v", err)
+	}
+}
+
+func TestBrokerDispatchesQueuedTaskWhenAgentConnects(t *testing.T) {
+	key, err := ske.GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ske.Init(key)
+
+	broker, taskStore := newTaskBroker(t)
+	taskId, err := messages.QueueTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, messages.DefaultTaskPolicy)
+	if err != nil {
+		t.Fatalf("queue task: %v", err)
+	}
+
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		completeTask(stream, "")
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	waitForTaskStatus(t, taskStore, taskId, model.TaskStatusCompletedWithSuccess)
+}
+
+// waitForTaskStatus polls the store until the task has the given status.
+func waitForTaskStatus(t *testing.T, taskStore store.TaskStore, taskId string, status string) *model.Task {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		task, err := taskStore.GetById(taskId)
+		if err != nil {
+			t.Fatalf("get task: %v", err)
+		}
+		if task.Status == status {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected task status %s, got %s", status, task.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBrokerDoesNotRetryQueuedTaskFailedByAgent(t *testing.T) {
+	key, err := ske.GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ske.Init(key)
+
+	broker, taskStore := newTaskBroker(t)
+	opened := make(chan struct{}, 10)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		opened <- struct{}{}
+		// Ends the task without a status, which is a protocol error rather than a lost agent
+		stream.Close()
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	taskId, err := messages.QueueTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, messages.DefaultTaskPolicy)
+	if err != nil {
+		t.Fatalf("queue task: %v", err)
+	}
+
+	task := waitForTaskStatus(t, taskStore, taskId, model.TaskStatusCompletedWithFailure)
+	if task.Attempts != 1 || len(opened) != 1 {
+		t.Fatalf("expected a single attempt, got %d attempts and %d dispatches", task.Attempts, len(opened))
+	}
+}
+
+func TestBrokerUsesTimeoutOfQueuedTask(t *testing.T) {
+	key, err := ske.GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ske.Init(key)
+
+	broker, taskStore := newTaskBroker(t)
+	policy := messages.TaskPolicy{MaxAttempts: 1, Expiry: time.Hour, Timeout: 100 * time.Millisecond}
+	taskId, err := messages.QueueTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, policy)
+	if err != nil {
+		t.Fatalf("queue task: %v", err)
+	}
+
+	// The task is dispatched when the agent connects, from what was stored with it
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	task := waitForTaskStatus(t, taskStore, taskId, model.TaskStatusCompletedWithFailure)
+	if task.Result == nil || *task.Result != messages.ErrTaskTimeout.Error() {
+		t.Fatalf("expected the task to time out, got %+v", task)
+	}
+}
+
+func TestBrokerCancelsRunningTask(t *testing.T) {
+	broker, taskStore := newTaskBroker(t)
+	started := make(chan string, 1)
+	agentCause := make(chan error, 1)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		started <- stream.Id
+		<-stream.Context().Done()
+		agentCause <- context.Cause(stream.Context())
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerComposeDownNoStreaming{}, 5*time.Second)
+	}()
+
+	taskId := <-started
+	if err := broker.Cancel(taskId); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if err := <-result; err != messages.ErrTaskCancelled {
+		t.Fatalf("expected ErrTaskCancelled, got %v", err)
+	}
+	select {
+	case err := <-agentCause:
+		if err != messages.ErrTaskCancelled {
+			t.Fatalf("expected agent task context to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent task was not cancelled")
+	}
+
+	task, err := taskStore.GetById(taskId)
+	if err != nil || task.Status != model.TaskStatusCancelled {
+		t.Fatalf("expected task to be recorded as cancelled, got %+v (%v)", task, err)
+	}
+	if err := broker.Cancel(taskId); err != messages.ErrTaskCompleted {
+		t.Fatalf("expected ErrTaskCompleted, got %v", err)
+	}
+	if err := broker.Cancel("unknown"); err != messages.ErrTaskNotFound {
+		t.Fatalf("expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestBrokerCancelsQueuedTask(t *testing.T) {
+	key, err := ske.GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ske.Init(key)
+
+	broker, taskStore := newTaskBroker(t)
+	taskId, err := messages.QueueTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, messages.DefaultTaskPolicy)
+	if err != nil {
+		t.Fatalf("queue task: %v", err)
+	}
+
+	if err := broker.Cancel(taskId); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	task, err := taskStore.GetById(taskId)
+	if err != nil || task.Status != model.TaskStatusCancelled {
+		t.Fatalf("expected task to be recorded as cancelled, got %+v (%v)", task, err)
+	}
+}
+
+func TestBrokerCancelsLocalStreamTask(t *testing.T) {
+	broker, taskStore := newTaskBroker(t)
+	nodeId := uint(1)
+	runningTaskId := func() string {
+		rows, _, err := taskStore.GetList(store.TaskFilter{NodeId: &nodeId, Status: model.TaskStatusDispatched}, 1, 10)
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("expected 1 running local task, got %d (%v)", len(rows), err)
+		}
+		return rows[0].Id
+	}
+
+	done := messages.RecordLocalTask(context.Background(), broker, 1, dockerapi.DockerImageList{})
+	if err := broker.Cancel(runningTaskId()); err != messages.ErrNotCancellable {
+		t.Fatalf("expected ErrNotCancellable, got %v", err)
+	}
+	done(nil)
+
+	conn, done := messages.RecordLocalStreamTask(context.Background(), broker, 1, dockerapi.DockerContainerLogs{}, messages.NewStream("browser"))
+	taskId := runningTaskId()
+	if err := broker.Cancel(taskId); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	ctx := conn.(interface{ Context() context.Context }).Context()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("local task context was not cancelled")
+	}
+	done(ctx.Err())
+
+	task, err := taskStore.GetById(taskId)
+	if err != nil || task.Status != model.TaskStatusCancelled {
+		t.Fatalf("expected task to be recorded as cancelled, got %+v (%v)", task, err)
+	}
+}
+
+func TestBrokerCancelsLocalRecreate(t *testing.T) {
+	broker, taskStore := newTaskBroker(t)
+	nodeId := uint(1)
+
+	ctx, done := messages.RecordLocalCancellableTask(context.Background(), broker, 1, dockerapi.DockerContainerRecreateStale{})
+	rows, _, err := taskStore.GetList(store.TaskFilter{NodeId: &nodeId, Status: model.TaskStatusDispatched}, 1, 10)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected 1 running local task, got %d (%v)", len(rows), err)
+	}
+	if err := broker.Cancel(rows[0].Id); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("local task context was not cancelled")
+	}
+	if context.Cause(ctx) != messages.ErrTaskCancelled {
+		t.Errorf("expected the task to be cancelled by the broker, got %v", context.Cause(ctx))
+	}
+	done(nil)
+
+	task, err := taskStore.GetById(rows[0].Id)
+	if err != nil || task.Status != model.TaskStatusCancelled {
+		t.Fatalf("expected task to be recorded as cancelled, got %+v (%v)", task, err)
+	}
+}
+
+func TestBrokerRecordsTaskHistory(t *testing.T) {
+	broker, taskStore := newTaskBroker(t)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		completeTask(stream, "")
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	ctx := messages.WithUserName(context.Background(), "admin")
+	if err := messages.ProcessTask(ctx, broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second); err != nil {
+		t.Fatalf("process task: %v", err)
+	}
+	done := messages.RecordLocalTask(ctx, broker, 1, dockerapi.DockerImageList{})
+	done(errors.New("failed"))
+
+	nodeId := uint(2)
+	rows, count, err := taskStore.GetList(store.TaskFilter{NodeId: &nodeId}, 1, 10)
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 task for node 2, got %d (%v)", count, err)
+	}
+	if rows[0].Type != "DockerVolumeList" || rows[0].UserName != "admin" || rows[0].Status != model.TaskStatusCompletedWithSuccess || rows[0].CompletedAt == nil {
+		t.Fatalf("unexpected task recorded: %+v", rows[0])
+	}
+
+	rows, count, err = taskStore.GetList(store.TaskFilter{Status: model.TaskStatusCompletedWithFailure}, 1, 10)
+	if err != nil || count != 1 || rows[0].NodeId != 1 || rows[0].Type != "DockerImageList" || *rows[0].Result != "failed" {
+		t.Fatalf("expected the failed local task, got %+v (%v)", rows, err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	_, count, err = taskStore.GetList(store.TaskFilter{From: &future}, 1, 10)
+	if err != nil || count != 0 {
+		t.Fatalf("expected no tasks in the future, got %d (%v)", count, err)
+	}
+}
+
+func TestBrokerKeepsAgentStatusOfCurrentSession(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {})
+	staleSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	status := &messages.AgentStatusMessage{Lanes: []messages.TaskLaneStatus{{Name: "request", Workers: 4, Running: 4, Queued: 2, QueueSize: 100}}}
+	broker.UpdateAgentStatus(2, serverSession, status)
+	broker.UpdateAgentStatus(2, staleSession, &messages.AgentStatusMessage{})
+
+	if got, _ := broker.AgentStatus(2); got != status {
+		t.Fatalf("expected the status reported on the current session, got %+v", got)
+	}
+
+	broker.UnregisterSession(2, serverSession)
+	if got, _ := broker.AgentStatus(2); got != nil {
+		t.Fatalf("expected no status once the agent disconnected, got %+v", got)
+	}
+}
+
+func TestBrokerDrainWaitsForRunningTasks(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	release := make(chan struct{})
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		<-release
+		completeTask(stream, "")
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	processed := make(chan error, 1)
+	go func() {
+		processed <- messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- broker.Drain(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	err := messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	if err != messages.ErrShuttingDown {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("drain ended while a task was running: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-processed; err != nil {
+		t.Fatalf("running task failed: %v", err)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("drain failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("drain did not end after the task ended")
+	}
+}
+
+func TestBrokerDrainGivesUpAtDeadline(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		stream.ReadMessage()
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	go messages.ProcessTask(context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := broker.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be reached, got %v", err)
+	}
+}
+
+// Run with -race to catch the sessions being closed while agents unregister
+func TestBrokerClosesWhileAgentsUnregister(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+
+	sessions := make([]*messages.Session, 10)
+	for i := range sessions {
+		sessions[i], _ = newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {})
+		broker.RegisterSession(uint(i+2), sessions[i], testTaskTypes)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, s := range sessions {
+			broker.UnregisterSession(uint(i+2), s)
+		}
+	}()
+	broker.Close()
+	<-done
+
+	for i := range sessions {
+		if broker.IsNodeConnected(uint(i + 2)) {
+			t.Errorf("expected node %d to be disconnected", i+2)
+		}
+	}
+}
+
+func TestTaskStoreDeletesOnlyFinishedTasksPastRetention(t *testing.T) {
+	// Without a broker, whose own pruning would race with the test
+	taskStore := newTaskStore(t)
+
+	old := time.Now().Add(-2 * messages.DefaultTaskRetention)
+	tasks := []model.Task{
+		{Id: "old-completed", Status: model.TaskStatusCompletedWithSuccess, CreatedAt: old},
+		{Id: "old-cancelled", Status: model.TaskStatusCancelled, CreatedAt: old},
+		{Id: "old-queued", Status: model.TaskStatusQueued, CreatedAt: old},
+		{Id: "old-dispatched", Status: model.TaskStatusDispatched, CreatedAt: old},
+		{Id: "recent-completed", Status: model.TaskStatusCompletedWithFailure, CreatedAt: time.Now()},
+	}
+	for i := range tasks {
+		if err := taskStore.Create(&tasks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := taskStore.DeleteFinished(time.Now().Add(-messages.DefaultTaskRetention))
+	if err != nil || n != 2 {
+		t.Fatalf("expected the 2 old finished tasks to be deleted, got %d (%v)", n, err)
+	}
+	for _, id := range []string{"old-queued", "old-dispatched", "recent-completed"} {
+		if m, _ := taskStore.GetById(id); m == nil {
+			t.Errorf("expected %s to be kept", id)
+		}
+	}
+}
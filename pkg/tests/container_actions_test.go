@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+)
+
+func TestContainerActionsValidateRequests(t *testing.T) {
+	e, _, _ := newAgentServer(t)
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"pause", `{}`},
+		{"unpause", `{"id": ""}`},
+		{"kill", `{"signal": "SIGTERM"}`},
+		{"kill", `{"id": "c1", "signal": "` + strings.Repeat("X", 21) + `"}`},
+		{"kill", `{"id": "c1", "signal": "SIG\u0000TERM"}`},
+		{"rename", `{"id": "c1"}`},
+		{"rename", `{"id": "c1", "name": ""}`},
+		{"rename", `{"id": "c1", "name": "` + strings.Repeat("a", 101) + `"}`},
+		{"rename", `{"id": "c1", "name": 5}`},
+	}
+
+	for _, tt := range tests {
+		if rec := post(e, "/api/v1/nodes/2/containers/"+tt.path, tt.body); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s %s: expected 422, got %d", tt.path, tt.body, rec.Code)
+		}
+	}
+}
+
+func TestContainerActionsPassRequestsToAgent(t *testing.T) {
+	e, broker, _ := newAgentServer(t)
+
+	var mu sync.Mutex
+	received := map[string]string{}
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		mu.Lock()
+		received[messages.TypeOf(taskDefinition)] = taskDefinition
+		mu.Unlock()
+		completeTask(stream, "")
+	})
+	broker.RegisterSession(2, serverSession, []string{"DockerContainerPause", "DockerContainerUnpause", "DockerContainerKill", "DockerContainerRename"})
+
+	for path, body := range map[string]string{
+		"pause":   `{"id": "c1"}`,
+		"unpause": `{"id": "c1"}`,
+		"kill":    `{"id": "c1"}`,
+		"rename":  `{"id": "c1", "name": "web-2"}`,
+	} {
+		if rec := post(e, "/api/v1/nodes/2/containers/"+path, body); rec.Code != http.StatusNoContent {
+			t.Errorf("%s: expected 204, got %d %s", path, rec.Code, rec.Body)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	kill, err := messages.Parse[dockerapi.DockerContainerKill](received["DockerContainerKill"])
+	if err != nil || kill.Id != "c1" || kill.Signal != "" {
+		t.Errorf("expected a kill with Docker's default signal, got %+v (%v)", kill, err)
+	}
+	rename, err := messages.Parse[dockerapi.DockerContainerRename](received["DockerContainerRename"])
+	if err != nil || rename.Id != "c1" || rename.Name != "web-2" {
+		t.Errorf("expected the container to be renamed to web-2, got %+v (%v)", rename, err)
+	}
+	for _, taskType := range []string{"DockerContainerPause", "DockerContainerUnpause"} {
+		if received[taskType] == "" {
+			t.Errorf("expected a %s task", taskType)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+)
+
+type bulkResult struct {
+	NodeId      uint   `json:"nodeId"`
+	ContainerId string `json:"containerId"`
+	Name        string `json:"name"`
+	TaskId      string `json:"taskId"`
+	Ok          bool   `json:"ok"`
+	Queued      bool   `json:"queued"`
+	NodeOffline bool   `json:"nodeOffline"`
+	Error       string `json:"error"`
+}
+
+func TestBulkContainerActionReportsEveryItemInOrder(t *testing.T) {
+	// The local action fails fast rather than reaching a Docker daemon
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:1")
+
+	e, broker, presenceRegistry := newAgentServer(t)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		switch messages.TypeOf(taskDefinition) {
+		case "DockerContainerList":
+			completeTask(stream, string(messages.Serialize(dockerapi.DockerContainerListResponse{Items: []dockerapi.Container{
+				{Id: "c4", Name: "db", Labels: map[string]string{"app": "other"}},
+				{Id: "c3", Name: "web", Labels: map[string]string{"app": "shop"}},
+			}})))
+		case "DockerContainerStop":
+			defer stream.Close()
+			result := "No such container"
+			messages.Send(stream, messages.TaskStatusMessage{Status: model.TaskStatusCompletedWithFailure, Result: &result})
+		default:
+			completeTask(stream, "")
+		}
+	})
+	broker.RegisterSession(2, serverSession, []string{"DockerContainerList", "DockerContainerStart", "DockerContainerStop"})
+	presenceRegistry.Connected(2)
+
+	rec := post(e, "/api/v1/containers/bulk", `{
+		"items": [
+			{"nodeId": 1, "containerId": "local", "action": "start"},
+			{"nodeId": 2, "containerId": "c1", "action": "start"},
+			{"nodeId": 2, "containerId": "c2", "action": "stop"},
+			{"nodeId": 3, "containerId": "c9", "action": "start"}
+		],
+		"selector": {"labels": ["app=shop"], "action": "start"}
+	}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bulk action failed: %d %s", rec.Code, rec.Body)
+	}
+
+	var res struct {
+		Succeeded int          `json:"succeeded"`
+		Queued    int          `json:"queued"`
+		Failed    int          `json:"failed"`
+		Items     []bulkResult `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Items) != 6 {
+		t.Fatalf("expected 6 results, got %+v", res.Items)
+	}
+
+	local, started, stopped, offline, selected, offlineSelection := res.Items[0], res.Items[1], res.Items[2], res.Items[3], res.Items[4], res.Items[5]
+	if local.ContainerId != "local" || local.Ok || local.Queued || local.Error == "" {
+		t.Errorf("expected the local action to fail, got %+v", local)
+	}
+	if started.ContainerId != "c1" || !started.Ok || started.TaskId == "" {
+		t.Errorf("expected the outcome of the agent action, got %+v", started)
+	}
+	if stopped.ContainerId != "c2" || stopped.Ok || !strings.Contains(stopped.Error, "No such container") {
+		t.Errorf("expected the failure of the agent action, got %+v", stopped)
+	}
+	if offline.ContainerId != "c9" || !offline.Queued || !offline.NodeOffline || offline.TaskId == "" {
+		t.Errorf("expected the action on the offline node to be queued, got %+v", offline)
+	}
+	if selected.ContainerId != "c3" || selected.Name != "web" || !selected.Ok {
+		t.Errorf("expected the selected container to be started, got %+v", selected)
+	}
+	if offlineSelection.NodeId != 3 || !offlineSelection.NodeOffline || offlineSelection.Error == "" {
+		t.Errorf("expected the offline node of the selection to be reported, got %+v", offlineSelection)
+	}
+	if res.Succeeded != 2 || res.Queued != 1 || res.Failed != 3 {
+		t.Errorf("expected 2 succeeded, 1 queued and 3 failed, got %d, %d and %d", res.Succeeded, res.Queued, res.Failed)
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestContainerCreateConfigMapsRequest(t *testing.T) {
+	req := &dockerapi.DockerContainerCreate{
+		Image: "nginx:latest",
+		Ports: []dockerapi.PortMapping{
+			{HostPort: 8080, ContainerPort: 80},
+			{HostIp: "127.0.0.1", ContainerPort: 53, Protocol: "udp"},
+		},
+		Volumes: []dockerapi.VolumeMapping{
+			{Source: "/srv/html", Target: "/usr/share/nginx/html", ReadOnly: true},
+			{Source: "nginx-cache", Target: "/var/cache/nginx"},
+		},
+		Networks: []string{"frontend", "backend"},
+		Cpus:     1.5,
+	}
+
+	config, hostConfig, err := dockerapi.ContainerCreateConfig(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp, udp := nat.Port("80/tcp"), nat.Port("53/udp")
+	if _, ok := config.ExposedPorts[tcp]; !ok {
+		t.Errorf("expected tcp to be the default protocol, got %v", config.ExposedPorts)
+	}
+	if b := hostConfig.PortBindings[tcp]; len(b) != 1 || b[0].HostPort != "8080" {
+		t.Errorf("expected port 80 to be published on 8080, got %v", b)
+	}
+	if b := hostConfig.PortBindings[udp]; len(b) != 1 || b[0].HostPort != "" || b[0].HostIP != "127.0.0.1" {
+		t.Errorf("expected port 53 to be published on a random port of 127.0.0.1, got %v", b)
+	}
+
+	if len(hostConfig.Mounts) != 2 {
+		t.Fatalf("expected 2 mounts, got %v", hostConfig.Mounts)
+	}
+	if m := hostConfig.Mounts[0]; m.Type != mount.TypeBind || !m.ReadOnly {
+		t.Errorf("expected an absolute source to be a read only bind mount, got %+v", m)
+	}
+	if m := hostConfig.Mounts[1]; m.Type != mount.TypeVolume || m.Source != "nginx-cache" {
+		t.Errorf("expected a named source to be a volume, got %+v", m)
+	}
+
+	if hostConfig.NetworkMode != "frontend" {
+		t.Errorf("expected the first network to be the network mode, got %s", hostConfig.NetworkMode)
+	}
+	if hostConfig.RestartPolicy.Name != container.RestartPolicyDisabled {
+		t.Errorf("expected no restart policy by default, got %s", hostConfig.RestartPolicy.Name)
+	}
+	if hostConfig.NanoCPUs != 1500000000 {
+		t.Errorf("expected 1.5 cpus, got %d nano cpus", hostConfig.NanoCPUs)
+	}
+}
+
+func TestContainerCreateConfigRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		req  dockerapi.DockerContainerCreate
+	}{
+		{"missing image", dockerapi.DockerContainerCreate{}},
+		{"unknown restart policy", dockerapi.DockerContainerCreate{Image: "nginx", RestartPolicy: "sometimes"}},
+		{"retries without on-failure", dockerapi.DockerContainerCreate{Image: "nginx", RestartPolicy: "always", MaxRetries: 3}},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := dockerapi.ContainerCreateConfig(&tt.req); err == nil {
+			t.Errorf("%s: expected the request to be rejected", tt.name)
+		}
+	}
+
+	req := dockerapi.DockerContainerCreate{Image: "nginx", RestartPolicy: "on-failure", MaxRetries: 3}
+	if _, hostConfig, err := dockerapi.ContainerCreateConfig(&req); err != nil || hostConfig.RestartPolicy.MaximumRetryCount != 3 {
+		t.Errorf("expected retries with on-failure to be kept, got %v", err)
+	}
+}
+
+func TestPullImageNeededFollowsPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		present bool
+		pull    bool
+	}{
+		{"", false, true},
+		{"", true, false},
+		{dockerapi.PullMissing, false, true},
+		{dockerapi.PullMissing, true, false},
+		{dockerapi.PullAlways, true, true},
+		{dockerapi.PullNever, false, false},
+	}
+
+	for _, tt := range tests {
+		if pull := dockerapi.PullImageNeeded(tt.policy, tt.present); pull != tt.pull {
+			t.Errorf("policy %q with image present %v: expected pull %v, got %v", tt.policy, tt.present, tt.pull, pull)
+		}
+	}
+}
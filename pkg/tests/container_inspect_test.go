@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+)
+
+func TestMaskEnvHidesSecrets(t *testing.T) {
+	env := dockerapi.MaskEnv([]string{
+		"PATH=/usr/bin",
+		"POSTGRES_PASSWORD=hunter2",
+		"api_key=abc",
+		"EMPTY_TOKEN=",
+		"DATABASE_URL=postgres://app:hunter2@db:5432/app",
+		"HOME_URL=https://example.com/",
+		"OPTS=a=b",
+	})
+
+	expected := []dockerapi.ContainerEnvVar{
+		{Name: "PATH", Value: "/usr/bin"},
+		{Name: "POSTGRES_PASSWORD", Value: "********", Masked: true},
+		{Name: "api_key", Value: "********", Masked: true},
+		{Name: "EMPTY_TOKEN", Value: ""},
+		{Name: "DATABASE_URL", Value: "postgres://app:********@db:5432/app", Masked: true},
+		{Name: "HOME_URL", Value: "https://example.com/"},
+		{Name: "OPTS", Value: "a=b"},
+	}
+	if len(env) != len(expected) {
+		t.Fatalf("expected %d variables, got %d", len(expected), len(env))
+	}
+	for i := range expected {
+		if env[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], env[i])
+		}
+	}
+}
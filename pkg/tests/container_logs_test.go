@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+
+	"github.com/gorilla/websocket"
+)
+
+func logFrame(stream byte, payload string) []byte {
+	hdr := make([]byte, 8)
+	hdr[0] = stream
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(payload)))
+	return append(hdr, payload...)
+}
+
+func TestTrimLogsHeadKeepsWholeLines(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  string
+		max  int
+		want string
+	}{
+		{"fits", "one\ntwo\n", 8, "one\ntwo\n"},
+		{"drops oldest lines", "one\ntwo\nthree\n", 8, "three\n"},
+		{"cut inside a line", "one\ntwo\nthree\n", 10, "three\n"},
+		{"last line too long", "one\n0123456789\n", 5, "6789\n"},
+		{"no newline", "0123456789", 4, "6789"},
+	}
+
+	for _, tt := range tests {
+		if got := string(dockerapi.TrimLogsHead([]byte(tt.buf), tt.max)); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestContainerLogsDockerOptions(t *testing.T) {
+	o := dockerapi.ContainerLogsOptions{}.DockerOptions(true)
+	if o.Tail != "40" || !o.ShowStdout || !o.ShowStderr || !o.Follow {
+		t.Errorf("expected the zero value to follow the last 40 lines of both streams, got %+v", o)
+	}
+
+	o = dockerapi.ContainerLogsOptions{Tail: "all", Since: "10m", Stream: dockerapi.LogsStreamStderr, Timestamps: true}.DockerOptions(false)
+	if o.Tail != "all" || o.Since != "10m" || o.ShowStdout || !o.ShowStderr || o.Follow || !o.Timestamps {
+		t.Errorf("expected the options to be passed on, got %+v", o)
+	}
+
+	o = dockerapi.ContainerLogsOptions{Stream: dockerapi.LogsStreamStdout}.DockerOptions(false)
+	if !o.ShowStdout || o.ShowStderr {
+		t.Errorf("expected only stdout, got %+v", o)
+	}
+}
+
+func TestReadLogFramesDemultiplexesStreams(t *testing.T) {
+	var logs bytes.Buffer
+	logs.Write(logFrame(1, "out\n"))
+	logs.Write(logFrame(2, "err\n"))
+
+	var out bytes.Buffer
+	err := dockerapi.ReadLogFrames(&logs, func(dat []byte) error {
+		out.Write(dat)
+		return nil
+	})
+	if err != nil || out.String() != "out\nerr\n" {
+		t.Errorf("expected the payloads of both streams, got %q (%v)", out.String(), err)
+	}
+
+	tests := []struct {
+		name string
+		logs []byte
+		err  string
+	}{
+		{"engine error", append(logFrame(1, "out\n"), logFrame(3, "log file is gone\n")...), "log file is gone"},
+		{"unknown stream", logFrame(7, "?"), "Unexpected stream 7"},
+		{"truncated frame", logFrame(1, "out\n")[:10], "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		err := dockerapi.ReadLogFrames(bytes.NewReader(tt.logs), func([]byte) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestContainerLogsDownloadValidatesOptions(t *testing.T) {
+	e, _, _ := newAgentServer(t)
+
+	for _, query := range []string{"tail=-1", "tail=many", "stream=stdin", "since=yesterday", "until=2024-13-01", "format=zip"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/nodes/2/containers/c1/logs/download?"+query, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestContainerLogsDownloadDefaultsToAllLines(t *testing.T) {
+	e, broker, _ := newAgentServer(t)
+	requests := make(chan *dockerapi.DockerContainerLogsDownload, 1)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		defer stream.Close()
+		m, err := messages.Parse[dockerapi.DockerContainerLogsDownload](taskDefinition)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- m
+
+		for _, event := range []string{dockerapi.ContainerLogsDownloadEventStart, dockerapi.ContainerLogsDownloadEventDone} {
+			dat, _ := json.Marshal(dockerapi.ContainerLogsDownloadEvent{Type: event})
+			stream.WriteMessage(websocket.TextMessage, dat)
+			if event == dockerapi.ContainerLogsDownloadEventStart {
+				stream.WriteMessage(websocket.BinaryMessage, []byte("started\n"))
+			}
+		}
+	})
+	broker.RegisterSession(2, serverSession, []string{"DockerContainerLogsDownload"})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nodes/2/containers/c1/logs/download?since=1h", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "started\n" {
+		t.Fatalf("expected the logs, got %d %q", rec.Code, rec.Body)
+	}
+
+	m := <-requests
+	if m.Id != "c1" || m.Tail != "all" || m.Since != "1h" {
+		t.Errorf("expected all lines since an hour ago, got %+v", m)
+	}
+	if rec.Header().Get("X-Logs-Truncated") != "false" {
+		t.Errorf("expected the logs not to be truncated, got %q", rec.Header().Get("X-Logs-Truncated"))
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestContainerNetworksSplitsPrimaryNetwork(t *testing.T) {
+	id := "3f4e8a9b2c1d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f"
+	c := &container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{
+			ID:         id,
+			HostConfig: &container.HostConfig{NetworkMode: "frontend"},
+		},
+		NetworkSettings: &container.NetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"frontend": {Aliases: []string{"web", id[:12]}},
+				"backend":  {Aliases: []string{"api"}},
+			},
+		},
+	}
+
+	primary, others := dockerapi.ContainerNetworks(c)
+	frontend, ok := primary.EndpointsConfig["frontend"]
+	if !ok || len(primary.EndpointsConfig) != 1 {
+		t.Fatalf("expected frontend as the only primary network, got %v", primary.EndpointsConfig)
+	}
+	if !slices.Equal(frontend.Aliases, []string{"web"}) {
+		t.Errorf("expected the alias of the old container id to be dropped, got %v", frontend.Aliases)
+	}
+	if _, ok := others["backend"]; !ok || len(others) != 1 {
+		t.Errorf("expected backend to be connected afterwards, got %v", others)
+	}
+}
+
+func TestContainerKeepsPathOnlyOnCopiedMounts(t *testing.T) {
+	inspect := func(hostConfig *container.HostConfig) *container.InspectResponse {
+		return &container.InspectResponse{ContainerJSONBase: &container.ContainerJSONBase{HostConfig: hostConfig}}
+	}
+
+	tests := []struct {
+		name       string
+		hostConfig *container.HostConfig
+		keeps      bool
+	}{
+		{"named volume", &container.HostConfig{Binds: []string{"/var/run/docker.sock:/var/run/docker.sock", "dokemon-agent-data:/data"}}, true},
+		{"bind with options", &container.HostConfig{Binds: []string{"/srv/agent:/data:rw"}}, true},
+		{"parent directory", &container.HostConfig{Binds: []string{"/srv:/"}}, true},
+		{"mount", &container.HostConfig{Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: "agent", Target: "/data/"}}}, true},
+		{"anonymous volume", &container.HostConfig{Mounts: []mount.Mount{{Type: mount.TypeVolume, Target: "/data"}}}, false},
+		{"tmpfs", &container.HostConfig{Mounts: []mount.Mount{{Type: mount.TypeTmpfs, Target: "/data"}}}, false},
+		{"sibling path", &container.HostConfig{Binds: []string{"/srv/agent:/data2"}}, false},
+		{"docker socket only", &container.HostConfig{Binds: []string{"/var/run/docker.sock:/var/run/docker.sock"}}, false},
+	}
+
+	for _, tt := range tests {
+		if keeps := dockerapi.ContainerKeepsPath(inspect(tt.hostConfig), "/data"); keeps != tt.keeps {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.keeps, keeps)
+		}
+	}
+}
+
+func TestContainerRecreatableRefusesContainersWithoutRollback(t *testing.T) {
+	inspect := func(image string, labels map[string]string, hostConfig *container.HostConfig) *container.InspectResponse {
+		return &container.InspectResponse{
+			ContainerJSONBase: &container.ContainerJSONBase{ID: "c1", HostConfig: hostConfig},
+			Config:            &container.Config{Image: image, Labels: labels},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		c           *container.InspectResponse
+		recreatable bool
+	}{
+		{"standalone", inspect("nginx:latest", nil, &container.HostConfig{RestartPolicy: container.RestartPolicy{Name: "always"}}), true},
+		{"auto removed", inspect("nginx:latest", nil, &container.HostConfig{AutoRemove: true}), false},
+		{"compose project", inspect("nginx:latest", map[string]string{"com.docker.compose.project": "shop"}, &container.HostConfig{}), false},
+		{"pinned digest", inspect("nginx@sha256:0123", nil, &container.HostConfig{}), false},
+	}
+
+	for _, tt := range tests {
+		if err := dockerapi.ContainerRecreatable(tt.c); (err == nil) != tt.recreatable {
+			t.Errorf("%s: expected recreatable %v, got %v", tt.name, tt.recreatable, err)
+		}
+	}
+}
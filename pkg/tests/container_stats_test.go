@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestCalculateContainerUsage(t *testing.T) {
+	s := container.StatsResponse{
+		Name: "/web",
+		CPUStats: container.CPUStats{
+			CPUUsage:    container.CPUUsage{TotalUsage: 3_000},
+			SystemUsage: 20_000,
+			OnlineCPUs:  2,
+		},
+		PreCPUStats: container.CPUStats{
+			CPUUsage:    container.CPUUsage{TotalUsage: 1_000},
+			SystemUsage: 10_000,
+		},
+		MemoryStats: container.MemoryStats{
+			Usage: 300,
+			Limit: 1000,
+			Stats: map[string]uint64{"inactive_file": 100},
+		},
+		Networks: map[string]container.NetworkStats{
+			"eth0": {RxBytes: 10, TxBytes: 20},
+			"eth1": {RxBytes: 1, TxBytes: 2},
+		},
+		BlkioStats: container.BlkioStats{
+			IoServiceBytesRecursive: []container.BlkioStatEntry{
+				{Op: "Read", Value: 5}, {Op: "write", Value: 7}, {Op: "Total", Value: 12},
+			},
+		},
+	}
+
+	u := dockerapi.CalculateContainerUsage(&s)
+	if u.Name != "web" {
+		t.Errorf("expected name web, got %s", u.Name)
+	}
+	if u.CpuPercent != 40 {
+		t.Errorf("expected 40%% CPU, got %f", u.CpuPercent)
+	}
+	if u.MemoryUsage != 200 || u.MemoryPercent != 20 {
+		t.Errorf("expected 200 bytes (20%%) of memory, got %d (%f%%)", u.MemoryUsage, u.MemoryPercent)
+	}
+	if u.NetworkRx != 11 || u.NetworkTx != 22 {
+		t.Errorf("expected 11/22 network bytes, got %d/%d", u.NetworkRx, u.NetworkTx)
+	}
+	if u.BlockRead != 5 || u.BlockWrite != 7 {
+		t.Errorf("expected 5/7 block bytes, got %d/%d", u.BlockRead, u.BlockWrite)
+	}
+}
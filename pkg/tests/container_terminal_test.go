@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTerminalCmdFallsBackToSh(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  []string
+		want []string
+	}{
+		{"default", nil, []string{"sh"}},
+		{"sh", []string{"sh"}, []string{"sh"}},
+		{"shell name", []string{"bash"}, []string{"sh", "-c", `command -v "$1" >/dev/null 2>&1 && exec "$1"; exec sh`, "sh", "bash"}},
+		{"path", []string{"/bin/zsh"}, []string{"/bin/zsh"}},
+		{"arguments", []string{"top", "-b"}, []string{"top", "-b"}},
+	}
+
+	for _, tt := range tests {
+		if got := dockerapi.TerminalCmd(tt.cmd); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTerminalControlMessageIsNulPrefixedText(t *testing.T) {
+	m, err := dockerapi.TerminalControlMessage(websocket.TextMessage, []byte("\x00"+`{"type":"resize","cols":120,"rows":40}`))
+	if err != nil || m == nil || m.Type != dockerapi.TerminalControlResize || m.Cols != 120 || m.Rows != 40 {
+		t.Fatalf("expected a resize to 120x40, got %+v (%v)", m, err)
+	}
+
+	inputs := []struct {
+		name        string
+		messageType int
+		dat         string
+	}{
+		{"keystrokes", websocket.TextMessage, "ls\r"},
+		{"empty", websocket.TextMessage, ""},
+		{"binary", websocket.BinaryMessage, "\x00" + `{"type":"resize","cols":120,"rows":40}`},
+	}
+	for _, tt := range inputs {
+		if m, err := dockerapi.TerminalControlMessage(tt.messageType, []byte(tt.dat)); m != nil || err != nil {
+			t.Errorf("%s: expected input, got %+v (%v)", tt.name, m, err)
+		}
+	}
+
+	invalid := []struct {
+		name string
+		dat  string
+	}{
+		{"not json", "\x00resize"},
+		{"resize without rows", "\x00" + `{"type":"resize","cols":120}`},
+	}
+	for _, tt := range invalid {
+		if _, err := dockerapi.TerminalControlMessage(websocket.TextMessage, []byte(tt.dat)); err == nil {
+			t.Errorf("%s: expected an invalid control message", tt.name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/gorilla/websocket"
+)
+
+// sendLegacy writes a message the way agents predating protocol version 1 do.
+func sendLegacy(t *testing.T, ws *websocket.Conn, messageType string, message any) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, append([]byte(messageType+" "), data...)); err != nil {
+		t.Fatalf("send %s: %v", messageType, err)
+	}
+}
+
+// receiveLegacy reads a message in the framing of agents predating protocol version 1.
+func receiveLegacy(t *testing.T, ws *websocket.Conn, messageType string, message any) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("receive %s: %v", messageType, err)
+	}
+	payload, ok := strings.CutPrefix(string(data), messageType+" ")
+	if !ok {
+		t.Fatalf("expected %s, got %s", messageType, data)
+	}
+	if err := json.Unmarshal([]byte(payload), message); err != nil {
+		t.Fatalf("decode %s: %v", messageType, err)
+	}
+}
+
+func TestAgentWithoutProtocolVersionRunsTasks(t *testing.T) {
+	e, broker, _ := newAgentServer(t)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	wsUrl := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	rec := post(e, "/api/v1/nodes/2/generatetoken", `{"ttlMinutes":5}`)
+	var r struct {
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &r) != nil {
+		t.Fatalf("token not generated: %d %s", rec.Code, rec.Body)
+	}
+	credential, code := enroll(t, e, r.Token)
+	if code != http.StatusOK {
+		t.Fatalf("enroll failed: %d", code)
+	}
+
+	// The connect message of agents built before protocol versions existed
+	ws, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	sendLegacy(t, ws, "ConnectMessage", map[string]string{
+		"connectionToken": credential,
+		"agentVersion":    "1.7.0b-amd64@192.168.1.2",
+		"agentArch":       "amd64",
+	})
+	var connectResponse messages.ConnectResponseMessage
+	receiveLegacy(t, ws, "ConnectResponseMessage", &connectResponse)
+	if !connectResponse.Success {
+		t.Fatalf("connect rejected: %s", connectResponse.Message)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !broker.IsNodeConnected(2) {
+		if time.Now().After(deadline) {
+			t.Fatalf("agent was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	type result struct {
+		res *dockerapi.DockerVolumeListResponse
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := messages.ProcessTaskWithResponse[dockerapi.DockerVolumeList, dockerapi.DockerVolumeListResponse](
+			context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+		results <- result{res, err}
+	}()
+
+	var queued messages.TaskQueuedMessage
+	receiveLegacy(t, ws, "TaskQueuedMessage", &queued)
+	if !strings.HasPrefix(queued.TaskDefinition, "DockerVolumeList ") {
+		t.Fatalf("expected a task definition in the legacy framing, got %s", queued.TaskDefinition)
+	}
+
+	// The agent runs the task over a websocket of its own
+	taskWs, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("dial task session: %v", err)
+	}
+	defer taskWs.Close()
+	sendLegacy(t, taskWs, "TaskSessionMessage", messages.TaskSessionMessage{ConnectionToken: credential, TaskId: queued.TaskId})
+	var sessionResponse messages.TaskSessionResponseMessage
+	receiveLegacy(t, taskWs, "TaskSessionResponseMessage", &sessionResponse)
+	if !sessionResponse.Success {
+		t.Fatalf("task session rejected: %s", sessionResponse.Message)
+	}
+	taskResult := `DockerVolumeListResponse {"items":[]}`
+	sendLegacy(t, taskWs, "TaskStatusMessage", messages.TaskStatusMessage{Status: "CompletedWithSuccess", Result: &taskResult})
+
+	select {
+	case r := <-results:
+		if r.err != nil || r.res == nil {
+			t.Fatalf("expected the task result, got %+v (%v)", r.res, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task did not complete")
+	}
+}
@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/dockerapi"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+)
+
+func TestMessageRoundTripUsesEnvelope(t *testing.T) {
+	data := messages.Serialize(dockerapi.DockerContainerStop{Id: "abc"})
+
+	var e messages.Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("expected an envelope, got %s: %v", data, err)
+	}
+	if e.Type != "DockerContainerStop" || e.Version != 1 || e.Id == "" {
+		t.Fatalf("unexpected envelope header: %+v", e)
+	}
+
+	m, err := messages.Parse[dockerapi.DockerContainerStop](string(data))
+	if err != nil || m.Id != "abc" {
+		t.Fatalf("round trip failed: %+v (%v)", m, err)
+	}
+}
+
+func TestParseAcceptsLegacyFraming(t *testing.T) {
+	m, err := messages.Parse[messages.TaskStatusMessage](`TaskStatusMessage {"status":"CompletedWithSuccess","result":null}`)
+	if err != nil || m.Status != "CompletedWithSuccess" {
+		t.Fatalf("legacy message not parsed: %+v (%v)", m, err)
+	}
+	if messages.TypeOf(`Ping {}`) != "Ping" {
+		t.Fatalf("legacy type not recognized")
+	}
+}
+
+func TestParseIsStrict(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message string
+	}{
+		{"malformed payload", `{"type":"DockerContainerStop","version":1,"id":"1","payload":{"id":}`},
+		{"wrong field type", `{"type":"DockerContainerStop","version":1,"id":"1","payload":{"id":1}}`},
+		{"null payload", `{"type":"DockerContainerStop","version":1,"id":"1","payload":null}`},
+		{"missing payload", `{"type":"DockerContainerStop","version":1,"id":"1"}`},
+		{"other type", `{"type":"DockerContainerStart","version":1,"id":"1","payload":{}}`},
+		{"newer version", `{"type":"DockerContainerStop","version":2,"id":"1","payload":{}}`},
+		{"legacy trailing data", `DockerContainerStop {"id":"abc"} {}`},
+		{"no type", `{"version":1,"payload":{}}`},
+	} {
+		if m, err := messages.Parse[dockerapi.DockerContainerStop](tc.message); err == nil {
+			t.Errorf("%s: expected an error, got %+v", tc.name, m)
+		}
+	}
+}
+
+func TestUnknownFieldsAreIgnored(t *testing.T) {
+	m, err := messages.Parse[dockerapi.DockerContainerStop](`{"type":"DockerContainerStop","version":1,"id":"1","payload":{"id":"abc","addedLater":true}}`)
+	if err != nil || m.Id != "abc" {
+		t.Fatalf("expected fields added by newer peers to be ignored: %+v (%v)", m, err)
+	}
+}
+
+func TestMarshalForLegacyPeer(t *testing.T) {
+	data, err := messages.Marshal(messages.Ping{}, 1)
+	if err != nil || string(data) != "Ping {}" {
+		t.Fatalf("expected legacy framing, got %s (%v)", data, err)
+	}
+
+	taskDefinition, err := messages.Transcode(string(messages.Serialize(dockerapi.DockerContainerStop{Id: "abc"})), 1)
+	if err != nil || taskDefinition != `DockerContainerStop {"id":"abc"}` {
+		t.Fatalf("expected task definition in legacy framing, got %s (%v)", taskDefinition, err)
+	}
+
+	if _, err := messages.Marshal(struct{}{}, messages.ProtocolVersion); err == nil {
+		t.Fatalf("expected unregistered message type to fail")
+	}
+}
+
+func TestBrokerSpeaksLegacyProtocolToOldAgents(t *testing.T) {
+	broker, _ := newTaskBroker(t)
+	received := make(chan string, 1)
+	serverSession, _ := newSessionPairWithVersion(t, 1, func(stream *messages.Stream, taskDefinition string) {
+		received <- taskDefinition
+		completeTask(stream, `DockerVolumeListResponse {"items":[]}`)
+	})
+	broker.RegisterSession(2, serverSession, testTaskTypes)
+
+	res, err := messages.ProcessTaskWithResponse[dockerapi.DockerVolumeList, dockerapi.DockerVolumeListResponse](
+		context.Background(), broker, 2, dockerapi.DockerVolumeList{}, 5*time.Second)
+	if err != nil || res == nil {
+		t.Fatalf("process task with legacy agent: %+v (%v)", res, err)
+	}
+	if got := <-received; !strings.HasPrefix(got, "DockerVolumeList {") {
+		t.Fatalf("expected task definition in legacy framing, got %s", got)
+	}
+}
@@ -42,6 +42,15 @@ func (c *Client) NetworkCreate(ctx context.Context, req *types.DockerNetworkCrea
 	}, nil
 }
 
+func (m *MockDockerClient) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	res, err := m.NetworkCreateFunc(ctx, name, options)
+	if err != nil {
+		return network.CreateResponse{}, err
+	}
+
+	return network.CreateResponse{ID: res.ID, Warning: res.Warning}, nil
+}
+
 func NewMockClient(t *testing.T, mockFunc func(ctx context.Context, name string, options network.CreateOptions) (types.DockerNetworkCreateResponse, error)) *MockDockerClient {
 	return &MockDockerClient{
 		NetworkCreateFunc: mockFunc,
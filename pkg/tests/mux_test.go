@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/gorilla/websocket"
+)
+
+// newSessionPair returns the server and agent ends of a multiplexed connection. Frames read
+// from each websocket are dispatched to its session, and StreamOpenMessages received by the
+// agent are passed to onOpen.
+func newSessionPair(t *testing.T, onOpen func(stream *messages.Stream, taskDefinition string)) (*messages.Session, *messages.Session) {
+	return newSessionPairWithVersion(t, messages.ProtocolVersion, onOpen)
+}
+
+// newSessionPairWithVersion is newSessionPair where both ends speak the given protocol version.
+func newSessionPairWithVersion(t *testing.T, protocolVersion uint, onOpen func(stream *messages.Stream, taskDefinition string)) (*messages.Session, *messages.Session) {
+	serverSessions := make(chan *messages.Session, 1)
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		session := messages.NewSession(ws, protocolVersion)
+		serverSessions <- session
+		go readLoop(ws, session, nil)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	agentSession := messages.NewSession(ws, protocolVersion)
+	go readLoop(ws, agentSession, onOpen)
+
+	return <-serverSessions, agentSession
+}
+
+func readLoop(ws *websocket.Conn, session *messages.Session, onOpen func(*messages.Stream, string)) {
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			session.Shutdown(err)
+			return
+		}
+
+		messageString := string(message)
+		messageType := messages.TypeOf(messageString)
+		if session.Dispatch(messageType, messageString) {
+			continue
+		}
+
+		if messageType == "StreamOpenMessage" && onOpen != nil {
+			m, _ := messages.Parse[messages.StreamOpenMessage](messageString)
+			stream, err := session.Accept(m.StreamId)
+			if err != nil {
+				continue
+			}
+			go onOpen(stream, m.TaskDefinition)
+		}
+	}
+}
+
+func TestStreamsAreMultiplexed(t *testing.T) {
+	echo := func(stream *messages.Stream, taskDefinition string) {
+		defer stream.Close()
+		stream.WriteMessage(websocket.TextMessage, []byte(taskDefinition))
+		for {
+			mt, dat, err := stream.ReadMessage()
+			if err != nil {
+				return
+			}
+			stream.WriteMessage(mt, dat)
+		}
+	}
+	serverSession, _ := newSessionPair(t, echo)
+
+	a := messages.NewStream("a")
+	b := messages.NewStream("b")
+	if err := serverSession.Open(a, "task-a"); err != nil {
+		t.Fatalf("open a: %v", err)
+	}
+	if err := serverSession.Open(b, "task-b"); err != nil {
+		t.Fatalf("open b: %v", err)
+	}
+
+	for _, tc := range []struct {
+		stream *messages.Stream
+		want   string
+	}{{a, "task-a"}, {b, "task-b"}} {
+		tc.stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, dat, err := tc.stream.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %s: %v", tc.stream.Id, err)
+		}
+		if string(dat) != tc.want {
+			t.Fatalf("expected %q on stream %s, got %q", tc.want, tc.stream.Id, dat)
+		}
+	}
+
+	b.WriteMessage(websocket.BinaryMessage, []byte("hello b"))
+	_, dat, err := b.ReadMessage()
+	if err != nil || string(dat) != "hello b" {
+		t.Fatalf("expected echo on stream b, got %q (%v)", dat, err)
+	}
+
+	a.Close()
+	b.WriteMessage(websocket.BinaryMessage, []byte("still open"))
+	_, dat, err = b.ReadMessage()
+	if err != nil || string(dat) != "still open" {
+		t.Fatalf("closing stream a affected stream b: %q (%v)", dat, err)
+	}
+}
+
+func TestStreamEndsWhenRemoteCloses(t *testing.T) {
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		stream.WriteMessage(websocket.TextMessage, []byte("done"))
+		stream.Close()
+	})
+
+	s := messages.NewStream("task")
+	if err := serverSession.Open(s, "task"); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, dat, err := s.ReadMessage()
+	if err != nil || string(dat) != "done" {
+		t.Fatalf("expected buffered data before close, got %q (%v)", dat, err)
+	}
+	if _, _, err := s.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected io.EOF after remote close, got %v", err)
+	}
+}
+
+func TestStreamsEndWhenSessionShutsDown(t *testing.T) {
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {})
+
+	s := messages.NewStream("task")
+	if err := serverSession.Open(s, "task"); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	serverSession.Shutdown(messages.ErrSessionClosed)
+	if _, _, err := s.ReadMessage(); err != messages.ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	if err := serverSession.Open(messages.NewStream("late"), "task"); err != messages.ErrSessionClosed {
+		t.Fatalf("expected open on closed session to fail, got %v", err)
+	}
+}
+
+func TestStreamWriterWaitsForSlowReader(t *testing.T) {
+	const chunks = 64 // 4 MiB, well beyond the window of a stream
+	written := make(chan int, 1)
+	serverSession, _ := newSessionPair(t, func(stream *messages.Stream, taskDefinition string) {
+		if taskDefinition != "slow" {
+			stream.WriteMessage(websocket.TextMessage, []byte(taskDefinition))
+			return
+		}
+
+		chunk := make([]byte, 64<<10)
+		n := 0
+		for ; n < chunks; n++ {
+			if err := stream.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+				break
+			}
+		}
+		written <- n
+	})
+
+	slow := messages.NewStream("slow")
+	if err := serverSession.Open(slow, "slow"); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	select {
+	case n := <-written:
+		t.Fatalf("writer sent %d chunks while nothing was read", n)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Other streams of the connection are not held up by the slow one
+	other := messages.NewStream("other")
+	echoed := make(chan error, 1)
+	go func() {
+		other.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := other.ReadMessage()
+		echoed <- err
+	}()
+	if err := serverSession.Open(other, "other"); err != nil {
+		t.Fatalf("open other: %v", err)
+	}
+	if err := <-echoed; err != nil {
+		t.Fatalf("read other stream: %v", err)
+	}
+
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < chunks; i++ {
+		if _, _, err := slow.ReadMessage(); err != nil {
+			t.Fatalf("read chunk %d: %v", i, err)
+		}
+	}
+	if n := <-written; n != chunks {
+		t.Fatalf("expected %d chunks written, got %d", chunks, n)
+	}
+}
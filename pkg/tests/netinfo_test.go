@@ -0,0 +1,34 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/common"
+)
+
+func TestParseDefaultRoute(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`
+	iface, gateway := common.ParseDefaultRoute(bufio.NewScanner(strings.NewReader(table)))
+	if iface != "eth0" || gateway != "192.168.1.1" {
+		t.Fatalf("expected eth0 via 192.168.1.1, got %s via %s", iface, gateway)
+	}
+
+	iface, gateway = common.ParseDefaultRoute(bufio.NewScanner(strings.NewReader("Iface\tDestination\tGateway\n")))
+	if iface != "" || gateway != "" {
+		t.Fatalf("expected no default route, got %s via %s", iface, gateway)
+	}
+}
+
+func TestAgentVersionNumberIgnoresLegacySuffix(t *testing.T) {
+	for _, v := range []string{"1.7.0b", "1.7.0b-amd64", "1.7.0b-arm64@192.168.1.2+zt:10.0.0.1"} {
+		if got := common.AgentVersionNumber(v); got != "1.7.0b" {
+			t.Fatalf("expected 1.7.0b for %s, got %s", v, got)
+		}
+	}
+}
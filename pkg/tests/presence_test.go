@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+	"github.com/dokemon-ng/dokemon/pkg/server/presence"
+	"github.com/dokemon-ng/dokemon/pkg/server/store"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func newPresenceRegistry(t *testing.T) (*presence.Registry, store.NodeStore) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&model.Node{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := db.Create(&model.Node{Id: 2, Name: "agent"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	nodeStore := store.NewSqlNodeStore(db)
+	return presence.NewRegistry(nodeStore, time.Hour), nodeStore
+}
+
+func nextEvent(t *testing.T, events <-chan presence.Event) presence.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("expected a presence event")
+		return presence.Event{}
+	}
+}
+
+func TestPresenceReportsTransitionsOfCurrentConnection(t *testing.T) {
+	registry, _ := newPresenceRegistry(t)
+	_, events, unsubscribe := registry.Subscribe()
+	defer unsubscribe()
+
+	first := registry.Connected(2)
+	if e := nextEvent(t, events); e.NodeId != 2 || !e.Online {
+		t.Fatalf("expected node 2 online, got %+v", e)
+	}
+
+	// The agent reconnected before the server noticed the first connection was lost
+	second := registry.Connected(2)
+	registry.Disconnected(2, first, "connection reset")
+	if !registry.IsOnline(2) {
+		t.Fatalf("expected the newer connection to keep the node online")
+	}
+
+	registry.Disconnected(2, second, "connection reset")
+	if e := nextEvent(t, events); e.Online || e.Reason != "connection reset" {
+		t.Fatalf("expected node 2 offline, got %+v", e)
+	}
+	if registry.IsOnline(2) {
+		t.Fatalf("expected node 2 offline")
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestPresenceBatchesLastPing(t *testing.T) {
+	registry, nodeStore := newPresenceRegistry(t)
+
+	id := registry.Connected(2)
+	node, _ := nodeStore.GetById(2)
+	if node.LastPing == nil {
+		t.Fatalf("expected the first ping to be written right away")
+	}
+	connectedAt := *node.LastPing
+
+	time.Sleep(10 * time.Millisecond)
+	registry.Seen(2, id)
+	node, _ = nodeStore.GetById(2)
+	if !node.LastPing.Equal(connectedAt) {
+		t.Fatalf("expected pings to be written in batches")
+	}
+
+	registry.Flush()
+	node, _ = nodeStore.GetById(2)
+	if !node.LastPing.After(connectedAt) {
+		t.Fatalf("expected the last ping to be written on flush")
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ssl"
+)
+
+// newMutualTLSServer starts an HTTPS server using a certificate issued by a fresh CA. It
+// responds with the common name of the client certificate, if any.
+func newMutualTLSServer(t *testing.T) (*ssl.CertificateAuthority, *httptest.Server) {
+	dir := t.TempDir()
+	ca, err := ssl.LoadOrCreateCertificateAuthority(path.Join(dir, "ca.crt"), path.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, err := ca.IssueServerCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.Pool(),
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return ca, server
+}
+
+func get(config *tls.Config, url string) (string, error) {
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	res, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestPinnedCAWithClientCertificate(t *testing.T) {
+	ca, server := newMutualTLSServer(t)
+
+	key, csr, err := ssl.GenerateClientKey("ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ca.SignClientCertificate(csr, "node-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fingerprints are accepted in the colon separated form shown by most tools
+	fingerprint := strings.ToUpper(ca.Fingerprint())
+	config := ssl.PinnedClientConfig(fingerprint[:2] + ":" + fingerprint[2:])
+	config.Certificates = []tls.Certificate{cert}
+
+	name, err := get(config, server.URL)
+	if err != nil || name != "node-2" {
+		t.Fatalf("expected the client certificate to be verified, got %q (%v)", name, err)
+	}
+}
+
+func TestPinnedCARejectsOtherServers(t *testing.T) {
+	_, server := newMutualTLSServer(t)
+	other, _ := newMutualTLSServer(t)
+
+	_, err := get(ssl.PinnedClientConfig(other.Fingerprint()), server.URL)
+	if err == nil || !strings.Contains(err.Error(), ssl.ErrFingerprintMismatch.Error()) {
+		t.Fatalf("expected fingerprint mismatch, got %v", err)
+	}
+}
+
+func TestSignClientCertificateRejectsInvalidCSR(t *testing.T) {
+	ca, _ := newMutualTLSServer(t)
+
+	if _, err := ca.SignClientCertificate("not a csr", "node-2"); err != ssl.ErrInvalidCSR {
+		t.Fatalf("expected invalid CSR error, got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ske"
+	"github.com/dokemon-ng/dokemon/pkg/crypto/ssl"
+	"github.com/dokemon-ng/dokemon/pkg/messages"
+	"github.com/dokemon-ng/dokemon/pkg/server/handler"
+	"github.com/dokemon-ng/dokemon/pkg/server/model"
+	"github.com/dokemon-ng/dokemon/pkg/server/presence"
+	"github.com/dokemon-ng/dokemon/pkg/server/router"
+	"github.com/dokemon-ng/dokemon/pkg/server/store"
+
+	"github.com/glebarez/sqlite"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// newNodeTokenServer returns the routes of a server with a single agent node, id 2.
+func newNodeTokenServer(t *testing.T) *echo.Echo {
+	e, _, _ := newAgentServer(t)
+	return e
+}
+
+// newAgentServer is newNodeTokenServer along with the task broker and the presence registry
+// of the server. Agents connect on /ws. Node 3 is an agent node which never connects.
+func newAgentServer(t *testing.T) (*echo.Echo, *messages.TaskBroker, *presence.Registry) {
+	key, err := ske.GenerateRandomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ske.Init(key)
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&model.Node{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := db.Create([]model.Node{{Id: 2, Name: "agent"}, {Id: 3, Name: "offline"}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := ssl.LoadOrCreateCertificateAuthority(filepath.Join(t.TempDir(), "ca.crt"), filepath.Join(t.TempDir(), "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker, taskStore := newTaskBroker(t)
+	nodeStore := store.NewSqlNodeStore(db)
+	presenceRegistry := presence.NewRegistry(nodeStore, presence.DefaultFlushPeriod)
+	h := handler.NewHandler("", nil, nil, nil, nil, nodeStore, nil, nil, nil, nil, nil, nil, taskStore, broker, presenceRegistry, ca)
+
+	// Register would also serve the web UI, which isn't built for tests
+	e := router.New()
+	e.POST("/agent/enroll", h.EnrollAgent)
+	e.POST("/agent/certificate", h.IssueAgentCertificate)
+	e.POST("/api/v1/nodes/:id/generatetoken", h.GenerateRegistrationToken)
+	e.POST("/api/v1/nodes/:id/revoketoken", h.RevokeNodeToken)
+	e.POST("/api/v1/nodes/:id/resetcertificate", h.ResetNodeCertificate)
+	e.GET("/ws", h.HandleWebSocket)
+	e.POST("/api/v1/containers/bulk", h.BulkContainerAction)
+	e.POST("/api/v1/nodes/:nodeId/containers/pause", h.PauseContainer)
+	e.POST("/api/v1/nodes/:nodeId/containers/unpause", h.UnpauseContainer)
+	e.POST("/api/v1/nodes/:nodeId/containers/kill", h.KillContainer)
+	e.POST("/api/v1/nodes/:nodeId/containers/rename", h.RenameContainer)
+	e.GET("/api/v1/nodes/:nodeId/containers/:id/logs/download", h.DownloadContainerLogs)
+
+	return e, broker, presenceRegistry
+}
+
+func post(e *echo.Echo, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func enroll(t *testing.T, e *echo.Echo, token string) (string, int) {
+	body, _ := json.Marshal(messages.EnrollRequest{Token: token})
+	rec := post(e, "/agent/enroll", string(body))
+
+	var r messages.EnrollResponse
+	json.Unmarshal(rec.Body.Bytes(), &r)
+	return r.Credential, rec.Code
+}
+
+func TestEnrollmentTokenIsExchangedOnce(t *testing.T) {
+	e := newNodeTokenServer(t)
+
+	rec := post(e, "/api/v1/nodes/2/generatetoken", `{"ttlMinutes":5}`)
+	var r struct {
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &r) != nil {
+		t.Fatalf("token not generated: %d %s", rec.Code, rec.Body)
+	}
+
+	credential, code := enroll(t, e, r.Token)
+	if code != http.StatusOK || credential == "" || credential == r.Token {
+		t.Fatalf("expected a credential, got %d %q", code, credential)
+	}
+
+	if _, code := enroll(t, e, r.Token); code != http.StatusUnauthorized {
+		t.Fatalf("expected the enrollment token to be consumed, got %d", code)
+	}
+
+	// Agents call enroll on every start with whatever token they have
+	if same, code := enroll(t, e, credential); code != http.StatusOK || same != credential {
+		t.Fatalf("expected the credential to be returned unchanged, got %d", code)
+	}
+
+	if rec := post(e, "/api/v1/nodes/2/revoketoken", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke failed: %d %s", rec.Code, rec.Body)
+	}
+	if _, code := enroll(t, e, credential); code != http.StatusUnauthorized {
+		t.Fatalf("expected the credential to be revoked, got %d", code)
+	}
+}
+
+func TestGenerateTokenRejectsLongTtl(t *testing.T) {
+	e := newNodeTokenServer(t)
+
+	if rec := post(e, "/api/v1/nodes/2/generatetoken", `{"ttlMinutes":100000}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected ttl to be validated, got %d", rec.Code)
+	}
+}
+
+func TestCertificateIsReissuedOnlyAfterReset(t *testing.T) {
+	e := newNodeTokenServer(t)
+
+	rec := post(e, "/api/v1/nodes/2/generatetoken", `{"ttlMinutes":5}`)
+	var r struct {
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &r) != nil {
+		t.Fatalf("token not generated: %d %s", rec.Code, rec.Body)
+	}
+	credential, code := enroll(t, e, r.Token)
+	if code != http.StatusOK {
+		t.Fatalf("enroll failed: %d", code)
+	}
+
+	_, csr, err := ssl.GenerateClientKey("dokemon-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(messages.CertificateRequest{ConnectionToken: credential, CSR: csr})
+
+	if rec := post(e, "/agent/certificate", string(body)); rec.Code != http.StatusOK {
+		t.Fatalf("expected a certificate, got %d %s", rec.Code, rec.Body)
+	}
+
+	// The token alone doesn't replace the certificate of the agent
+	if rec := post(e, "/agent/certificate", string(body)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected the current certificate to be required, got %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := post(e, "/api/v1/nodes/2/resetcertificate", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("reset failed: %d %s", rec.Code, rec.Body)
+	}
+	if rec := post(e, "/agent/certificate", string(body)); rec.Code != http.StatusOK {
+		t.Fatalf("expected a certificate after the reset, got %d %s", rec.Code, rec.Body)
+	}
+}
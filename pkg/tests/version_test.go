@@ -0,0 +1,27 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/dokemon-ng/dokemon/pkg/common"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.7.0b", "1.7.0b", 0},
+		{"1.6.9", "1.7.0b", -1},
+		{"1.7.0", "1.7.0b", -1},
+		{"1.7.0b", "1.7.0c", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"1.7", "1.7.0", 0},
+		{"v1.8.0", "1.7.0b", 1},
+		{common.AgentVersionNumber("1.6.2-amd64@192.168.1.2+zt:10.0.0.1"), "1.6.2", 0},
+	} {
+		if got := common.CompareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
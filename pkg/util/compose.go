@@ -7,6 +7,7 @@
 	"path/filepath"
 	"sort"
 
+	"github.com/dokemon-ng/dokemon/pkg/messages"
 	"github.com/dokemon-ng/dokemon/pkg/server/store"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
@@ -24,7 +25,7 @@ func ToEnvFormat(variables map[string]store.VariableValue) []string {
 	return ret
 }
 
-func LogVars(cmd *exec.Cmd, variables map[string]store.VariableValue, ws *websocket.Conn, print bool) {
+func LogVars(cmd *exec.Cmd, variables map[string]store.VariableValue, ws messages.Conn, print bool) {
 	if print {
 		ws.WriteMessage(websocket.TextMessage, []byte("*** SETTING BELOW VARIABLES: ***\n\n"))
 	}
@@ -43,14 +43,6 @@ export default function ContainerTerminal() {
     if (container?.state === "running") {
       setLastContainerId(container.id)
       const terminal = newTerminal(false)
-
-      if (socket) socket.close()
-      const s = new WebSocket(
-        `${wsApiBaseUrl()}/nodes/${nodeId}/containers/${containerId}/terminal`
-      )
-      setSocket(s)
-
-      terminal.loadAddon(new AttachAddon(s))
       const fitAddon = new FitAddon()
       terminal.loadAddon(fitAddon)
 
@@ -61,6 +53,20 @@ export default function ContainerTerminal() {
       terminal.open(terminalEl!)
       printDokemonLogo(terminal)
       fitAddon.fit()
+
+      // bash falls back to sh in containers that don't have it. The TTY starts with the size
+      // of the terminal and follows it through resize control messages.
+      if (socket) socket.close()
+      const s = new WebSocket(
+        `${wsApiBaseUrl()}/nodes/${nodeId}/containers/${containerId}/terminal?cmd=bash&cols=${terminal.cols}&rows=${terminal.rows}`
+      )
+      setSocket(s)
+
+      terminal.loadAddon(new AttachAddon(s))
+      terminal.onResize(({ cols, rows }) => {
+        if (s.readyState !== WebSocket.OPEN) return
+        s.send("\x00" + JSON.stringify({ type: "resize", cols, rows }))
+      })
       addEventListener("resize", () => {
         fitAddon?.fit()
       })
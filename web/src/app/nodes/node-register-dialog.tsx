@@ -41,6 +41,7 @@ docker run \\
     -e SERVER_URL=${setting?.value} \\
     -e TOKEN={HIDDEN} \\
     -v /var/run/docker.sock:/var/run/docker.sock \\
+    -v dokemon-agent-data:/data \\
     --name dokemon-agent --restart unless-stopped \\
     -d javastraat/dokemon-agent:latest && \\
     docker run \\